@@ -9,6 +9,12 @@ app_name="mExpoter"
 # Directory to store build files
 output_dir="builds"
 
+# Build information shown by -version
+version=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+commit=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+build_date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+ldflags="-X cmd_pg_mongo/migrator.Version=$version -X cmd_pg_mongo/migrator.Commit=$commit -X cmd_pg_mongo/migrator.BuildDate=$build_date"
+
 # Create output directory if it doesn't exist
 mkdir -p $output_dir
 
@@ -24,7 +30,7 @@ do
     fi
 
     echo "Building for $platform..."
-    env GOOS=$GOOS GOARCH=$GOARCH go build -o $output_dir/$output_name main.go
+    env GOOS=$GOOS GOARCH=$GOARCH go build -ldflags "$ldflags" -o $output_dir/$output_name .
 
     if [ $? -ne 0 ]; then
         echo "An error has occurred! Aborting the script execution..."
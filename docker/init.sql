@@ -0,0 +1,20 @@
+-- Sample data for trying the migration end to end against the postgres service of docker-compose.yml.
+-- It covers the column types with their own conversion, NULLs included.
+CREATE TYPE mood AS ENUM ('sad', 'ok', 'happy');
+
+CREATE TABLE sample (
+    id          serial PRIMARY KEY,
+    name        text NOT NULL,
+    price       numeric(12, 2),
+    created_at  timestamptz DEFAULT now(),
+    attributes  jsonb,
+    tags        text[],
+    external_id uuid,
+    payload     bytea,
+    feeling     mood
+);
+
+INSERT INTO sample (name, price, attributes, tags, external_id, payload, feeling) VALUES
+    ('first', 10.50, '{"color": "red", "sizes": [1, 2]}', '{a,b}', 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', '\x0102', 'happy'),
+    ('second', NULL, NULL, '{}', NULL, NULL, NULL),
+    ('third', 12345678901.99, '[]', '{NULL,c}', 'b1ffcd88-8d1a-4ef8-bb6d-6bb9bd380a22', '\x', 'sad');
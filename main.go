@@ -2,239 +2,651 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"cmd_pg_mongo/migrator"
 )
 
-// Config struct to hold database configuration
-type Config struct {
-	Postgres struct {
-		Host      string   `mapstructure:"host"`
-		Port      int      `mapstructure:"port"`
-		Database  string   `mapstructure:"database"`
-		User      string   `mapstructure:"user"`
-		Password  string   `mapstructure:"password"`
-		Tables    []string `mapstructure:"tables"`
-		AllTables bool     `mapstructure:"all_tables"`
-		SkipEmpty bool     `mapstructure:"skip_empty"`
-	} `mapstructure:"postgres"`
-
-	MongoDB struct {
-		URI      string `mapstructure:"uri"`
-		Database string `mapstructure:"database"`
-	} `mapstructure:"mongodb"`
+// migrateOptions holds the flags of the migrate command, which is also what runs without a command
+type migrateOptions struct {
+	resume          bool
+	restart         bool
+	continueOnError bool
+	dryRun          bool
+	dryRunDocs      int
+	showProgress    bool
+	verify          bool
+
+	maxDocsPerSecond    int
+	maxDocsPerSecondSet bool
+
+	schedule string
+
+	skipMissingTables bool
+
+	sample       int
+	sampleRandom bool
+
+	report            string
+	failOnDroppedRows bool
+
+	checkIDs bool
+
+	force bool
 }
 
 func main() {
-	// Parse command-line arguments
-	configFile := flag.String("config", "config.yml", "path to the config file")
-	flag.Parse()
+	var configFile string
+	var migrate migrateOptions
+	var listTables bool
+
+	root := &cobra.Command{
+		Use:           "cmd_pg_mongo",
+		Short:         "Copy PostgreSQL tables into MongoDB collections",
+		Version:       migrator.VersionString(),
+		Args:          cobra.NoArgs,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		Run: func(cmd *cobra.Command, args []string) {
+			if listTables {
+				runList(configFile)
+				return
+			}
+			migrate.maxDocsPerSecondSet = cmd.Flags().Changed("max-docs-per-second")
+			runMigrate(configFile, migrate)
+		},
+	}
+	root.SetVersionTemplate("{{.Version}}\n")
+	root.PersistentFlags().StringVar(&configFile, "config", "config.yml", "path to the config file")
+	if err := migrator.RegisterConnectionFlags(root.PersistentFlags()); err != nil {
+		fatalf("Error registering flags: %v", err)
+	}
+	addMigrateFlags(root.Flags(), &migrate)
+	root.Flags().BoolVar(&listTables, "list-tables", false, "print the tables all_tables would migrate, like the list command")
+	root.Flags().MarkDeprecated("list-tables", "use the list command instead")
+
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Copy the configured tables into MongoDB (the default)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			migrate.maxDocsPerSecondSet = cmd.Flags().Changed("max-docs-per-second")
+			runMigrate(configFile, migrate)
+		},
+	}
+	addMigrateFlags(migrateCmd.Flags(), &migrate)
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Print the tables all_tables would migrate with their estimated row counts",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runList(configFile)
+		},
+	}
 
-	// Load configuration from the specified file or default config.yml using viper
-	config, err := loadConfig(*configFile)
-	if err != nil {
-		log.Fatalf("Error loading configuration: %v\n", err)
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Compare the row count of every table with the document count of its collection",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runVerify(configFile)
+		},
 	}
 
-	// Connect to PostgreSQL
-	pgConn, err := connectToPostgreSQL(config)
-	if err != nil {
-		log.Fatalf("Error connecting to PostgreSQL: %v\n", err)
+	var importDir string
+	importCmd := &cobra.Command{
+		Use:   "import",
+		Short: "Load the .bson files written by output.target bson (or mongodump) into MongoDB",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runImport(configFile, importDir)
+		},
+	}
+	importCmd.Flags().StringVar(&importDir, "dir", "", "directory of the dump, defaults to output.path")
+
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version, commit and build date",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(migrator.VersionString())
+		},
 	}
-	defer pgConn.Close()
 
-	// Connect to MongoDB
-	mongoClient, err := connectToMongoDB(config)
-	if err != nil {
-		log.Fatalf("Error connecting to MongoDB: %v\n", err)
+	root.AddCommand(migrateCmd, listCmd, verifyCmd, importCmd, versionCmd)
+	root.SetArgs(normalizeArgs(os.Args[1:]))
+	if err := root.Execute(); err != nil {
+		fatalf("%v", err)
 	}
-	defer mongoClient.Disconnect(context.Background())
+}
 
-	if config.Postgres.AllTables {
-		// Fetch all table names from PostgreSQL
-		tables, err := getAllPostgresTables(pgConn, config.Postgres.Database)
-		if err != nil {
-			log.Fatalf("Error fetching table names from PostgreSQL: %v\n", err)
+// addMigrateFlags defines the flags of the migrate command on fs
+func addMigrateFlags(fs *pflag.FlagSet, opts *migrateOptions) {
+	fs.BoolVar(&opts.resume, "resume", true, "resume paginated tables from the checkpoint of an unfinished run")
+	fs.BoolVar(&opts.restart, "restart", false, "clear existing checkpoints and start every table from the beginning")
+	fs.BoolVar(&opts.continueOnError, "continue-on-error", false, "skip rows that fail to convert or insert, logging them to the dead-letter file")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "read and convert every table but only print documents instead of writing to MongoDB")
+	fs.IntVar(&opts.dryRunDocs, "dry-run-docs", 3, "number of documents printed per table in dry-run mode")
+	fs.BoolVar(&opts.showProgress, "progress", false, "report the progress and ETA of every table")
+	fs.BoolVar(&opts.verify, "verify", false, "after the migration compare the row count of every table with the document count of its collection")
+	fs.IntVar(&opts.maxDocsPerSecond, "max-docs-per-second", 0, "limit the documents written to MongoDB per second, overrides mongodb.max_docs_per_second (0 is unlimited)")
+	fs.BoolVar(&opts.skipMissingTables, "skip-missing-tables", false, "warn about configured tables that do not exist and migrate the others, like postgres.missing_tables: skip")
+	fs.IntVar(&opts.sample, "sample", 0, "read at most N rows of every table without a limit, overrides migration.sample")
+	fs.BoolVar(&opts.sampleRandom, "sample-random", false, "pick the sampled rows at random with ORDER BY random(), like migration.sample_random")
+	fs.StringVar(&opts.report, "report", "", "write a JSON summary of the run to this file, overrides migration.report_file")
+	fs.BoolVar(&opts.failOnDroppedRows, "fail-on-dropped-rows", false, "exit with an error when rows were skipped or rejected by MongoDB, like migration.fail_on_dropped_rows")
+	fs.BoolVar(&opts.checkIDs, "check-ids", false, "read and convert every table without writing anything, reporting rows that get the same _id (a --dry-run printing no documents)")
+	fs.BoolVar(&opts.force, "force", false, "migrate even when the pre-flight check finds tables incompatible with the configuration")
+	fs.StringVar(&opts.schedule, "schedule", "", "keep running and repeat the migration on this cron expression or interval (e.g. 15m), overrides migration.schedule")
+}
+
+// normalizeArgs rewrites single-dash long flags such as -config=custom.yml, which the standard
+// flag package accepted, to the --config form cobra expects. Negative numbers are left alone.
+func normalizeArgs(args []string) []string {
+	normalized := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			copy(normalized[i:], args[i:])
+			break
 		}
-		config.Postgres.Tables = tables
+		if len(arg) > 2 && arg[0] == '-' && arg[1] != '-' && (arg[1] < '0' || arg[1] > '9') {
+			arg = "-" + arg
+		}
+		normalized[i] = arg
 	}
+	return normalized
+}
 
-	// Fetch data from PostgreSQL and insert into MongoDB
-	for _, table := range config.Postgres.Tables {
-		fmt.Printf("Transferring data from table %s...\n", table)
-		err = fetchDataFromPostgresAndInsertToMongo(pgConn, mongoClient, table, config.MongoDB.Database, table, config.Postgres.SkipEmpty)
-		if err != nil {
-			log.Printf("Error transferring data from table %s: %v\n", table, err)
-		} else {
-			fmt.Printf("Data transfer from PostgreSQL table %s to MongoDB completed successfully.\n", table)
-		}
+// loadConfig reads the config file and sets up logging, exiting on failure
+func loadConfig(configFile string) migrator.Config {
+	config, err := migrator.LoadConfig(configFile)
+	if err != nil {
+		fatalf("Error loading configuration: %v", err)
 	}
+	setupLogging(config)
+	return config
 }
 
-// loadConfig reads the config file and parses it into a Config struct
-func loadConfig(filename string) (Config, error) {
-	var config Config
+// setupLogging configures the logger from the config and logs the version, exiting on failure
+func setupLogging(config migrator.Config) {
+	logger, err := migrator.NewLogger(config.LogFormat, config.LogLevel)
+	if err != nil {
+		fatalf("Error configuring logging: %v", err)
+	}
+	migrator.SetLogger(logger)
+	logger.Info("Starting %s", migrator.VersionString())
+}
 
-	viper.SetConfigFile(filename)
-	if err := viper.ReadInConfig(); err != nil {
-		return config, fmt.Errorf("failed to read config file: %v", err)
+// commandContext returns the root context, cancelled on SIGINT/SIGTERM or when the configured timeout elapses
+func commandContext(config migrator.Config) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if config.Migration.Timeout <= 0 {
+		return ctx, stop
 	}
+	ctx, cancel := context.WithTimeout(ctx, config.Migration.Timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
 
-	if err := viper.Unmarshal(&config); err != nil {
-		return config, fmt.Errorf("failed to unmarshal config: %v", err)
+// connectPostgres opens the PostgreSQL connection of a source
+func connectPostgres(ctx context.Context, config migrator.Config) (*pgxpool.Pool, error) {
+	pgConn, err := migrator.ConnectToPostgreSQL(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to PostgreSQL%s: %v", sourceLabel(config), err)
 	}
+	return pgConn, nil
+}
 
-	return config, nil
+// connectMongo opens the MongoDB connection shared by all sources, exiting on failure. Sources
+// cannot change the connection settings, so the first one provides them fully expanded.
+// It returns nil when the documents are written to files instead.
+func connectMongo(ctx context.Context, config migrator.Config) *mongo.Client {
+	if !config.WritesToMongoDB() {
+		return nil
+	}
+	mongoClient, err := migrator.ConnectToMongoDB(ctx, config.PostgresSources()[0])
+	if err != nil {
+		fatalf("Error connecting to MongoDB: %v", err)
+	}
+	return mongoClient
 }
 
-// connectToPostgreSQL establishes a connection to PostgreSQL
-func connectToPostgreSQL(pgConfig Config) (*pgxpool.Pool, error) {
-	connStr := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s pool_max_conns=10",
-		pgConfig.Postgres.Host, pgConfig.Postgres.Port, pgConfig.Postgres.Database, pgConfig.Postgres.User, pgConfig.Postgres.Password)
+// sourceLabel names the source of config in messages, or returns "" without a sources list
+func sourceLabel(config migrator.Config) string {
+	if config.SourceName == "" {
+		return ""
+	}
+	return " (source " + config.SourceName + ")"
+}
 
-	poolConfig, err := pgxpool.ParseConfig(connStr)
+// resolveTables fills in the tables of a source
+func resolveTables(ctx context.Context, pgConn *pgxpool.Pool, config *migrator.Config) error {
+	tables, err := migrator.ResolveTables(ctx, pgConn, *config)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("error fetching table names from PostgreSQL%s: %v", sourceLabel(*config), err)
 	}
+	config.Postgres.Tables = tables
+	return nil
+}
 
-	pool, err := pgxpool.ConnectConfig(context.Background(), poolConfig)
-	if err != nil {
-		return nil, err
+// runMigrate copies the configured tables of every source into MongoDB, once or on the
+// configured schedule
+func runMigrate(configFile string, opts migrateOptions) {
+	config := loadConfig(configFile)
+	if opts.sample < 0 {
+		fatalf("--sample must not be negative, got %d", opts.sample)
+	}
+	if opts.schedule != "" {
+		config.Migration.Schedule = opts.schedule
+	}
+	if opts.report != "" {
+		config.Migration.ReportFile = opts.report
+	}
+	if opts.failOnDroppedRows {
+		config.Migration.FailOnDroppedRows = true
+	}
+	if config.Migration.Schedule != "" {
+		runScheduled(config, opts)
+		return
 	}
 
-	return pool, nil
-}
+	ctx, cancel := commandContext(config)
+	defer cancel()
 
-// connectToMongoDB establishes a connection to MongoDB
-func connectToMongoDB(mongoConfig Config) (*mongo.Client, error) {
-	ctx := context.Background()
+	if config.Metrics.Address != "" {
+		stopMetrics, err := migrator.ServeMetrics(ctx, config.Metrics.Address)
+		if err != nil {
+			fatalf("Error starting the metrics server: %v", err)
+		}
+		defer stopMetrics()
+	}
 
-	clientOptions := options.Client().ApplyURI(mongoConfig.MongoDB.URI)
-	client, err := mongo.Connect(ctx, clientOptions)
-	if err != nil {
-		return nil, err
+	mongoClient := connectMongo(ctx, config)
+	if mongoClient != nil {
+		defer mongoClient.Disconnect(context.Background())
 	}
 
-	// Check the connection
-	err = client.Ping(ctx, nil)
+	if err := migrateSources(ctx, mongoClient, config, opts); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// runScheduled stays resident and repeats the migration on migration.schedule. The first SIGINT or
+// SIGTERM stops the tool once the current run is done, a second one cancels that run. A failed run
+// is logged and retried at the next scheduled time.
+func runScheduled(config migrator.Config, opts migrateOptions) {
+	logger := migrator.CurrentLogger()
+	schedule, err := migrator.ParseSchedule(config.Migration.Schedule)
 	if err != nil {
-		return nil, err
+		fatalf("Error parsing the schedule: %v", err)
 	}
 
-	return client, nil
-}
+	stopCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	runCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+		case <-runCtx.Done():
+			return
+		}
+		logger.Info("Stopping after the current run, signal again to cancel it")
+		stop()
+		select {
+		case <-signals:
+			logger.Info("Cancelling the current run")
+			abort()
+		case <-runCtx.Done():
+		}
+	}()
 
-// getAllPostgresTables retrieves all table names from the PostgreSQL database
-func getAllPostgresTables(pgConn *pgxpool.Pool, databaseName string) ([]string, error) {
-	ctx := context.Background()
+	if config.Metrics.Address != "" {
+		stopMetrics, err := migrator.ServeMetrics(runCtx, config.Metrics.Address)
+		if err != nil {
+			fatalf("Error starting the metrics server: %v", err)
+		}
+		defer stopMetrics()
+	}
 
-	query := `
-		SELECT table_name
-		FROM information_schema.tables
-		WHERE table_schema = 'public' AND table_type = 'BASE TABLE'
-	`
+	mongoClient := connectMongo(runCtx, config)
+	if mongoClient != nil {
+		defer mongoClient.Disconnect(context.Background())
+	}
 
-	rows, err := pgConn.Query(ctx, query)
-	if err != nil {
-		return nil, fmt.Errorf("error querying PostgreSQL for table names: %v", err)
+	for _, source := range config.PostgresSources() {
+		if tables := migrator.RepeatedInserts(source); len(tables) > 0 {
+			logger.Warn("Tables without an incremental column are inserted in full on every run%s: %s; set incremental, mongodb.mode: upsert or drop_before_import", sourceLabel(source), strings.Join(tables, ", "))
+		}
 	}
-	defer rows.Close()
 
-	var tables []string
-	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
-			return nil, fmt.Errorf("error scanning table name: %v", err)
+	for cycle := 1; ; cycle++ {
+		logger.Info("Run %d started", cycle)
+		started := time.Now()
+		ctx, cancel := runCtx, func() {}
+		if config.Migration.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(runCtx, config.Migration.Timeout)
+		}
+		err := migrateSources(ctx, mongoClient, config, opts)
+		cancel()
+		if err != nil {
+			logger.Error("Run %d failed after %s: %v", cycle, time.Since(started).Round(time.Millisecond), err)
+		} else {
+			logger.Info("Run %d finished in %s", cycle, time.Since(started).Round(time.Millisecond))
+		}
+		// Checkpoints are cleared by the first run only, later runs continue from the watermarks
+		opts.restart = false
+
+		if stopCtx.Err() != nil {
+			logger.Info("Stopped after run %d", cycle)
+			return
+		}
+		next := schedule.Next(time.Now())
+		logger.Info("Next run at %s", next.Format(time.RFC3339))
+		if migrator.WaitUntil(stopCtx, next) != nil {
+			logger.Info("Stopped after run %d", cycle)
+			return
 		}
-		tables = append(tables, tableName)
 	}
+}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating table names: %v", err)
+// migrateSources runs one migration of every source and writes its report
+func migrateSources(ctx context.Context, mongoClient *mongo.Client, config migrator.Config, opts migrateOptions) error {
+	report := migrator.NewRunReport(config)
+	err := func() error {
+		for _, source := range config.PostgresSources() {
+			applyMigrateOptions(&source, opts)
+			results, err := migrateSource(ctx, mongoClient, source, opts)
+			report.Add(source.SourceName, results)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err == nil && config.Migration.FailOnDroppedRows && report.DroppedRows() > 0 {
+		err = fmt.Errorf("%d row(s) were skipped or rejected by MongoDB", report.DroppedRows())
+	}
+	if err == nil && report.Totals.IDCollisions > 0 {
+		err = fmt.Errorf("%d row(s) got the _id of an earlier row of their table, see the log for examples", report.Totals.IDCollisions)
 	}
+	report.Finish(err)
 
-	return tables, nil
+	// The error of the run wins over failing to write its report
+	if config.Migration.ReportFile == "" {
+		return err
+	}
+	if werr := report.WriteFile(config.Migration.ReportFile); werr != nil && err != nil {
+		migrator.CurrentLogger().Error("%v", werr)
+	} else if werr != nil {
+		return werr
+	}
+	return err
 }
 
-// fetchDataFromPostgresAndInsertToMongo retrieves data from PostgreSQL and inserts it into MongoDB
-func fetchDataFromPostgresAndInsertToMongo(pgConn *pgxpool.Pool, mongoClient *mongo.Client, pgTableName, mongoDBName, mongoCollectionName string, skipEmpty bool) error {
-	ctx := context.Background()
+// applyMigrateOptions overrides the configuration of a source with the migrate flags
+func applyMigrateOptions(config *migrator.Config, opts migrateOptions) {
+	config.Migration.Resume = opts.resume && !opts.restart
+	if opts.continueOnError {
+		config.Migration.ContinueOnError = true
+	}
+	config.Migration.DryRun = opts.dryRun
+	config.Migration.DryRunDocs = opts.dryRunDocs
+	if opts.checkIDs {
+		config.Migration.CheckIDs = true
+		config.Migration.DryRun = true
+		config.Migration.DryRunDocs = 0
+	}
+	config.Migration.Progress = opts.showProgress
+	if opts.maxDocsPerSecondSet {
+		config.MongoDB.MaxDocsPerSecond = opts.maxDocsPerSecond
+	}
+	if opts.skipMissingTables {
+		config.Postgres.MissingTables = "skip"
+	}
+	if opts.sample > 0 {
+		config.Migration.Sample = opts.sample
+	}
+	if opts.sampleRandom {
+		config.Migration.SampleRandom = true
+	}
+}
 
-	// PostgreSQL query
-	rows, err := pgConn.Query(ctx, fmt.Sprintf("SELECT * FROM %s", pgTableName))
+// migrateSource copies the tables of one source, with its own PostgreSQL pool, sync state and
+// dead-letter file, and returns the results of its tables
+func migrateSource(ctx context.Context, mongoClient *mongo.Client, config migrator.Config, opts migrateOptions) ([]migrator.TransferResult, error) {
+	pgConn, err := connectPostgres(ctx, config)
 	if err != nil {
-		return fmt.Errorf("error querying PostgreSQL: %v", err)
+		return nil, err
 	}
-	defer rows.Close()
+	defer pgConn.Close()
 
-	// Check if the table is empty
-	if !rows.Next() {
-		if skipEmpty {
-			fmt.Printf("Table %s is empty. Skipping...\n", pgTableName)
-			return nil
-		} else {
-			// Create an empty collection
-			mongoCollection := mongoClient.Database(mongoDBName).Collection(mongoCollectionName)
-			_, err := mongoCollection.InsertOne(ctx, bson.D{})
-			if err != nil {
-				return fmt.Errorf("error creating empty collection in MongoDB: %v", err)
-			}
-			fmt.Printf("Table %s is empty. Created empty collection in MongoDB.\n", pgTableName)
-			return nil
+	if err := resolveTables(ctx, pgConn, &config); err != nil {
+		return nil, err
+	}
+	if err := checkCompatibility(ctx, pgConn, config, opts.force); err != nil {
+		return nil, err
+	}
+
+	state, err := migrator.LoadStateStore(config.Migration.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading sync state: %v", err)
+	}
+	// A dry run must not advance watermarks or checkpoints
+	state.ReadOnly = config.Migration.DryRun
+	if opts.restart {
+		if err := state.ClearCheckpoints(); err != nil {
+			return nil, fmt.Errorf("error clearing checkpoints: %v", err)
 		}
 	}
 
-	// MongoDB collection
-	mongoCollection := mongoClient.Database(mongoDBName).Collection(mongoCollectionName)
+	deadLetters := migrator.NewDeadLetterSink(config.Migration.DeadLetterFile, config.Migration.MaxErrors)
+	defer deadLetters.Close()
 
-	// Get column names
-	fields := rows.FieldDescriptions()
-	columnNames := make([]string, len(fields))
-	for i, field := range fields {
-		columnNames[i] = string(field.Name)
+	// With the documents on stdout the report goes to stderr
+	report := io.Writer(os.Stdout)
+	if config.WritesDocumentsToStdout() {
+		report = os.Stderr
+	}
+	if config.SourceName != "" {
+		fmt.Fprintf(report, "Source %s\n", config.SourceName)
+	}
+	// Fetch data from PostgreSQL and insert into MongoDB
+	results, err := migrator.MigrateTables(ctx, pgConn, mongoClient, state, deadLetters, config)
+	migrator.FprintSummary(report, results)
+	if config.Migration.DryRun {
+		fmt.Fprintln(report, "Dry run: no documents were written, INSERTED shows what would have been inserted.")
+	}
+	if err != nil {
+		return results, fmt.Errorf("migration aborted%s: %v", sourceLabel(config), err)
+	}
+	if ctx.Err() != nil {
+		return results, fmt.Errorf("migration cancelled: %v", ctx.Err())
 	}
 
-	// Iterate through PostgreSQL rows and insert into MongoDB
-	for {
-		columnValues := make([]interface{}, len(fields))
-		columnPointers := make([]interface{}, len(fields))
+	if opts.verify && config.Migration.DryRun {
+		fmt.Fprintln(report, "Dry run: skipping verification.")
+	} else if opts.verify && !config.WritesToMongoDB() {
+		fmt.Fprintf(report, "Output is %s: skipping verification.\n", config.Output.Target)
+	} else if opts.verify {
+		return results, verifyTables(ctx, pgConn, mongoClient, withoutFailedTables(config, results))
+	}
+	return results, nil
+}
 
-		for i := range columnValues {
-			columnPointers[i] = &columnValues[i]
+// withoutFailedTables leaves the tables that failed out of config, so that verification does not
+// report a table that is not required and failed as a mismatch
+func withoutFailedTables(config migrator.Config, results []migrator.TransferResult) migrator.Config {
+	failed := map[string]bool{}
+	for _, r := range results {
+		if r.Status == migrator.StatusFailed {
+			failed[r.Table] = true
+		}
+	}
+	tables := make([]migrator.TableConfig, 0, len(config.Postgres.Tables))
+	for _, table := range config.Postgres.Tables {
+		if !failed[table.Name] {
+			tables = append(tables, table)
 		}
+	}
+	config.Postgres.Tables = tables
+	return config
+}
 
-		// Scan row into the column values
-		if err := rows.Scan(columnPointers...); err != nil {
-			return fmt.Errorf("error scanning PostgreSQL row: %v", err)
+// checkCompatibility reports every table the configuration cannot migrate cleanly before any
+// data moves, and fails unless force is set
+func checkCompatibility(ctx context.Context, pgConn *pgxpool.Pool, config migrator.Config, force bool) error {
+	logger := migrator.CurrentLogger()
+	problems, err := migrator.CheckCompatibility(ctx, pgConn, config)
+	if err != nil {
+		return fmt.Errorf("error checking compatibility%s: %v", sourceLabel(config), err)
+	}
+	for _, problem := range problems {
+		if force {
+			logger.Warn("Incompatible: %s", problem)
+		} else {
+			logger.Error("Incompatible: %s", problem)
 		}
+	}
+	if len(problems) > 0 && !force {
+		return fmt.Errorf("%d compatibility problem(s)%s, fix the configuration or migrate anyway with --force", len(problems), sourceLabel(config))
+	}
+	return nil
+}
+
+// runList prints the tables found in every PostgreSQL source without connecting to MongoDB.
+// With a sources list each line starts with the source name.
+func runList(configFile string) {
+	config := loadConfig(configFile)
+	ctx, cancel := commandContext(config)
+	defer cancel()
 
-		// Create document
-		document := bson.D{}
-		for i, columnName := range columnNames {
-			document = append(document, bson.E{Key: columnName, Value: columnValues[i]})
+	for _, source := range config.PostgresSources() {
+		if err := listSource(ctx, source); err != nil {
+			fatalf("%v", err)
 		}
+	}
+}
 
-		// Insert document into MongoDB
-		_, err := mongoCollection.InsertOne(ctx, document)
-		if err != nil {
-			return fmt.Errorf("error inserting document into MongoDB: %v", err)
+// listSource prints the tables of one source
+func listSource(ctx context.Context, config migrator.Config) error {
+	pgConn, err := connectPostgres(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer pgConn.Close()
+
+	tables, err := migrator.ListTables(ctx, pgConn, config)
+	if err != nil {
+		return fmt.Errorf("error listing tables%s: %v", sourceLabel(config), err)
+	}
+	if config.SourceName != "" {
+		for i := range tables {
+			tables[i].Table = config.SourceName + "\t" + tables[i].Table
 		}
+	}
+	migrator.PrintTableList(tables)
+	return nil
+}
 
-		if !rows.Next() {
-			break
+// runVerify compares the configured tables of every source with their collections without
+// migrating anything
+func runVerify(configFile string) {
+	config := loadConfig(configFile)
+	if !config.WritesToMongoDB() {
+		fatalf("Nothing to verify: output.target is %s", config.Output.Target)
+	}
+	ctx, cancel := commandContext(config)
+	defer cancel()
+
+	mongoClient := connectMongo(ctx, config)
+	defer mongoClient.Disconnect(context.Background())
+
+	for _, source := range config.PostgresSources() {
+		if err := verifySource(ctx, mongoClient, source); err != nil {
+			fatalf("%v", err)
 		}
 	}
+}
 
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("error iterating PostgreSQL rows: %v", err)
+// runImport loads a dump directory into MongoDB without connecting to PostgreSQL
+func runImport(configFile, dir string) {
+	config, err := migrator.LoadImportConfig(configFile)
+	if err != nil {
+		fatalf("Error loading configuration: %v", err)
 	}
+	setupLogging(config)
+	if dir == "" {
+		dir = config.Output.Path
+	}
+	ctx, cancel := commandContext(config)
+	defer cancel()
 
+	mongoClient := connectMongo(ctx, config)
+	defer mongoClient.Disconnect(context.Background())
+
+	results, err := migrator.ImportDump(ctx, mongoClient, migrator.DumpDir(dir, config), config)
+	migrator.PrintSummary(results)
+	if err != nil {
+		fatalf("Import aborted: %v", err)
+	}
+}
+
+// verifySource verifies the tables of one source
+func verifySource(ctx context.Context, mongoClient *mongo.Client, config migrator.Config) error {
+	pgConn, err := connectPostgres(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer pgConn.Close()
+
+	if err := resolveTables(ctx, pgConn, &config); err != nil {
+		return err
+	}
+	if config.SourceName != "" {
+		fmt.Printf("Source %s\n", config.SourceName)
+	}
+	return verifyTables(ctx, pgConn, mongoClient, config)
+}
+
+// verifyTables prints the verification of every table, returning an error on any mismatch
+func verifyTables(ctx context.Context, pgConn *pgxpool.Pool, mongoClient *mongo.Client, config migrator.Config) error {
+	verification, err := migrator.VerifyTables(ctx, pgConn, mongoClient, config)
+	migrator.PrintVerification(verification)
+	if err != nil {
+		return fmt.Errorf("verification failed: %v", err)
+	}
+	mismatches := 0
+	for _, r := range verification {
+		if r.Mismatch() {
+			mismatches++
+		}
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("verification failed: %d table(s) do not match their collections", mismatches)
+	}
 	return nil
 }
+
+// fatalf logs an error and exits the process with status 1
+func fatalf(format string, args ...interface{}) {
+	migrator.CurrentLogger().Error(format, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,163 @@
+//go:build integration
+
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/testcontainers/testcontainers-go"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The benchmarks read a generated table from PostgreSQL in a container and throw the documents
+// away, so they measure reading and converting rows without MongoDB:
+//
+//	go test -tags integration -run '^$' -bench . -benchtime 5x ./migrator/
+//
+// They are skipped when no Docker daemon is reachable.
+
+// benchRows is the number of rows of the benchmark table
+const benchRows = 200000
+
+var benchSchema = fmt.Sprintf(`
+CREATE TABLE bench (
+    id         integer PRIMARY KEY,
+    name       text NOT NULL,
+    price      numeric(12, 2),
+    created_at timestamptz,
+    tags       text[]
+);
+INSERT INTO bench
+SELECT i, 'item ' || i, i / 100.0, timestamptz '2024-01-01 00:00:00+00' + i * interval '1 minute', ARRAY['a', 'b']
+FROM generate_series(1, %d) AS i;
+ANALYZE bench;
+`, benchRows)
+
+// discardSink is a DocSink that accepts every write and keeps nothing
+type discardSink struct{}
+
+func (discardSink) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	return &mongo.InsertOneResult{}, nil
+}
+
+func (discardSink) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	return &mongo.InsertManyResult{}, nil
+}
+
+func (discardSink) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	return &mongo.BulkWriteResult{}, nil
+}
+
+func (discardSink) Drop(ctx context.Context) error {
+	return nil
+}
+
+// benchConfig starts PostgreSQL with the benchmark table and loads a config reading it, with the
+// postgres settings given as YAML lines
+func benchConfig(ctx context.Context, b *testing.B, settings string) Config {
+	b.Helper()
+	// testcontainers.SkipIfProviderIsNotHealthy only takes a *testing.T
+	provider, err := testcontainers.ProviderDocker.GetProvider()
+	if err == nil {
+		err = provider.Health(ctx)
+	}
+	if err != nil {
+		b.Skipf("Docker is not running: %v", err)
+	}
+	dir := b.TempDir()
+	initScript := filepath.Join(dir, "init.sql")
+	if err := os.WriteFile(initScript, []byte(benchSchema), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	pgHost, pgPort := startContainer(ctx, b, postgresContainer(initScript))
+
+	viper.Reset()
+	configFile := filepath.Join(dir, "config.yml")
+	content := fmt.Sprintf(`
+postgres:
+  host: %s
+  port: %s
+  database: shop
+  user: app
+  password: secret
+  tables: [bench]
+%s
+mongodb:
+  uri: mongodb://localhost:27017
+  database: shop
+  id_strategy: from_pk
+`, pgHost, pgPort, settings)
+	if err := os.WriteFile(configFile, []byte(content), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return config
+}
+
+// benchTransfer transfers the benchmark table b.N times with each of configs, reporting the
+// allocations and rows read per second of every one as a sub-benchmark
+func benchTransfer(ctx context.Context, b *testing.B, configs map[string]Config) {
+	for name, config := range configs {
+		b.Run(name, func(b *testing.B) {
+			pgConn, err := ConnectToPostgreSQL(ctx, config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer pgConn.Close()
+			table := TableConfig{Name: "public.bench"}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// A fresh state file, so a paginated run does not resume from the last one
+				b.StopTimer()
+				state, err := LoadStateStore(filepath.Join(b.TempDir(), "state.json"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				deadLetters := NewDeadLetterSink(filepath.Join(b.TempDir(), "failed_rows.jsonl"), 0)
+				result := TransferResult{Table: table.Name}
+				b.StartTimer()
+
+				err = transferTable(ctx, pgConn, discardSink{}, table, "bench", state, deadLetters, config, &result)
+				deadLetters.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if result.RowsRead != benchRows {
+					b.Fatalf("read %d rows, want %d", result.RowsRead, benchRows)
+				}
+			}
+			b.ReportMetric(float64(benchRows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+func BenchmarkReadMode(b *testing.B) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	config := benchConfig(ctx, b, "")
+	cursor := config
+	cursor.Postgres.ReadMode = readModeCursor
+	benchTransfer(ctx, b, map[string]Config{readModeQuery: config, readModeCursor: cursor})
+}
+
+func BenchmarkPageQueries(b *testing.B) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	// 200 keyset pages per transfer
+	config := benchConfig(ctx, b, "  page_size: 1000")
+	unprepared := config
+	unprepared.Postgres.PrepareStatements = false
+	benchTransfer(ctx, b, map[string]Config{"prepared": config, "unprepared": unprepared})
+}
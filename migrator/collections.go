@@ -0,0 +1,100 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CappedConfig creates the target collection of a table as a capped collection
+type CappedConfig struct {
+	SizeBytes int64 `mapstructure:"size_bytes"` // maximum size of the collection, rounded up to a multiple of 256 by MongoDB
+	MaxDocs   int64 `mapstructure:"max_docs"`   // maximum number of documents, 0 for no limit besides the size
+}
+
+// TTLConfig creates a TTL index that makes MongoDB delete documents once their date field is older
+// than ExpireAfterSeconds
+type TTLConfig struct {
+	Field              string `mapstructure:"field"` // document field holding the date, after field_naming
+	ExpireAfterSeconds int32  `mapstructure:"expire_after_seconds"`
+}
+
+// cappedOptions are the options of an existing collection compared with CappedConfig
+type cappedOptions struct {
+	Capped bool  `bson:"capped"`
+	Size   int64 `bson:"size"`
+	Max    int64 `bson:"max"`
+}
+
+// createCappedCollection creates the collection as configured by capped before anything is
+// written to it. An existing collection with other options is left as is with a warning.
+func createCappedCollection(ctx context.Context, collection *mongo.Collection, capped CappedConfig, config Config) error {
+	db := collection.Database()
+	specs, err := db.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collection.Name()}})
+	if err != nil {
+		return fmt.Errorf("error looking up MongoDB collection %s: %v", collection.Name(), err)
+	}
+	if len(specs) > 0 {
+		var existing cappedOptions
+		if specs[0].Options != nil {
+			if err := bson.Unmarshal(specs[0].Options, &existing); err != nil {
+				return fmt.Errorf("error reading the options of MongoDB collection %s: %v", collection.Name(), err)
+			}
+		}
+		wantSize := (capped.SizeBytes + 255) / 256 * 256
+		if !existing.Capped || existing.Size != wantSize || existing.Max != capped.MaxDocs {
+			logger.Warn("MongoDB collection %s already exists and is not capped at %d bytes and %d documents, not recreating it (drop it or set drop_before_import)", collection.Name(), capped.SizeBytes, capped.MaxDocs)
+		}
+		return nil
+	}
+
+	if config.Migration.DryRun {
+		logger.Info("Dry run: would create MongoDB collection %s capped at %d bytes.", collection.Name(), capped.SizeBytes)
+		return nil
+	}
+	createOptions := options.CreateCollection().SetCapped(true).SetSizeInBytes(capped.SizeBytes)
+	if capped.MaxDocs > 0 {
+		createOptions.SetMaxDocuments(capped.MaxDocs)
+	}
+	if err := db.CreateCollection(ctx, collection.Name(), createOptions); err != nil {
+		return fmt.Errorf("error creating capped MongoDB collection %s: %v", collection.Name(), err)
+	}
+	logger.Info("Created MongoDB collection %s capped at %d bytes.", collection.Name(), capped.SizeBytes)
+	return nil
+}
+
+// createTTLIndex creates the TTL index of ttl. An existing index on the field with another
+// expiry is left as is with a warning.
+func createTTLIndex(ctx context.Context, collection *mongo.Collection, ttl TTLConfig, config Config) error {
+	indexes, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing the indexes of MongoDB collection %s: %v", collection.Name(), err)
+	}
+	for _, index := range indexes {
+		keys, err := index.KeysDocument.Elements()
+		if err != nil || len(keys) != 1 || keys[0].Key() != ttl.Field {
+			continue
+		}
+		if index.ExpireAfterSeconds == nil || *index.ExpireAfterSeconds != ttl.ExpireAfterSeconds {
+			logger.Warn("MongoDB collection %s already has the index %s on %s without an expiry of %ds, not creating the TTL index", collection.Name(), index.Name, ttl.Field, ttl.ExpireAfterSeconds)
+		}
+		return nil
+	}
+
+	if config.Migration.DryRun {
+		logger.Info("Dry run: would create a TTL index on %s of MongoDB collection %s.", ttl.Field, collection.Name())
+		return nil
+	}
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: ttl.Field, Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(ttl.ExpireAfterSeconds),
+	}
+	if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+		return fmt.Errorf("error creating the TTL index on %s of MongoDB collection %s: %v", ttl.Field, collection.Name(), err)
+	}
+	logger.Info("Created a TTL index on %s of MongoDB collection %s, expiring documents after %ds.", ttl.Field, collection.Name(), ttl.ExpireAfterSeconds)
+	return nil
+}
@@ -0,0 +1,102 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// CheckCompatibility inspects the columns of every configured table against the configured
+// options before any data moves, and returns every problem that would fail a table halfway or
+// give it broken documents: columns mapping to the same field, a missing key for the _id strategy,
+// upserts or pruning without an _id, and key or incremental columns that are not selected.
+func CheckCompatibility(ctx context.Context, pgConn RowSource, config Config) ([]string, error) {
+	var problems []string
+	for _, table := range config.Postgres.Tables {
+		found, err := checkTableCompatibility(ctx, pgConn, table, config)
+		if err != nil {
+			return problems, err
+		}
+		problems = append(problems, found...)
+	}
+	return problems, nil
+}
+
+// checkTableCompatibility returns the problems of one table, or an error when PostgreSQL cannot be asked
+func checkTableCompatibility(ctx context.Context, pgConn RowSource, table TableConfig, config Config) ([]string, error) {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("table %s: ", table.Name)+fmt.Sprintf(format, args...))
+	}
+
+	columns, err := resolveColumns(ctx, pgConn, table)
+	if err != nil {
+		return nil, err
+	}
+	// The result columns of the query the transfer runs, without reading any row
+	counted := table
+	counted.RandomSample = false
+	query, args := buildSelectQuery(counted, columns, nil, 0)
+	rows, err := pgConn.Query(ctx, fmt.Sprintf("SELECT * FROM (%s) AS source LIMIT 0", query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying table %s: %v", table.Name, err)
+	}
+	fields := rows.FieldDescriptions()
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying table %s: %v", table.Name, err)
+	}
+	columnNames := make([]string, len(fields))
+	for i, field := range fields {
+		columnNames[i] = string(field.Name)
+	}
+
+	// Field names after mongodb.field_naming, which must not repeat or shadow the added fields
+	names := make([]string, len(columnNames))
+	seen := make(map[string]string, len(columnNames))
+	for i, column := range columnNames {
+		names[i] = fieldName(column, config.MongoDB.FieldNaming)
+		if other, ok := seen[names[i]]; ok {
+			report("columns %s and %s both map to the field %s", other, column, names[i])
+		}
+		seen[names[i]] = column
+	}
+	added := metadataFields(table.Name, nil, config)
+	if table.SourceField != "" {
+		added = append(added, bson.E{Key: table.SourceField})
+	}
+	for _, field := range added {
+		if column, ok := seen[field.Key]; ok {
+			report("column %s has the same field name as the added field %s", column, field.Key)
+		}
+	}
+
+	keyColumns, err := resolveIDColumns(ctx, pgConn, table, config)
+	if err != nil {
+		problems = append(problems, err.Error())
+		return problems, nil
+	}
+	if len(keyColumns) == 0 && table.Query == "" && config.idStrategy() == idStrategyFromPK && config.MongoDB.IDColumnPolicy != idPolicyAlwaysObjectID {
+		report("mongodb.id_strategy from_pk needs a primary key, MongoDB would generate the _id values")
+	}
+	if len(keyColumns) == 0 && config.MongoDB.Mode != modeInsert {
+		report("mongodb.mode %s needs an _id built from the rows, every run would insert the rows again", config.MongoDB.Mode)
+	}
+	if len(keyColumns) == 0 && prunes(table, config) {
+		report("prune needs an _id built from the rows, set an id_strategy or id_column")
+	}
+	keyIndexes, err := columnIndexes(columnNames, keyColumns)
+	if err != nil {
+		report("_id: %v", err)
+	} else if err := checkIDField(table.Name, names, keyIndexes, config); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if table.Incremental != "" {
+		if _, err := columnIndexes(columnNames, []string{table.Incremental}); err != nil {
+			report("incremental: %v", err)
+		}
+	}
+	return problems, nil
+}
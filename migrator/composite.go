@@ -0,0 +1,150 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// compositeAttribute is a field of a composite type
+type compositeAttribute struct {
+	name string
+	oid  uint32
+}
+
+// loadCompositeTypes records the attributes of the composite types created with CREATE TYPE ... AS,
+// in declaration order
+func loadCompositeTypes(ctx context.Context, pgConn RowSource, types pgTypes) error {
+	query := `
+		SELECT t.oid, a.attname, a.atttypid
+		FROM pg_type t
+		JOIN pg_class c ON c.oid = t.typrelid AND c.relkind = 'c'
+		JOIN pg_attribute a ON a.attrelid = t.typrelid
+		WHERE t.typtype = 'c' AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY t.oid, a.attnum
+	`
+
+	rows, err := pgConn.Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("error querying PostgreSQL for composite types: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid uint32
+		var attribute compositeAttribute
+		if err := rows.Scan(&oid, &attribute.name, &attribute.oid); err != nil {
+			return fmt.Errorf("error scanning composite type: %v", err)
+		}
+		types.composites[oid] = append(types.composites[oid], attribute)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating composite types: %v", err)
+	}
+	return nil
+}
+
+// compositeConverter stores a composite value as a sub-document with a field per attribute,
+// named like columns. Every attribute is converted like a column of its type, so nested
+// composites become nested documents. NULL attributes become BSON null.
+func compositeConverter(table, column string, attributes []compositeAttribute, types pgTypes, config Config) convertFunc {
+	connInfo := pgtype.NewConnInfo()
+	names := make([]string, len(attributes))
+	converters := make([]convertFunc, len(attributes))
+	for i, attribute := range attributes {
+		names[i] = fieldName(attribute.name, config.MongoDB.FieldNaming)
+		field := pgproto3.FieldDescription{Name: []byte(attribute.name), DataTypeOID: attribute.oid, Format: pgtype.TextFormatCode}
+		converters[i] = converterFor(table, field, types, config).convert
+	}
+
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		if len(attributes) == 0 {
+			return bson.D{}, nil
+		}
+		// Composite types have no decoder in pgx, so they are sent in text format
+		fields, err := parseRecord(raw)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", column, err)
+		}
+		if len(fields) != len(attributes) {
+			return nil, fmt.Errorf("column %s: composite value has %d fields instead of %d", column, len(fields), len(attributes))
+		}
+
+		document := make(bson.D, len(attributes))
+		for i, text := range fields {
+			document[i].Key = names[i]
+			if text == nil {
+				continue
+			}
+			v, err := decodeText(connInfo, attributes[i].oid, text)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: error decoding attribute %s: %v", column, attributes[i].name, err)
+			}
+			if document[i].Value, err = converters[i](v, text); err != nil {
+				return nil, err
+			}
+		}
+		return document, nil
+	}
+}
+
+// decodeText decodes the text form of a value like pgx does for a result column, leaving types it
+// does not know as strings
+func decodeText(connInfo *pgtype.ConnInfo, oid uint32, text []byte) (interface{}, error) {
+	dataType, ok := connInfo.DataTypeForOID(oid)
+	if !ok {
+		return string(text), nil
+	}
+	value := pgtype.NewValue(dataType.Value)
+	decoder, ok := value.(pgtype.TextDecoder)
+	if !ok {
+		return string(text), nil
+	}
+	if err := decoder.DecodeText(connInfo, text); err != nil {
+		return nil, err
+	}
+	return value.Get(), nil
+}
+
+// parseRecord splits the text form of a composite value such as (1,"a ""b""",) into the text of
+// its fields. A NULL field, left empty in the text, is nil; a quoted empty string is not.
+func parseRecord(raw []byte) ([][]byte, error) {
+	if len(raw) < 2 || raw[0] != '(' || raw[len(raw)-1] != ')' {
+		return nil, fmt.Errorf("invalid composite value %q", raw)
+	}
+	body := raw[1 : len(raw)-1]
+
+	var fields [][]byte
+	for i := 0; ; i++ {
+		var field []byte
+		quoted := false
+		for ; i < len(body) && (quoted || body[i] != ','); i++ {
+			switch c := body[i]; {
+			case c == '"' && quoted && i+1 < len(body) && body[i+1] == '"':
+				field = append(field, '"')
+				i++
+			case c == '"':
+				quoted = !quoted
+				if field == nil {
+					field = []byte{}
+				}
+			case c == '\\' && i+1 < len(body):
+				i++
+				field = append(field, body[i])
+			default:
+				field = append(field, c)
+			}
+		}
+		if quoted {
+			return nil, fmt.Errorf("invalid composite value %q: unterminated quote", raw)
+		}
+		fields = append(fields, field)
+		if i >= len(body) {
+			return fields, nil
+		}
+	}
+}
@@ -0,0 +1,960 @@
+package migrator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"golang.org/x/time/rate"
+)
+
+// defaultBatchSize is the number of documents sent per InsertMany call when mongodb.batch_size is unset
+const defaultBatchSize = 1000
+
+// Write modes controlling how documents land in MongoDB
+const (
+	modeInsert  = "insert"  // InsertMany, MongoDB generates or rejects duplicate _id values
+	modeUpsert  = "upsert"  // $set the columns on the document with the same _id, creating it if missing
+	modeReplace = "replace" // replace the whole document with the same _id, creating it if missing
+)
+
+// Handling of inserts whose _id is already taken (mongodb.on_duplicate)
+const (
+	onDuplicateFail    = "fail"    // the batch fails, or its duplicates are dead-lettered with continue_on_error
+	onDuplicateSkip    = "skip"    // the duplicates are counted and left out, the rest is inserted
+	onDuplicateReplace = "replace" // the existing documents are replaced, as with mode replace
+)
+
+// Shapes of an _id built from several key columns (mongodb.composite_id)
+const (
+	compositeIDDocument = "document" // sub-document of the key fields
+	compositeIDString   = "string"   // key values joined by composite_id_separator
+)
+
+// Sources of the _id of a document (mongodb.id_strategy)
+const (
+	idStrategyObjectID    = "objectid"     // left to MongoDB, which generates an ObjectID
+	idStrategyFromPK      = "from_pk"      // the primary key columns
+	idStrategyFromColumns = "from_columns" // the columns listed in id_columns
+	idStrategyHash        = "hash"         // SHA-1 of the id_columns, or of the primary key
+)
+
+// Handling of columns named id and _id (mongodb.id_column_policy)
+const (
+	idPolicyErrorOnConflict = "error_on_conflict" // an _id column is the _id unless the strategy builds one, then the table fails
+	idPolicyUseIDColumn     = "use_id_column"     // the _id column, or else the id column, makes up the _id
+	idPolicyAlwaysObjectID  = "always_objectid"   // MongoDB generates every _id, an _id column is kept as source_id
+)
+
+// Forms of a hashed _id (mongodb.id_hash_format)
+const (
+	idHashObjectID = "objectid" // the first 12 bytes of the hash as an ObjectID
+	idHashHex      = "hex"      // the whole hash as a string of 40 hex digits
+)
+
+// Storage formats of uuid columns (types.uuid_format)
+const (
+	uuidFormatString = "string" // canonical hyphenated form
+	uuidFormatBinary = "binary" // BSON binary subtype 4
+)
+
+// Storage formats of bytea columns (types.bytea_format)
+const (
+	byteaFormatBinary = "binary" // BSON binary, generic subtype
+	byteaFormatBase64 = "base64" // standard base64 string
+)
+
+// defaultPoolMaxConns is the size of the PostgreSQL connection pool when postgres.pool_max_conns is unset
+const defaultPoolMaxConns = 10
+
+// defaultSchema is used when postgres.schemas is unset and to qualify bare table names
+const defaultSchema = "public"
+
+// Config struct to hold database configuration
+type Config struct {
+	Postgres struct {
+		// DSN is a complete connection string (keyword=value or postgres:// URL) used instead of
+		// the host, port, database, user and SSL settings
+		DSN string `mapstructure:"dsn"`
+
+		Host     string `mapstructure:"host"`
+		Port     int    `mapstructure:"port"`
+		Database string `mapstructure:"database"`
+		User     string `mapstructure:"user"`
+		Password string `mapstructure:"password"`
+
+		// PasswordEnv names the environment variable holding the password when password is empty
+		PasswordEnv string `mapstructure:"password_env"`
+
+		// SSLMode and the certificate files are passed to the connection string; empty keeps the pgx defaults
+		SSLMode     string `mapstructure:"sslmode"`
+		SSLRootCert string `mapstructure:"sslrootcert"`
+		SSLCert     string `mapstructure:"sslcert"`
+		SSLKey      string `mapstructure:"sslkey"`
+
+		// Connection pool limits, applied to the pgxpool.Config
+		PoolMaxConns        int32         `mapstructure:"pool_max_conns"`
+		PoolMinConns        int32         `mapstructure:"pool_min_conns"`
+		PoolMaxConnLifetime time.Duration `mapstructure:"pool_max_conn_lifetime"`
+		PoolMaxConnIdleTime time.Duration `mapstructure:"pool_max_conn_idle_time"`
+
+		// StatementTimeout is set as statement_timeout on every connection, so PostgreSQL cancels
+		// any single statement running longer; 0 keeps the server setting
+		StatementTimeout time.Duration `mapstructure:"statement_timeout"`
+
+		Schemas                  []string      `mapstructure:"schemas"`
+		Tables                   []TableConfig `mapstructure:"tables"`
+		AllTables                bool          `mapstructure:"all_tables"`
+		AllTablesQuery           string        `mapstructure:"all_tables_query"`
+		IncludeTables            []string      `mapstructure:"include_tables"`
+		ExcludeTables            []string      `mapstructure:"exclude_tables"`
+		IncludeViews             bool          `mapstructure:"include_views"`
+		IncludeMaterializedViews bool          `mapstructure:"include_materialized_views"`
+		IncludeSystemTables      bool          `mapstructure:"include_system_tables"`
+		IncludeUnloggedTables    bool          `mapstructure:"include_unlogged_tables"`
+		SkipEmpty                bool          `mapstructure:"skip_empty"`
+		MissingTables            string        `mapstructure:"missing_tables"`
+		PageSize                 int           `mapstructure:"page_size"`
+
+		// ReadMode query runs the select as is, cursor reads it through a server-side cursor
+		ReadMode  string `mapstructure:"read_mode"`
+		FetchSize int    `mapstructure:"fetch_size"`
+
+		// PrepareStatements keeps the statement cache of pgx, which prepares every query once per connection
+		PrepareStatements bool `mapstructure:"prepare_statements"`
+	} `mapstructure:"postgres"`
+
+	MongoDB struct {
+		URI                     string   `mapstructure:"uri"`
+		Database                string   `mapstructure:"database"`
+		BatchSize               int      `mapstructure:"batch_size"`
+		MaxBatchBytes           int      `mapstructure:"max_batch_bytes"`
+		GridFSThreshold         int      `mapstructure:"gridfs_threshold"`
+		Ordered                 bool     `mapstructure:"ordered"`
+		CollectionIncludeSchema bool     `mapstructure:"collection_include_schema"`
+		CollectionPrefix        string   `mapstructure:"collection_prefix"`
+		CollectionSuffix        string   `mapstructure:"collection_suffix"`
+		FieldNaming             string   `mapstructure:"field_naming"`
+		OmitNulls               bool     `mapstructure:"omit_nulls"`
+		EmptyStringAsNull       bool     `mapstructure:"empty_string_as_null"`
+		NullArrayAsEmpty        bool     `mapstructure:"null_array_as_empty"`
+		CreateIndexes           bool     `mapstructure:"create_indexes"`
+		CreateValidator         bool     `mapstructure:"create_validator"`
+		ValidationLevel         string   `mapstructure:"validation_level"`
+		IDFromPrimaryKey        bool     `mapstructure:"id_from_primary_key"`
+		IDStrategy              string   `mapstructure:"id_strategy"`
+		IDColumns               []string `mapstructure:"id_columns"`
+		IDHashFormat            string   `mapstructure:"id_hash_format"`
+		IDColumnPolicy          string   `mapstructure:"id_column_policy"`
+		CompositeID             string   `mapstructure:"composite_id"`
+		CompositeIDSeparator    string   `mapstructure:"composite_id_separator"`
+		Mode                    string   `mapstructure:"mode"`
+		OnDuplicate             string   `mapstructure:"on_duplicate"`
+		DropBeforeImport        bool     `mapstructure:"drop_before_import"`
+		Prune                   bool     `mapstructure:"prune"`
+		MaxDocsPerSecond        int      `mapstructure:"max_docs_per_second"`
+		OversizedDocuments      string   `mapstructure:"oversized_documents"`
+		TruncateFields          []string `mapstructure:"truncate_fields"`
+
+		// Merge sends the tables matching each entry into one collection
+		Merge []MergeConfig `mapstructure:"merge"`
+
+		// Credential settings supplement the credential of the URI, the ones set here win
+		AuthMechanism string `mapstructure:"auth_mechanism"`
+		AuthSource    string `mapstructure:"auth_source"`
+		Username      string `mapstructure:"username"`
+		Password      string `mapstructure:"password"`
+
+		// TLS configures the client certificate setup; when disabled the URI options apply as is
+		TLS struct {
+			Enabled            bool   `mapstructure:"enabled"`
+			CAFile             string `mapstructure:"ca_file"`
+			CertFile           string `mapstructure:"cert_file"`
+			KeyFile            string `mapstructure:"key_file"`
+			InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+		} `mapstructure:"tls"`
+
+		// WriteConcern replaces the write concern of the URI when any field is set
+		WriteConcern struct {
+			W        string        `mapstructure:"w"`
+			Journal  *bool         `mapstructure:"journal"`
+			WTimeout time.Duration `mapstructure:"wtimeout"`
+		} `mapstructure:"write_concern"`
+		ReadPreference string `mapstructure:"read_preference"`
+	} `mapstructure:"mongodb"`
+
+	// Metadata selects the source fields added to every document, named with Prefix
+	Metadata struct {
+		Prefix     string `mapstructure:"prefix"`
+		Table      bool   `mapstructure:"table"`
+		MigratedAt bool   `mapstructure:"migrated_at"`
+		RunID      bool   `mapstructure:"run_id"`
+
+		// Set once per run by MigrateTables unless already set
+		ID        string    `mapstructure:"-"`
+		StartedAt time.Time `mapstructure:"-"`
+	} `mapstructure:"metadata"`
+
+	// Sources holds the complete configuration of every entry of the sources list, see
+	// PostgresSources. SourceName is the name of the entry in such a configuration.
+	Sources    []Config `mapstructure:"-"`
+	SourceName string   `mapstructure:"-"`
+
+	// withoutPostgres skips the checks of the postgres settings, see LoadImportConfig
+	withoutPostgres bool
+
+	// Output selects where the documents go: MongoDB, or files in Path
+	Output struct {
+		Target string `mapstructure:"target"`
+		Path   string `mapstructure:"path"`
+
+		// files is the output the tables of a run write to with target jsonl or bson
+		files *fileOutput
+	} `mapstructure:"output"`
+
+	// Metrics serves Prometheus metrics over HTTP when Address is set
+	Metrics struct {
+		Address string `mapstructure:"address"`
+	} `mapstructure:"metrics"`
+
+	LogFormat string `mapstructure:"log_format"`
+	LogLevel  string `mapstructure:"log_level"`
+
+	Types struct {
+		TimestampOffsetField bool   `mapstructure:"timestamp_offset_field"`
+		SourceTimezone       string `mapstructure:"source_timezone"`
+		JSONAsString         bool   `mapstructure:"json_as_string"`
+		UUIDFormat           string `mapstructure:"uuid_format"`
+		ByteaFormat          string `mapstructure:"bytea_format"`
+		IntervalFormat       string `mapstructure:"interval_format"`
+		TimeFormat           string `mapstructure:"time_format"`
+		InetFormat           string `mapstructure:"inet_format"`
+		BitFormat            string `mapstructure:"bit_format"`
+		XMLFormat            string `mapstructure:"xml_format"`
+		RangeFormat          string `mapstructure:"range_format"`
+		EnumOrdinalField     bool   `mapstructure:"enum_ordinal_field"`
+		CitextLowerField     bool   `mapstructure:"citext_lower_field"`
+		GeometrySRID         uint32 `mapstructure:"geometry_srid"`
+		GeometryIndex        bool   `mapstructure:"geometry_index"`
+	} `mapstructure:"types"`
+
+	Migration struct {
+		Concurrency int           `mapstructure:"concurrency"`
+		Timeout     time.Duration `mapstructure:"timeout"`
+		StateFile   string        `mapstructure:"state_file"`
+
+		// Writers is the number of batches of one table written at the same time, while
+		// WriteQueue batches at most wait for a writer
+		Writers    int `mapstructure:"writers"`
+		WriteQueue int `mapstructure:"write_queue"`
+
+		ContinueOnError bool   `mapstructure:"continue_on_error"`
+		DeadLetterFile  string `mapstructure:"dead_letter_file"`
+		MaxErrors       int    `mapstructure:"max_errors"`
+
+		// MaxRetries is how often a failed connection attempt is retried, waiting RetryDelay
+		// before the first retry and twice as long before each further one
+		MaxRetries int           `mapstructure:"max_retries"`
+		RetryDelay time.Duration `mapstructure:"retry_delay"`
+
+		// ProgressInterval is how often progress is logged with -progress
+		ProgressInterval time.Duration `mapstructure:"progress_interval"`
+
+		// Schedule keeps the tool running and repeats the migration, see ParseSchedule
+		Schedule string `mapstructure:"schedule"`
+
+		// Sample reads at most this many rows of every table without a limit of its own,
+		// picked at random with SampleRandom
+		Sample       int  `mapstructure:"sample"`
+		SampleRandom bool `mapstructure:"sample_random"`
+
+		// ReportFile receives a JSON summary of every run, FailOnDroppedRows makes a run that
+		// skipped or lost rows fail
+		ReportFile        string `mapstructure:"report_file"`
+		FailOnDroppedRows bool   `mapstructure:"fail_on_dropped_rows"`
+
+		// CheckIDs remembers the _id of every row to report the rows of a table that get the same one
+		CheckIDs bool `mapstructure:"check_ids"`
+
+		// Set from command-line flags
+		Resume     bool `mapstructure:"-"`
+		DryRun     bool `mapstructure:"-"`
+		DryRunDocs int  `mapstructure:"-"`
+		Progress   bool `mapstructure:"-"`
+
+		// writeLimiter throttles the documents written by all tables of a run to MaxDocsPerSecond
+		writeLimiter *rate.Limiter
+	} `mapstructure:"migration"`
+}
+
+// TableConfig describes a single table to migrate. A plain string in the
+// tables list is accepted as shorthand for a TableConfig with only Name set.
+type TableConfig struct {
+	Name     string   `mapstructure:"name"`
+	Where    string   `mapstructure:"where"`
+	Include  []string `mapstructure:"include"`
+	Exclude  []string `mapstructure:"exclude"`
+	IDColumn string   `mapstructure:"id_column"`
+
+	// IDColumns builds _id from these columns instead of the primary key or mongodb.id_columns
+	IDColumns []string `mapstructure:"id_columns"`
+
+	// Incremental names a monotonically increasing column; only rows past the value
+	// recorded in the state file by the previous run are read
+	Incremental string `mapstructure:"incremental"`
+
+	// Query replaces the generated SELECT; the document fields are the result columns of the query
+	Query string `mapstructure:"query"`
+
+	// Limit reads at most this many rows, in random order with RandomSample
+	Limit        int  `mapstructure:"limit"`
+	RandomSample bool `mapstructure:"random_sample"`
+
+	// Collection names the target collection, ignoring collection_prefix and collection_suffix
+	Collection string `mapstructure:"collection"`
+
+	// SourceField adds the table name to every document under this field, as mongodb.merge does
+	SourceField string `mapstructure:"source_field"`
+
+	// TargetDB names the MongoDB database of the collection instead of mongodb.database
+	TargetDB string `mapstructure:"target_db"`
+
+	// Embed lists child tables whose rows are nested into the documents of this table
+	Embed []EmbedConfig `mapstructure:"embed"`
+
+	// Transforms set document fields from templates over the columns of each row
+	Transforms []TransformConfig `mapstructure:"transforms"`
+
+	// Lookups store values of small reference tables in the documents referencing them
+	Lookups []LookupConfig `mapstructure:"lookups"`
+
+	// DropBeforeImport overrides mongodb.drop_before_import for this table when set
+	DropBeforeImport *bool `mapstructure:"drop_before_import"`
+
+	// Prune overrides mongodb.prune for this table when set
+	Prune *bool `mapstructure:"prune"`
+
+	// Capped creates the collection as a capped collection, TTL adds an index expiring its documents
+	Capped *CappedConfig `mapstructure:"capped"`
+	TTL    *TTLConfig    `mapstructure:"ttl"`
+
+	// Required set to false lets the run go on when the table fails; tables are required by default
+	Required *bool `mapstructure:"required"`
+
+	// merge is the mongodb.merge entry the table belongs to, set by ResolveTables
+	merge *MergeConfig
+
+	// projection replaces the column list of the table query, set by newGridFSStreamer
+	projection string
+}
+
+// LoadConfig reads the config file and parses it into a Config struct
+func LoadConfig(filename string) (Config, error) {
+	config, decodeHook, err := readConfig(filename)
+	if err != nil {
+		return config, err
+	}
+
+	// With a sources list the top-level postgres block only provides defaults for the sources
+	if entries, ok := viper.Get("sources").([]interface{}); ok && len(entries) > 0 {
+		sources, err := loadSources(config, entries, decodeHook)
+		if err != nil {
+			return config, err
+		}
+		config.Sources = sources
+		return config, nil
+	}
+
+	if err := finishConfig(&config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// LoadImportConfig reads the config file for loading a dump into MongoDB. The postgres settings
+// and sources are not needed and not checked, and the documents always go to MongoDB.
+func LoadImportConfig(filename string) (Config, error) {
+	config, _, err := readConfig(filename)
+	if err != nil {
+		return config, err
+	}
+	config.withoutPostgres = true
+	config.Output.Target = outputMongo
+	if err := finishConfig(&config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// readConfig sets the defaults and decodes the config file, returning the decode hook for the
+// sources list
+func readConfig(filename string) (Config, mapstructure.DecodeHookFunc, error) {
+	var config Config
+
+	viper.SetDefault("postgres.password_env", "PGPASSWORD")
+	viper.SetDefault("postgres.pool_max_conns", defaultPoolMaxConns)
+	viper.SetDefault("mongodb.batch_size", defaultBatchSize)
+	viper.SetDefault("mongodb.ordered", true)
+	viper.SetDefault("mongodb.mode", modeInsert)
+	viper.SetDefault("mongodb.on_duplicate", onDuplicateFail)
+	viper.SetDefault("mongodb.field_naming", fieldNamingPreserve)
+	viper.SetDefault("mongodb.composite_id", compositeIDDocument)
+	viper.SetDefault("mongodb.id_hash_format", idHashObjectID)
+	viper.SetDefault("mongodb.id_column_policy", idPolicyErrorOnConflict)
+	viper.SetDefault("mongodb.composite_id_separator", ":")
+	viper.SetDefault("mongodb.oversized_documents", oversizedFail)
+	viper.SetDefault("mongodb.validation_level", validationStrict)
+	viper.SetDefault("metadata.prefix", "_src_")
+	viper.SetDefault("postgres.read_mode", readModeQuery)
+	viper.SetDefault("postgres.prepare_statements", true)
+	viper.SetDefault("postgres.include_unlogged_tables", true)
+	viper.SetDefault("postgres.missing_tables", missingTablesFail)
+	viper.SetDefault("types.uuid_format", uuidFormatString)
+	viper.SetDefault("types.bytea_format", byteaFormatBinary)
+	viper.SetDefault("types.interval_format", intervalFormatISO)
+	viper.SetDefault("types.time_format", timeFormatString)
+	viper.SetDefault("types.inet_format", inetFormatString)
+	viper.SetDefault("types.bit_format", bitFormatString)
+	viper.SetDefault("types.xml_format", xmlFormatString)
+	viper.SetDefault("types.range_format", rangeFormatDocument)
+	viper.SetDefault("types.geometry_srid", wgs84SRID)
+	viper.SetDefault("output.target", outputMongo)
+	viper.SetDefault("output.path", stdoutPath)
+	viper.SetDefault("migration.concurrency", 1)
+	viper.SetDefault("migration.writers", 1)
+	viper.SetDefault("migration.state_file", "sync_state.json")
+	viper.SetDefault("migration.dead_letter_file", "failed_rows.jsonl")
+	viper.SetDefault("migration.retry_delay", time.Second)
+	viper.SetDefault("migration.progress_interval", 10*time.Second)
+
+	for _, override := range connectionOverrides {
+		if err := viper.BindEnv(override.key, override.env); err != nil {
+			return config, nil, fmt.Errorf("failed to bind %s: %v", override.env, err)
+		}
+	}
+
+	// The format follows the file extension
+	format := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	switch format {
+	case "yml", "yaml", "json", "toml":
+	default:
+		return config, nil, fmt.Errorf("unsupported config file %s: the extension must be .yml, .yaml, .json or .toml", filename)
+	}
+
+	viper.SetConfigFile(filename)
+	viper.SetConfigType(format)
+	if err := viper.ReadInConfig(); err != nil {
+		return config, nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	decodeHook := mapstructure.ComposeDecodeHookFunc(
+		tableConfigHook,
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)
+	if err := viper.Unmarshal(&config, viper.DecodeHook(decodeHook)); err != nil {
+		return config, nil, fmt.Errorf("failed to unmarshal config: %v", err)
+	}
+	return config, decodeHook, nil
+}
+
+// finishConfig expands environment references, validates the configuration and fills in the
+// defaults that depend on other settings
+func finishConfig(config *Config) error {
+	// Connection settings may reference environment variables as ${VAR}
+	references := map[string]*string{
+		"mongodb.uri":      &config.MongoDB.URI,
+		"mongodb.database": &config.MongoDB.Database,
+		"mongodb.username": &config.MongoDB.Username,
+		"mongodb.password": &config.MongoDB.Password,
+	}
+	if !config.withoutPostgres {
+		references["postgres.dsn"] = &config.Postgres.DSN
+		references["postgres.host"] = &config.Postgres.Host
+		references["postgres.database"] = &config.Postgres.Database
+		references["postgres.user"] = &config.Postgres.User
+		references["postgres.password"] = &config.Postgres.Password
+	}
+	for key, value := range references {
+		expanded, err := expandEnvReferences(*value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		*value = expanded
+	}
+
+	if err := validateConfig(*config); err != nil {
+		return err
+	}
+
+	if config.MongoDB.BatchSize <= 0 {
+		config.MongoDB.BatchSize = defaultBatchSize
+	}
+	if len(config.Postgres.Schemas) == 0 {
+		config.Postgres.Schemas = []string{defaultSchema}
+	}
+	if config.Postgres.FetchSize <= 0 {
+		config.Postgres.FetchSize = defaultFetchSize
+	}
+	if config.Migration.Concurrency <= 0 {
+		config.Migration.Concurrency = 1
+	}
+	if config.Migration.Writers <= 0 {
+		config.Migration.Writers = 1
+	}
+	if config.Migration.WriteQueue <= 0 {
+		config.Migration.WriteQueue = config.Migration.Writers
+	}
+	if config.Migration.ProgressInterval <= 0 {
+		config.Migration.ProgressInterval = 10 * time.Second
+	}
+
+	// Every worker holds one connection while it reads a table, and a second one for child tables it
+	// embeds and for the chunks of large values it streams to GridFS, one query after the other
+	if config.Postgres.PoolMaxConns <= 0 {
+		config.Postgres.PoolMaxConns = defaultPoolMaxConns
+	}
+	connsPerWorker := 1
+	for _, table := range config.Postgres.Tables {
+		if len(table.Embed) > 0 {
+			connsPerWorker = 2
+		}
+	}
+	if config.MongoDB.GridFSThreshold > 0 {
+		connsPerWorker = 2
+	}
+	if int(config.Postgres.PoolMaxConns) < connsPerWorker*config.Migration.Concurrency {
+		return fmt.Errorf("postgres.pool_max_conns (%d) must be at least %d times migration.concurrency (%d)", config.Postgres.PoolMaxConns, connsPerWorker, config.Migration.Concurrency)
+	}
+	if config.Postgres.PoolMinConns > config.Postgres.PoolMaxConns {
+		return fmt.Errorf("postgres.pool_min_conns (%d) must not exceed postgres.pool_max_conns (%d)", config.Postgres.PoolMinConns, config.Postgres.PoolMaxConns)
+	}
+
+	return nil
+}
+
+// idStrategy is the effective mongodb.id_strategy. id_from_primary_key predates it and stands for from_pk.
+func (c Config) idStrategy() string {
+	switch {
+	case c.MongoDB.IDStrategy != "":
+		return c.MongoDB.IDStrategy
+	case c.MongoDB.IDFromPrimaryKey:
+		return idStrategyFromPK
+	}
+	return idStrategyObjectID
+}
+
+// validateConfig checks that the required settings are present and the options are valid
+func validateConfig(config Config) error {
+	switch config.Output.Target {
+	case outputMongo, outputJSONL:
+	case outputBSON:
+		if config.Output.Path == "" || config.Output.Path == stdoutPath {
+			return fmt.Errorf("output.target bson needs a directory in output.path")
+		}
+		if strings.TrimSpace(config.MongoDB.Database) == "" {
+			return fmt.Errorf("output.target bson needs mongodb.database, which names the dump subdirectory")
+		}
+	default:
+		return fmt.Errorf("invalid output.target %q: must be mongo, jsonl or bson", config.Output.Target)
+	}
+
+	type requiredSetting struct{ key, value string }
+	var required []requiredSetting
+	if !config.withoutPostgres && config.Postgres.DSN == "" {
+		required = append(required,
+			requiredSetting{"postgres.host", config.Postgres.Host},
+			requiredSetting{"postgres.database", config.Postgres.Database},
+			requiredSetting{"postgres.user", config.Postgres.User},
+		)
+	}
+	// File outputs never connect to MongoDB
+	if config.WritesToMongoDB() {
+		required = append(required,
+			requiredSetting{"mongodb.uri", config.MongoDB.URI},
+			requiredSetting{"mongodb.database", config.MongoDB.Database},
+		)
+	}
+	for _, setting := range required {
+		if strings.TrimSpace(setting.value) == "" {
+			return fmt.Errorf("%s is required", setting.key)
+		}
+	}
+	// A dsn is parsed up front, so a typo fails before anything connects
+	if !config.withoutPostgres && config.Postgres.DSN != "" {
+		if _, err := pgxpool.ParseConfig(config.Postgres.DSN); err != nil {
+			return fmt.Errorf("invalid postgres.dsn: %v", err)
+		}
+	} else if !config.withoutPostgres && (config.Postgres.Port <= 0 || config.Postgres.Port > 65535) {
+		return fmt.Errorf("postgres.port is required and must be between 1 and 65535, got %d", config.Postgres.Port)
+	}
+	if !config.withoutPostgres && len(config.Postgres.Tables) == 0 && !config.Postgres.AllTables {
+		return fmt.Errorf("postgres.tables is empty: list the tables to migrate or set postgres.all_tables: true")
+	}
+	if config.Postgres.AllTablesQuery != "" && !config.Postgres.AllTables {
+		return fmt.Errorf("postgres.all_tables_query needs postgres.all_tables: true")
+	}
+	for _, table := range config.Postgres.Tables {
+		if table.Name == "" && (table.Query == "" || table.Collection == "") {
+			return fmt.Errorf("postgres.tables: every entry needs a name, or a query and a collection")
+		}
+		if table.TargetDB != "" && (len(table.TargetDB) > 63 || strings.ContainsAny(table.TargetDB, "/\\. \"$")) {
+			return fmt.Errorf("table %s: invalid target_db %q: must be at most 63 characters without spaces or any of /\\.\"$", table.Name, table.TargetDB)
+		}
+		if table.Query != "" {
+			if table.Where != "" || len(table.Include) > 0 || len(table.Exclude) > 0 || table.Incremental != "" {
+				return fmt.Errorf("table %s: where, include, exclude and incremental cannot be combined with query", table.Name)
+			}
+			for _, embed := range table.Embed {
+				if embed.ParentKey == "" {
+					return fmt.Errorf("table %s: embed entries of a query need a parent_key", table.Name)
+				}
+			}
+		}
+		for _, embed := range table.Embed {
+			if embed.Table == "" || embed.ForeignKey == "" {
+				return fmt.Errorf("table %s: every embed entry needs a table and a foreign_key", table.Name)
+			}
+		}
+		for _, l := range table.Lookups {
+			if l.Column == "" || l.Table == "" || len(l.Values) == 0 {
+				return fmt.Errorf("table %s: every lookup needs a column, a table and values", table.Name)
+			}
+			switch l.Missing {
+			case "", lookupMissingNull, lookupMissingError:
+			default:
+				return fmt.Errorf("table %s: invalid missing %q of lookup %s: must be null or error", table.Name, l.Missing, l.Table)
+			}
+		}
+		if table.Capped != nil && table.TTL != nil {
+			return fmt.Errorf("table %s: a capped collection cannot have a TTL index", table.Name)
+		}
+		if table.Capped != nil && (table.Capped.SizeBytes <= 0 || table.Capped.MaxDocs < 0) {
+			return fmt.Errorf("table %s: capped needs a positive size_bytes and a max_docs of 0 or more", table.Name)
+		}
+		if table.TTL != nil && (table.TTL.Field == "" || table.TTL.ExpireAfterSeconds < 0) {
+			return fmt.Errorf("table %s: ttl needs a field and an expire_after_seconds of 0 or more", table.Name)
+		}
+	}
+
+	for _, table := range config.Postgres.Tables {
+		if len(table.Include) > 0 && len(table.Exclude) > 0 {
+			return fmt.Errorf("table %s: include and exclude cannot both be set", table.Name)
+		}
+		if _, err := compileTransforms(table); err != nil {
+			return err
+		}
+	}
+
+	for key, patterns := range map[string][]string{
+		"postgres.include_tables": config.Postgres.IncludeTables,
+		"postgres.exclude_tables": config.Postgres.ExcludeTables,
+	} {
+		if _, err := compileTablePatterns(patterns); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	for i, merge := range config.MongoDB.Merge {
+		if merge.Collection == "" || len(merge.Tables) == 0 {
+			return fmt.Errorf("mongodb.merge[%d]: tables and collection must be set", i)
+		}
+		if _, err := compileTablePatterns(merge.Tables); err != nil {
+			return fmt.Errorf("mongodb.merge[%d]: %v", i, err)
+		}
+	}
+
+	switch config.Postgres.ReadMode {
+	case readModeQuery, readModeCursor:
+	default:
+		return fmt.Errorf("invalid postgres.read_mode %q: must be query or cursor", config.Postgres.ReadMode)
+	}
+
+	switch config.Postgres.MissingTables {
+	case missingTablesFail, missingTablesSkip:
+	default:
+		return fmt.Errorf("invalid postgres.missing_tables %q: must be fail or skip", config.Postgres.MissingTables)
+	}
+
+	switch config.MongoDB.Mode {
+	case modeInsert, modeUpsert, modeReplace:
+	default:
+		return fmt.Errorf("invalid mongodb.mode %q: must be one of insert, upsert, replace", config.MongoDB.Mode)
+	}
+	switch config.MongoDB.OnDuplicate {
+	case onDuplicateFail, onDuplicateSkip, onDuplicateReplace:
+	default:
+		return fmt.Errorf("invalid mongodb.on_duplicate %q: must be fail, skip or replace", config.MongoDB.OnDuplicate)
+	}
+
+	switch config.MongoDB.CompositeID {
+	case compositeIDDocument, compositeIDString:
+	default:
+		return fmt.Errorf("invalid mongodb.composite_id %q: must be document or string", config.MongoDB.CompositeID)
+	}
+
+	switch config.MongoDB.IDStrategy {
+	case "", idStrategyObjectID, idStrategyFromPK, idStrategyFromColumns, idStrategyHash:
+	default:
+		return fmt.Errorf("invalid mongodb.id_strategy %q: must be one of objectid, from_pk, from_columns, hash", config.MongoDB.IDStrategy)
+	}
+	if config.MongoDB.IDFromPrimaryKey && config.MongoDB.IDStrategy != "" && config.MongoDB.IDStrategy != idStrategyFromPK {
+		return fmt.Errorf("mongodb.id_from_primary_key cannot be combined with id_strategy %s", config.MongoDB.IDStrategy)
+	}
+	if config.idStrategy() == idStrategyFromColumns && len(config.MongoDB.IDColumns) == 0 {
+		if config.Postgres.AllTables {
+			return fmt.Errorf("mongodb.id_strategy from_columns with all_tables needs mongodb.id_columns")
+		}
+		for _, table := range config.Postgres.Tables {
+			if len(tableIDColumns(table)) == 0 {
+				return fmt.Errorf("mongodb.id_strategy from_columns needs mongodb.id_columns, or id_columns on table %s", table.Name)
+			}
+		}
+	}
+	switch config.MongoDB.IDHashFormat {
+	case idHashObjectID, idHashHex:
+	default:
+		return fmt.Errorf("invalid mongodb.id_hash_format %q: must be objectid or hex", config.MongoDB.IDHashFormat)
+	}
+	switch config.MongoDB.IDColumnPolicy {
+	case idPolicyErrorOnConflict, idPolicyUseIDColumn, idPolicyAlwaysObjectID:
+	default:
+		return fmt.Errorf("invalid mongodb.id_column_policy %q: must be error_on_conflict, use_id_column or always_objectid", config.MongoDB.IDColumnPolicy)
+	}
+	for _, table := range config.Postgres.Tables {
+		if table.IDColumn != "" && len(table.IDColumns) > 0 {
+			return fmt.Errorf("table %s: id_column and id_columns cannot both be set", table.Name)
+		}
+	}
+
+	switch config.MongoDB.FieldNaming {
+	case fieldNamingPreserve, fieldNamingCamel, fieldNamingPascal:
+	default:
+		return fmt.Errorf("invalid mongodb.field_naming %q: must be one of preserve, camel, pascal", config.MongoDB.FieldNaming)
+	}
+
+	switch config.Types.UUIDFormat {
+	case uuidFormatString, uuidFormatBinary:
+	default:
+		return fmt.Errorf("invalid types.uuid_format %q: must be string or binary", config.Types.UUIDFormat)
+	}
+
+	switch config.Types.ByteaFormat {
+	case byteaFormatBinary, byteaFormatBase64:
+	default:
+		return fmt.Errorf("invalid types.bytea_format %q: must be binary or base64", config.Types.ByteaFormat)
+	}
+
+	switch config.Types.IntervalFormat {
+	case intervalFormatISO, intervalFormatMicroseconds:
+	default:
+		return fmt.Errorf("invalid types.interval_format %q: must be iso8601 or microseconds", config.Types.IntervalFormat)
+	}
+
+	switch config.Types.TimeFormat {
+	case timeFormatString, timeFormatMilliseconds:
+	default:
+		return fmt.Errorf("invalid types.time_format %q: must be string or milliseconds", config.Types.TimeFormat)
+	}
+
+	if _, err := time.LoadLocation(config.Types.SourceTimezone); err != nil {
+		return fmt.Errorf("invalid types.source_timezone %q: %v", config.Types.SourceTimezone, err)
+	}
+
+	switch config.Types.InetFormat {
+	case inetFormatString, inetFormatDocument:
+	default:
+		return fmt.Errorf("invalid types.inet_format %q: must be string or document", config.Types.InetFormat)
+	}
+
+	switch config.Types.BitFormat {
+	case bitFormatString, bitFormatBinary, bitFormatBoolean:
+	default:
+		return fmt.Errorf("invalid types.bit_format %q: must be string, binary or boolean", config.Types.BitFormat)
+	}
+	switch config.Types.XMLFormat {
+	case xmlFormatString, xmlFormatDocument:
+	default:
+		return fmt.Errorf("invalid types.xml_format %q: must be string or document", config.Types.XMLFormat)
+	}
+	switch config.Types.RangeFormat {
+	case rangeFormatDocument, rangeFormatString:
+	default:
+		return fmt.Errorf("invalid types.range_format %q: must be document or string", config.Types.RangeFormat)
+	}
+
+	switch config.Postgres.SSLMode {
+	case "", "disable", "allow", "prefer", "require":
+	case "verify-ca", "verify-full":
+		for key, path := range map[string]string{
+			"postgres.sslrootcert": config.Postgres.SSLRootCert,
+			"postgres.sslcert":     config.Postgres.SSLCert,
+			"postgres.sslkey":      config.Postgres.SSLKey,
+		} {
+			if err := requireFile(key, path); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("invalid postgres.sslmode %q: must be one of disable, allow, prefer, require, verify-ca, verify-full", config.Postgres.SSLMode)
+	}
+
+	switch strings.ToUpper(config.MongoDB.AuthMechanism) {
+	case "", authSCRAMSHA1, authSCRAMSHA256, authPlain, authX509, authAWS, authGSSAPI:
+	default:
+		return fmt.Errorf("invalid mongodb.auth_mechanism %q: must be one of SCRAM-SHA-1, SCRAM-SHA-256, PLAIN, MONGODB-X509, MONGODB-AWS, GSSAPI", config.MongoDB.AuthMechanism)
+	}
+	if strings.EqualFold(config.MongoDB.AuthMechanism, authX509) && !(config.MongoDB.TLS.Enabled && config.MongoDB.TLS.CertFile != "") && !strings.Contains(strings.ToLower(config.MongoDB.URI), "tlscertificatekeyfile=") {
+		return fmt.Errorf("mongodb.auth_mechanism MONGODB-X509 needs a client certificate: set mongodb.tls.enabled and mongodb.tls.cert_file")
+	}
+
+	if config.Migration.Schedule != "" {
+		if _, err := ParseSchedule(config.Migration.Schedule); err != nil {
+			return fmt.Errorf("migration.schedule: %v", err)
+		}
+	}
+
+	if config.Migration.Sample < 0 {
+		return fmt.Errorf("migration.sample must not be negative, got %d", config.Migration.Sample)
+	}
+	for _, table := range config.Postgres.Tables {
+		if table.Limit < 0 {
+			return fmt.Errorf("table %s: limit must not be negative, got %d", table.Name, table.Limit)
+		}
+	}
+
+	if config.Postgres.StatementTimeout < 0 {
+		return fmt.Errorf("postgres.statement_timeout must not be negative, got %s", config.Postgres.StatementTimeout)
+	}
+
+	if config.Migration.Writers < 0 {
+		return fmt.Errorf("migration.writers must not be negative, got %d", config.Migration.Writers)
+	}
+	if config.Migration.WriteQueue < 0 {
+		return fmt.Errorf("migration.write_queue must not be negative, got %d", config.Migration.WriteQueue)
+	}
+
+	switch config.MongoDB.ValidationLevel {
+	case validationStrict, validationModerate:
+	default:
+		return fmt.Errorf("invalid mongodb.validation_level %q: must be strict or moderate", config.MongoDB.ValidationLevel)
+	}
+
+	switch config.MongoDB.OversizedDocuments {
+	case oversizedFail, oversizedSkip:
+	case oversizedTruncate:
+		if len(config.MongoDB.TruncateFields) == 0 {
+			return fmt.Errorf("mongodb.oversized_documents: truncate needs mongodb.truncate_fields")
+		}
+	default:
+		return fmt.Errorf("invalid mongodb.oversized_documents %q: must be fail, skip or truncate", config.MongoDB.OversizedDocuments)
+	}
+
+	if config.MongoDB.GridFSThreshold < 0 {
+		return fmt.Errorf("mongodb.gridfs_threshold must not be negative, got %d", config.MongoDB.GridFSThreshold)
+	}
+	if config.MongoDB.MaxBatchBytes < 0 {
+		return fmt.Errorf("mongodb.max_batch_bytes must not be negative, got %d", config.MongoDB.MaxBatchBytes)
+	}
+	if config.MongoDB.MaxDocsPerSecond < 0 {
+		return fmt.Errorf("mongodb.max_docs_per_second must not be negative, got %d", config.MongoDB.MaxDocsPerSecond)
+	}
+
+	if _, err := buildWriteConcern(config); err != nil {
+		return err
+	}
+	if config.MongoDB.ReadPreference != "" {
+		if _, err := readpref.ModeFromString(config.MongoDB.ReadPreference); err != nil {
+			return fmt.Errorf("invalid mongodb.read_preference %q: must be one of primary, primaryPreferred, secondary, secondaryPreferred, nearest", config.MongoDB.ReadPreference)
+		}
+	}
+
+	if config.MongoDB.TLS.Enabled {
+		for key, path := range map[string]string{
+			"mongodb.tls.ca_file":   config.MongoDB.TLS.CAFile,
+			"mongodb.tls.cert_file": config.MongoDB.TLS.CertFile,
+			"mongodb.tls.key_file":  config.MongoDB.TLS.KeyFile,
+		} {
+			if err := requireFile(key, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// tableConfigHook lets an entry of the tables list be given as a bare table name
+func tableConfigHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() == reflect.String && to == reflect.TypeOf(TableConfig{}) {
+		return TableConfig{Name: data.(string)}, nil
+	}
+	return data, nil
+}
+
+// requireFile checks that the file named by an optional path setting exists
+func requireFile(key, path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	return nil
+}
+
+// envReference matches a ${VAR} reference in a config value
+var envReference = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandEnvReferences replaces every ${VAR} in value with the value of the environment variable.
+// Unlike os.ExpandEnv a bare $ is kept as is, since it is common in passwords.
+func expandEnvReferences(value string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return env
+	})
+	return expanded, err
+}
+
+// connectionOverrides lists the connection settings that can be overridden without editing
+// the config file. A command-line flag wins over the environment variable, which wins over the file.
+var connectionOverrides = []struct {
+	key, flag, env, usage string
+}{
+	{"postgres.dsn", "pg-dsn", "PG_DSN", "PostgreSQL connection string, used instead of the host, port, database and user"},
+	{"postgres.host", "pg-host", "PG_HOST", "PostgreSQL host"},
+	{"postgres.port", "pg-port", "PG_PORT", "PostgreSQL port"},
+	{"postgres.database", "pg-database", "PG_DATABASE", "PostgreSQL database"},
+	{"postgres.user", "pg-user", "PG_USER", "PostgreSQL user"},
+	{"postgres.password", "pg-password", "PG_PASSWORD", "PostgreSQL password"},
+	{"mongodb.uri", "mongo-uri", "MONGO_URI", "MongoDB connection URI"},
+	{"mongodb.database", "mongo-database", "MONGO_DATABASE", "MongoDB database"},
+	{"mongodb.username", "mongo-username", "MONGO_USERNAME", "MongoDB user"},
+	{"mongodb.password", "mongo-password", "MONGO_PASSWORD", "MongoDB password"},
+}
+
+// RegisterConnectionFlags defines the connection override flags on fs and binds them
+// to their config keys, so that LoadConfig picks up the values once fs is parsed
+func RegisterConnectionFlags(fs *pflag.FlagSet) error {
+	for _, override := range connectionOverrides {
+		fs.String(override.flag, "", fmt.Sprintf("%s, overrides %s (env %s)", override.usage, override.key, override.env))
+		if err := viper.BindPFlag(override.key, fs.Lookup(override.flag)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
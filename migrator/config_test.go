@@ -0,0 +1,150 @@
+package migrator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// loadTestConfig writes content to a config file with the given name and loads it
+func loadTestConfig(t *testing.T, name, content string) (Config, error) {
+	t.Helper()
+	viper.Reset()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.yml": `
+postgres:
+  host: db.example.com
+  port: 5433
+  database: shop
+  user: app
+  tables:
+    - orders
+    - name: customers
+      where: active
+      exclude: [notes]
+mongodb:
+  uri: mongodb://mongo:27017
+  database: shop
+  batch_size: 500
+`,
+		"config.json": `{
+  "postgres": {
+    "host": "db.example.com",
+    "port": 5433,
+    "database": "shop",
+    "user": "app",
+    "tables": ["orders", {"name": "customers", "where": "active", "exclude": ["notes"]}]
+  },
+  "mongodb": {"uri": "mongodb://mongo:27017", "database": "shop", "batch_size": 500}
+}`,
+		"config.toml": `
+[postgres]
+host = "db.example.com"
+port = 5433
+database = "shop"
+user = "app"
+
+[[postgres.tables]]
+name = "orders"
+
+[[postgres.tables]]
+name = "customers"
+where = "active"
+exclude = ["notes"]
+
+[mongodb]
+uri = "mongodb://mongo:27017"
+database = "shop"
+batch_size = 500
+`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			config, err := loadTestConfig(t, name, content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Postgres.Host != "db.example.com" || config.Postgres.Port != 5433 || config.Postgres.Database != "shop" {
+				t.Errorf("postgres block: got host %q, port %d, database %q", config.Postgres.Host, config.Postgres.Port, config.Postgres.Database)
+			}
+			tables := config.Postgres.Tables
+			if len(tables) != 2 || tables[0].Name != "orders" || tables[1].Name != "customers" {
+				t.Fatalf("tables: got %+v", tables)
+			}
+			if tables[1].Where != "active" || len(tables[1].Exclude) != 1 || tables[1].Exclude[0] != "notes" {
+				t.Errorf("options of customers: got %+v", tables[1])
+			}
+			if config.MongoDB.URI != "mongodb://mongo:27017" || config.MongoDB.Database != "shop" || config.MongoDB.BatchSize != 500 {
+				t.Errorf("mongodb block: got uri %q, database %q, batch_size %d", config.MongoDB.URI, config.MongoDB.Database, config.MongoDB.BatchSize)
+			}
+			// Settings the file leaves out keep their defaults
+			if config.MongoDB.Mode != modeInsert || config.Types.UUIDFormat != uuidFormatString {
+				t.Errorf("defaults: got mode %q, uuid_format %q", config.MongoDB.Mode, config.Types.UUIDFormat)
+			}
+		})
+	}
+}
+
+func TestLoadConfigUnsupportedExtension(t *testing.T) {
+	for _, name := range []string{"config.ini", "config"} {
+		_, err := loadTestConfig(t, name, "postgres:\n  host: localhost\n")
+		if err == nil || !strings.Contains(err.Error(), "the extension must be .yml, .yaml, .json or .toml") {
+			t.Errorf("%s: got error %v, want the unsupported extension error", name, err)
+		}
+	}
+}
+
+func TestLoadConfigInvalidFile(t *testing.T) {
+	if _, err := loadTestConfig(t, "config.json", `{"postgres": {"host": `); err == nil {
+		t.Error("malformed JSON: got no error")
+	}
+}
+
+func TestLoadConfigPoolSize(t *testing.T) {
+	const base = `
+postgres:
+  host: localhost
+  port: 5432
+  database: shop
+  user: app
+  pool_max_conns: 3
+  tables: %s
+mongodb:
+  uri: mongodb://localhost:27017
+  database: shop
+  gridfs_threshold: %d
+migration:
+  concurrency: 2
+`
+	tests := []struct {
+		name      string
+		tables    string
+		threshold int
+		fails     bool
+	}{
+		{"one connection per worker", "[orders]", 0, false},
+		{"embedding", "[{name: orders, embed: [{table: order_items, foreign_key: order_id}]}]", 0, true},
+		{"gridfs", "[orders]", 8388608, true},
+	}
+	for _, test := range tests {
+		_, err := loadTestConfig(t, "config.yml", fmt.Sprintf(base, test.tables, test.threshold))
+		if test.fails && (err == nil || !strings.Contains(err.Error(), "pool_max_conns (3) must be at least 2 times")) {
+			t.Errorf("%s: got error %v, want one about pool_max_conns", test.name, err)
+		}
+		if !test.fails && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
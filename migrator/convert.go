@@ -0,0 +1,535 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// convertFunc turns the value pgx decoded for one column into the value stored in MongoDB.
+// raw holds the undecoded wire bytes of the same column. It is never called for NULLs.
+type convertFunc func(value interface{}, raw []byte) (interface{}, error)
+
+// companionField is an extra document field derived from a column and stored right after it.
+// A NULL column produces a null companion.
+type companionField struct {
+	name  string
+	value convertFunc
+}
+
+// columnConverter describes how a single result column lands in a document
+type columnConverter struct {
+	convert    convertFunc
+	companions []companionField
+}
+
+// passthrough stores the value exactly as pgx decoded it
+func passthrough(value interface{}, raw []byte) (interface{}, error) {
+	return value, nil
+}
+
+// convertedRow holds the BSON values of a row and the companion fields of each column
+type convertedRow struct {
+	values     []interface{}
+	companions [][]bson.E
+	id         interface{} // replaces the _id built from the key columns when set
+}
+
+// buildConverters picks a converter for every result column based on its type OID
+func buildConverters(table string, fields []pgproto3.FieldDescription, types pgTypes, config Config) []columnConverter {
+	converters := make([]columnConverter, len(fields))
+	for i, field := range fields {
+		converters[i] = converterFor(table, field, types, config)
+	}
+	return converters
+}
+
+// converterFor returns the converter for a single result column
+func converterFor(table string, field pgproto3.FieldDescription, types pgTypes, config Config) columnConverter {
+	column := string(field.Name)
+
+	switch field.DataTypeOID {
+	case pgtype.NumericOID:
+		return columnConverter{convert: numericConverter(table, column)}
+	case pgtype.TimestampOID:
+		return columnConverter{convert: localTimestampConverter(sourceLocation(config))}
+	case pgtype.DateOID:
+		return columnConverter{convert: timestampConverter}
+	case pgtype.TimestamptzOID:
+		converter := columnConverter{convert: timestampConverter}
+		if config.Types.TimestampOffsetField {
+			converter.companions = append(converter.companions, companionField{name: fieldName(column+"_offset", config.MongoDB.FieldNaming), value: timestampOffset(types.timeZone)})
+		}
+		return converter
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		return columnConverter{convert: jsonConverter(table, field, config.Types.JSONAsString)}
+	case pgtype.UUIDOID:
+		return columnConverter{convert: uuidConverter(config.Types.UUIDFormat)}
+	case pgtype.ByteaOID:
+		return columnConverter{convert: byteaConverter(config.Types.ByteaFormat)}
+	case pgtype.InetOID:
+		return columnConverter{convert: inetConverter(config.Types.InetFormat, false)}
+	case pgtype.CIDROID:
+		return columnConverter{convert: inetConverter(config.Types.InetFormat, true)}
+	case pgtype.MacaddrOID:
+		return columnConverter{convert: macaddrConverter}
+	case moneyOID:
+		return columnConverter{convert: moneyConverter}
+	case pgtype.BitOID, pgtype.VarbitOID:
+		return columnConverter{convert: bitConverter(config.Types.BitFormat)}
+	case pgtype.IntervalOID:
+		return columnConverter{convert: intervalConverter(config.Types.IntervalFormat)}
+	case pgtype.TimeOID:
+		return columnConverter{convert: timeConverter(config.Types.TimeFormat)}
+	case timetzOID:
+		return columnConverter{convert: timetzConverter(config.Types.TimeFormat)}
+	case xmlOID:
+		return columnConverter{convert: xmlConverter(table, column, config.Types.XMLFormat)}
+	}
+
+	if elementOID, ok := arrayElementOIDs[field.DataTypeOID]; ok {
+		return columnConverter{convert: arrayConverter(table, field, elementOID, types, config)}
+	}
+
+	if labels, ok := types.enums[field.DataTypeOID]; ok {
+		converter := columnConverter{convert: enumConverter(field)}
+		if config.Types.EnumOrdinalField {
+			converter.companions = append(converter.companions, companionField{name: fieldName(column+"_ordinal", config.MongoDB.FieldNaming), value: enumOrdinal(labels)})
+		}
+		return converter
+	}
+	if _, ok := types.enumArrays[field.DataTypeOID]; ok {
+		return columnConverter{convert: enumArrayConverter(field)}
+	}
+	if types.geometries[field.DataTypeOID] {
+		return columnConverter{convert: geometryConverter(table, column, config.Types.GeometrySRID)}
+	}
+	if types.hstores[field.DataTypeOID] {
+		return columnConverter{convert: hstoreConverter(column)}
+	}
+	if types.citexts[field.DataTypeOID] {
+		converter := columnConverter{convert: citextConverter}
+		if config.Types.CitextLowerField {
+			converter.companions = append(converter.companions, companionField{name: fieldName(column+"_lower", config.MongoDB.FieldNaming), value: citextLower})
+		}
+		return converter
+	}
+	if types.citextArrays[field.DataTypeOID] {
+		return columnConverter{convert: enumArrayConverter(field)}
+	}
+	if attributes, ok := types.composites[field.DataTypeOID]; ok {
+		return columnConverter{convert: compositeConverter(table, column, attributes, types, config)}
+	}
+	if subtype, ok := types.ranges[field.DataTypeOID]; ok {
+		return columnConverter{convert: rangeConverter(table, field, subtype, types, config)}
+	}
+
+	return columnConverter{convert: passthrough}
+}
+
+// arrayElementOIDs maps the array types pgx decodes to the OID of their element type
+var arrayElementOIDs = map[uint32]uint32{
+	pgtype.BoolArrayOID:        pgtype.BoolOID,
+	pgtype.ByteaArrayOID:       pgtype.ByteaOID,
+	pgtype.Int2ArrayOID:        pgtype.Int2OID,
+	pgtype.Int4ArrayOID:        pgtype.Int4OID,
+	pgtype.Int8ArrayOID:        pgtype.Int8OID,
+	pgtype.Float4ArrayOID:      pgtype.Float4OID,
+	pgtype.Float8ArrayOID:      pgtype.Float8OID,
+	pgtype.NumericArrayOID:     pgtype.NumericOID,
+	pgtype.TextArrayOID:        pgtype.TextOID,
+	pgtype.VarcharArrayOID:     pgtype.VarcharOID,
+	pgtype.BPCharArrayOID:      pgtype.BPCharOID,
+	pgtype.DateArrayOID:        pgtype.DateOID,
+	pgtype.TimestampArrayOID:   pgtype.TimestampOID,
+	pgtype.TimestamptzArrayOID: pgtype.TimestamptzOID,
+	pgtype.UUIDArrayOID:        pgtype.UUIDOID,
+	pgtype.InetArrayOID:        pgtype.InetOID,
+	pgtype.CIDRArrayOID:        pgtype.CIDROID,
+	pgtype.JSONArrayOID:        pgtype.JSONOID,
+	pgtype.JSONBArrayOID:       pgtype.JSONBOID,
+}
+
+// convertRow converts the decoded values of a row. Every SQL NULL becomes an untyped nil,
+// whatever the column type, so it is stored as BSON null (or left out with omit_nulls).
+func convertRow(converters []columnConverter, values []interface{}, raw [][]byte) (convertedRow, error) {
+	row := convertedRow{
+		values:     make([]interface{}, len(values)),
+		companions: make([][]bson.E, len(values)),
+	}
+	for i, value := range values {
+		converter := converters[i]
+		null := raw[i] == nil || isNil(value)
+		for _, companion := range converter.companions {
+			var companionValue interface{}
+			if !null {
+				v, err := companion.value(value, raw[i])
+				if err != nil {
+					return row, err
+				}
+				companionValue = normalizeNil(v)
+			}
+			row.companions[i] = append(row.companions[i], bson.E{Key: companion.name, Value: companionValue})
+		}
+
+		if null {
+			continue
+		}
+		v, err := converter.convert(value, raw[i])
+		if err != nil {
+			return row, err
+		}
+		row.values[i] = normalizeNil(v)
+	}
+	return row, nil
+}
+
+// isNil reports whether value is nil or a typed nil such as a nil pointer, map or slice
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+		return v.IsNil()
+	}
+	return false
+}
+
+// normalizeNil turns typed nils into an untyped nil, which the BSON encoder writes as null
+func normalizeNil(value interface{}) interface{} {
+	if isNil(value) {
+		return nil
+	}
+	return value
+}
+
+// numericConverter maps numeric/decimal values to BSON Decimal128. Values whose precision or
+// exponent Decimal128 cannot hold exactly are stored as their decimal string with a warning.
+func numericConverter(table, column string) convertFunc {
+	warned := false
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		var numeric pgtype.Numeric
+		switch v := value.(type) {
+		case pgtype.Numeric:
+			numeric = v
+		case pgtype.InfinityModifier:
+			if v == pgtype.Infinity {
+				return primitive.ParseDecimal128("Infinity")
+			}
+			return primitive.ParseDecimal128("-Infinity")
+		default:
+			return nil, fmt.Errorf("column %s: unexpected numeric value of type %T", column, value)
+		}
+
+		if numeric.NaN {
+			return primitive.ParseDecimal128("NaN")
+		}
+
+		if decimal, ok := primitive.ParseDecimal128FromBigInt(numeric.Int, int(numeric.Exp)); ok {
+			return decimal, nil
+		}
+
+		text, err := numeric.EncodeText(nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: error formatting numeric value: %v", column, err)
+		}
+		if !warned {
+			logger.Warn("Table %s column %s has numeric values too large for Decimal128, storing them as strings", table, column)
+			warned = true
+		}
+		return string(text), nil
+	}
+}
+
+// timestampConverter stores timestamp, timestamptz and date values as BSON dates in UTC.
+// PostgreSQL infinity values have no BSON date equivalent and are stored as strings.
+func timestampConverter(value interface{}, raw []byte) (interface{}, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return primitive.NewDateTimeFromTime(v.UTC()), nil
+	case pgtype.InfinityModifier:
+		return v.String(), nil
+	default:
+		return nil, fmt.Errorf("unexpected timestamp value of type %T", value)
+	}
+}
+
+// timestampOffset returns the UTC offset a timestamptz value has in the session time zone, e.g.
+// "+05:30". PostgreSQL keeps no offset of its own, so without a session zone it is UTC.
+func timestampOffset(location *time.Location) convertFunc {
+	if location == nil {
+		location = time.UTC
+	}
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		t, ok := value.(time.Time)
+		if !ok {
+			return nil, nil
+		}
+		return t.In(location).Format("-07:00"), nil
+	}
+}
+
+// jsonConverter parses json/jsonb values into nested documents and arrays, keeping the key
+// order of objects. With asString set, or when a value is not valid JSON, the JSON text is
+// stored as a plain string instead.
+func jsonConverter(table string, field pgproto3.FieldDescription, asString bool) convertFunc {
+	column := string(field.Name)
+	warned := false
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		text := raw
+		// Binary jsonb is prefixed with a format version byte
+		if field.DataTypeOID == pgtype.JSONBOID && field.Format == pgtype.BinaryFormatCode && len(text) > 0 {
+			text = text[1:]
+		}
+		if asString {
+			return string(text), nil
+		}
+
+		parsed, err := parseJSON(text)
+		if err != nil {
+			if !warned {
+				logger.Warn("Table %s column %s has invalid JSON (%v), storing it as a string", table, column, err)
+				warned = true
+			}
+			return string(text), nil
+		}
+		return parsed, nil
+	}
+}
+
+// parseJSON decodes a JSON text into bson.D for objects, bson.A for arrays and int64 or
+// float64 for numbers
+func parseJSON(text []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	decoder.UseNumber()
+
+	value, err := parseJSONValue(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return value, nil
+}
+
+// parseJSONValue decodes the next JSON value from the decoder
+func parseJSONValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			document := bson.D{}
+			for decoder.More() {
+				keyToken, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := parseJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				document = append(document, bson.E{Key: keyToken.(string), Value: value})
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			return document, nil
+		case '[':
+			array := bson.A{}
+			for decoder.More() {
+				value, err := parseJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			return array, nil
+		default:
+			return nil, fmt.Errorf("unexpected delimiter %v", t)
+		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	default:
+		// strings, booleans and null
+		return t, nil
+	}
+}
+
+// arrayConverter stores PostgreSQL arrays as BSON arrays, converting each element like a
+// column of the element type. NULL elements stay null and multi-dimensional arrays become
+// nested arrays; lower bounds other than 1 are not preserved.
+func arrayConverter(table string, field pgproto3.FieldDescription, elementOID uint32, types pgTypes, config Config) convertFunc {
+	elementField := pgproto3.FieldDescription{Name: field.Name, DataTypeOID: elementOID, Format: pgtype.TextFormatCode}
+	convertElement := converterFor(table, elementField, types, config).convert
+
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		array := reflect.ValueOf(value)
+		if array.Kind() != reflect.Struct || !array.FieldByName("Elements").IsValid() {
+			return nil, fmt.Errorf("column %s: unexpected array value of type %T", field.Name, value)
+		}
+		elements := array.FieldByName("Elements")
+		dimensions := array.FieldByName("Dimensions").Interface().([]pgtype.ArrayDimension)
+
+		values := make([]interface{}, elements.Len())
+		for i := range values {
+			element := elements.Index(i)
+			elementValue := element.Interface().(interface{ Get() interface{} }).Get()
+			if elementValue == nil {
+				continue
+			}
+
+			// json and jsonb elements keep their text so object key order is preserved
+			var elementRaw []byte
+			if bytesField := element.FieldByName("Bytes"); bytesField.IsValid() {
+				elementRaw = bytesField.Bytes()
+			}
+
+			converted, err := convertElement(elementValue, elementRaw)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = converted
+		}
+
+		return nestArray(values, dimensions), nil
+	}
+}
+
+// nestArray splits the flattened elements of a multi-dimensional array into nested arrays
+func nestArray(values []interface{}, dimensions []pgtype.ArrayDimension) bson.A {
+	if len(dimensions) <= 1 {
+		return bson.A(values)
+	}
+
+	length := int(dimensions[0].Length)
+	nested := make(bson.A, length)
+	if length == 0 {
+		return nested
+	}
+	size := len(values) / length
+	for i := range nested {
+		nested[i] = nestArray(values[i*size:(i+1)*size], dimensions[1:])
+	}
+	return nested
+}
+
+// uuidConverter stores uuid values either as the canonical hyphenated string or as BSON
+// binary subtype 4
+func uuidConverter(format string) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		uuid, ok := value.([16]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected uuid value of type %T", value)
+		}
+		if format == uuidFormatBinary {
+			return primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: uuid[:]}, nil
+		}
+		return formatUUID(uuid), nil
+	}
+}
+
+// formatUUID returns the canonical xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx form of a UUID
+func formatUUID(uuid [16]byte) string {
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], uuid[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], uuid[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], uuid[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], uuid[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], uuid[10:])
+	return string(buf)
+}
+
+// byteaConverter stores bytea values as BSON binary with the generic subtype, or as a
+// standard base64 string. pgx hands out bytea values that alias its read buffer, so
+// binary values are copied exactly once and base64 is encoded straight from the buffer.
+func byteaConverter(format string) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		data, ok := value.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected bytea value of type %T", value)
+		}
+		if format == byteaFormatBase64 {
+			return base64.StdEncoding.EncodeToString(data), nil
+		}
+		return primitive.Binary{Subtype: bson.TypeBinaryGeneric, Data: append([]byte(nil), data...)}, nil
+	}
+}
+
+// enumConverter stores the label of an enum value as a string. pgx has no decoder for enum
+// types and reads them in text format, so the value already is the label.
+func enumConverter(field pgproto3.FieldDescription) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		if label, ok := value.(string); ok {
+			return label, nil
+		}
+		return string(raw), nil
+	}
+}
+
+// enumOrdinal returns the 1-based position of an enum label in the type's sort order
+func enumOrdinal(labels map[string]int) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		return int32(labels[string(raw)]), nil
+	}
+}
+
+// citextConverter stores a citext value as the string it holds, in its original case
+func citextConverter(value interface{}, raw []byte) (interface{}, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return string(raw), nil
+}
+
+// citextLower returns a citext value in lower case, to match it case-insensitively like PostgreSQL does
+func citextLower(value interface{}, raw []byte) (interface{}, error) {
+	return strings.ToLower(string(raw)), nil
+}
+
+// enumArrayConverter turns the text form of an enum array, e.g. {happy,sad}, into an array of labels.
+// citext[] columns are read the same way.
+func enumArrayConverter(field pgproto3.FieldDescription) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		array, err := pgtype.ParseUntypedTextArray(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", field.Name, err)
+		}
+		values := make([]interface{}, len(array.Elements))
+		for i, element := range array.Elements {
+			if element == "NULL" && !array.Quoted[i] {
+				continue
+			}
+			values[i] = element
+		}
+		return nestArray(values, array.Dimensions), nil
+	}
+}
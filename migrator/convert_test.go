@@ -0,0 +1,263 @@
+package migrator
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testConfig returns the configuration of a config file holding only the required settings, with
+// every default set
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	viper.Reset()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(requiredSettings), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// requiredSettings is the smallest config file that passes validation
+const requiredSettings = `
+postgres:
+  host: localhost
+  port: 5432
+  database: test
+  user: test
+  tables: [test]
+mongodb:
+  uri: mongodb://localhost:27017
+  database: test
+`
+
+// column describes a result column of the given type in text format
+func column(name string, oid uint32) pgproto3.FieldDescription {
+	return pgproto3.FieldDescription{Name: []byte(name), DataTypeOID: oid, Format: pgtype.TextFormatCode}
+}
+
+// convertColumn converts one value given in the wire format of field, nil for NULL, the way
+// transferTable does: decoded like pgx decodes it, then through the converter of the column.
+// It returns the stored value and the companion fields.
+func convertColumn(t *testing.T, field pgproto3.FieldDescription, raw []byte, types pgTypes, config Config) (interface{}, []bson.E) {
+	t.Helper()
+	var value interface{}
+	if raw != nil {
+		var err error
+		connInfo := pgtype.NewConnInfo()
+		if field.Format == pgtype.TextFormatCode {
+			value, err = decodeText(connInfo, field.DataTypeOID, raw)
+		} else {
+			value, err = decodeBinary(connInfo, field.DataTypeOID, raw)
+		}
+		if err != nil {
+			t.Fatalf("decoding %q: %v", raw, err)
+		}
+	}
+	converters := buildConverters("public.test", []pgproto3.FieldDescription{field}, types, config)
+	row, err := convertRow(converters, []interface{}{value}, [][]byte{raw})
+	if err != nil {
+		t.Fatalf("converting %q: %v", raw, err)
+	}
+	return row.values[0], row.companions[0]
+}
+
+// roundTrip stores value as the _id of a document and reads it back, as MongoDB would return it
+func roundTrip(t *testing.T, value interface{}) interface{} {
+	t.Helper()
+	data, err := bson.Marshal(bson.D{{Key: "_id", Value: value}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document bson.D
+	if err := bson.Unmarshal(data, &document); err != nil {
+		t.Fatal(err)
+	}
+	return document[0].Value
+}
+
+func TestUUIDFormats(t *testing.T) {
+	const text = "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"
+	binary := []byte{0xa0, 0xee, 0xbc, 0x99, 0x9c, 0x0b, 0x4e, 0xf8, 0xbb, 0x6d, 0x6b, 0xb9, 0xbd, 0x38, 0x0a, 0x11}
+	binaryField := column("id", pgtype.UUIDOID)
+	binaryField.Format = pgtype.BinaryFormatCode
+
+	for _, field := range []struct {
+		field pgproto3.FieldDescription
+		raw   []byte
+	}{{column("id", pgtype.UUIDOID), []byte(text)}, {binaryField, binary}} {
+		config := testConfig(t)
+		value, _ := convertColumn(t, field.field, field.raw, pgTypes{}, config)
+		if got := roundTrip(t, value); got != text {
+			t.Errorf("uuid_format string: got %#v, want %s", got, text)
+		}
+
+		config.Types.UUIDFormat = uuidFormatBinary
+		value, _ = convertColumn(t, field.field, field.raw, pgTypes{}, config)
+		got, ok := roundTrip(t, value).(primitive.Binary)
+		if !ok || got.Subtype != bson.TypeBinaryUUID {
+			t.Fatalf("uuid_format binary: got %#v, want binary subtype 4", roundTrip(t, value))
+		}
+		var uuid [16]byte
+		copy(uuid[:], got.Data)
+		if len(got.Data) != 16 || formatUUID(uuid) != text {
+			t.Errorf("uuid_format binary: got %x, want %s", got.Data, text)
+		}
+	}
+
+	value, _ := convertColumn(t, column("id", pgtype.UUIDOID), nil, pgTypes{}, testConfig(t))
+	if value != nil {
+		t.Errorf("NULL uuid: got %#v, want nil", value)
+	}
+}
+
+func TestEnumColumns(t *testing.T) {
+	// CREATE TYPE mood AS ENUM ('sad', 'ok', 'happy'), with the array type mood[]
+	const moodOID, moodArrayOID = 90001, 90002
+	types := pgTypes{
+		enums:      map[uint32]map[string]int{moodOID: {"sad": 1, "ok": 2, "happy": 3}},
+		enumArrays: map[uint32]uint32{moodArrayOID: moodOID},
+	}
+	tests := []struct {
+		raw     []byte
+		want    interface{}
+		ordinal interface{}
+	}{
+		{[]byte("happy"), "happy", int32(3)},
+		{[]byte("sad"), "sad", int32(1)},
+		{nil, nil, nil},
+	}
+	for _, ordinalField := range []bool{false, true} {
+		config := testConfig(t)
+		config.Types.EnumOrdinalField = ordinalField
+		for _, tt := range tests {
+			value, companions := convertColumn(t, column("mood", moodOID), tt.raw, types, config)
+			if value != tt.want {
+				t.Errorf("mood %q: got %#v, want %#v", tt.raw, value, tt.want)
+			}
+			if !ordinalField {
+				if len(companions) != 0 {
+					t.Errorf("mood %q: got companions %v without enum_ordinal_field", tt.raw, companions)
+				}
+				continue
+			}
+			if len(companions) != 1 || companions[0].Key != "mood_ordinal" || companions[0].Value != tt.ordinal {
+				t.Errorf("mood %q: got companions %v, want mood_ordinal %v", tt.raw, companions, tt.ordinal)
+			}
+		}
+	}
+
+	value, _ := convertColumn(t, column("moods", moodArrayOID), []byte(`{happy,NULL,sad}`), types, testConfig(t))
+	want := bson.A{"happy", nil, "sad"}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("mood[]: got %#v, want %#v", value, want)
+	}
+}
+
+// decimal parses a Decimal128 for the expectations of a test
+func decimal(t *testing.T, s string) primitive.Decimal128 {
+	t.Helper()
+	d, err := primitive.ParseDecimal128(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestConvertColumns(t *testing.T) {
+	date := func(s string) primitive.DateTime {
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return primitive.NewDateTimeFromTime(parsed)
+	}
+	tests := []struct {
+		name string
+		oid  uint32
+		raw  string
+		want interface{}
+	}{
+		{"int2", pgtype.Int2OID, "7", int16(7)},
+		{"int4", pgtype.Int4OID, "-42", int32(-42)},
+		{"int8 past float64 precision", pgtype.Int8OID, "9007199254740993", int64(9007199254740993)},
+		{"float8", pgtype.Float8OID, "1.5", float64(1.5)},
+		{"bool", pgtype.BoolOID, "t", true},
+		{"numeric keeps its scale", pgtype.NumericOID, "12.340", decimal(t, "12.340")},
+		{"numeric NaN", pgtype.NumericOID, "NaN", decimal(t, "NaN")},
+		{"text", pgtype.TextOID, "héllo", "héllo"},
+		{"varchar", pgtype.VarcharOID, "", ""},
+		{"date", pgtype.DateOID, "2024-03-01", date("2024-03-01T00:00:00Z")},
+		{"timestamp in UTC", pgtype.TimestampOID, "2024-03-01 12:30:00.123", date("2024-03-01T12:30:00.123Z")},
+		{"timestamptz", pgtype.TimestamptzOID, "2024-03-01 12:30:00+02", date("2024-03-01T10:30:00Z")},
+		{"timestamp infinity", pgtype.TimestampOID, "infinity", "infinity"},
+		{"jsonb keeps key order", pgtype.JSONBOID, `{"b": "x", "a": [true, null]}`, bson.D{{Key: "b", Value: "x"}, {Key: "a", Value: bson.A{true, nil}}}},
+		{"bytea", pgtype.ByteaOID, `\x0102ff`, primitive.Binary{Subtype: bson.TypeBinaryGeneric, Data: []byte{1, 2, 0xff}}},
+		{"int4[] nested", pgtype.Int4ArrayOID, "{{1,2},{3,NULL}}", bson.A{bson.A{int32(1), int32(2)}, bson.A{int32(3), nil}}},
+		{"text[]", pgtype.TextArrayOID, `{a,"b c",NULL}`, bson.A{"a", "b c", nil}},
+	}
+	config := testConfig(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := convertColumn(t, column("c", tt.oid), []byte(tt.raw), pgTypes{}, config)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s %q: got %#v (%T), want %#v (%T)", tt.name, tt.raw, got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestCitextColumns(t *testing.T) {
+	const citextOID, citextArrayOID = 90201, 90202
+	types := pgTypes{citexts: map[uint32]bool{citextOID: true}, citextArrays: map[uint32]bool{citextArrayOID: true}}
+	field := column("email", citextOID)
+	tests := []struct {
+		raw   []byte
+		value interface{}
+		lower interface{}
+	}{
+		{[]byte("Ann@Example.com"), "Ann@Example.com", "ann@example.com"},
+		{[]byte("ÄRGER"), "ÄRGER", "ärger"},
+		{[]byte(""), "", ""},
+		{nil, nil, nil},
+	}
+	for _, test := range tests {
+		config := testConfig(t)
+		value, companions := convertColumn(t, field, test.raw, types, config)
+		if value != test.value || len(companions) != 0 {
+			t.Errorf("%q: got %#v with %v, want %#v alone", test.raw, value, companions, test.value)
+		}
+
+		config.Types.CitextLowerField = true
+		value, companions = convertColumn(t, field, test.raw, types, config)
+		want := []bson.E{{Key: "email_lower", Value: test.lower}}
+		if value != test.value || !reflect.DeepEqual(companions, want) {
+			t.Errorf("lower field %q: got %#v with %v, want %#v with %v", test.raw, value, companions, test.value, want)
+		}
+	}
+
+	// The companion is named in the configured style
+	config := testConfig(t)
+	config.Types.CitextLowerField = true
+	config.MongoDB.FieldNaming = "camel"
+	if _, companions := convertColumn(t, field, []byte("A"), types, config); len(companions) != 1 || companions[0].Key != "emailLower" {
+		t.Errorf("camel: got companions %v, want emailLower", companions)
+	}
+
+	array, _ := convertColumn(t, column("aliases", citextArrayOID), []byte(`{Foo,"Bar Baz",NULL}`), types, testConfig(t))
+	if want := (bson.A{"Foo", "Bar Baz", nil}); !reflect.DeepEqual(array, want) {
+		t.Errorf("citext[]: got %#v, want %#v", array, want)
+	}
+}
@@ -0,0 +1,152 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+)
+
+// Values of postgres.read_mode
+const (
+	readModeQuery  = "query"
+	readModeCursor = "cursor"
+)
+
+// defaultFetchSize is the number of rows fetched from a cursor at a time when postgres.fetch_size is unset
+const defaultFetchSize = 10000
+
+// queryRows runs a read query as configured by postgres.read_mode. In cursor mode the rows come
+// from a server-side cursor fetched postgres.fetch_size rows at a time; a query PostgreSQL cannot
+// declare a cursor for is run as a plain query instead, with a warning.
+func queryRows(ctx context.Context, pgConn RowSource, table string, query string, args []interface{}, config Config) (pgx.Rows, error) {
+	if config.Postgres.ReadMode != readModeCursor {
+		return pgConn.Query(ctx, query, args...)
+	}
+
+	tx, err := pgConn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("error starting a transaction for the cursor: %v", err)
+	}
+	if _, err := tx.Exec(ctx, "DECLARE pg_mongo_cursor NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		tx.Rollback(context.Background())
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		logger.Warn("Table %s can not be read with a cursor (%v), using a plain query", table, err)
+		return pgConn.Query(ctx, query, args...)
+	}
+
+	r := &cursorRows{
+		ctx:       ctx,
+		tx:        tx,
+		fetch:     fmt.Sprintf("FETCH FORWARD %d FROM pg_mongo_cursor", config.Postgres.FetchSize),
+		fetchSize: config.Postgres.FetchSize,
+	}
+	if r.rows, err = tx.Query(ctx, r.fetch); err != nil {
+		tx.Rollback(context.Background())
+		return nil, err
+	}
+	return r, nil
+}
+
+// readRows runs a read query with queryRows and moves to its first row, reporting whether there is
+// one. A query PostgreSQL cancels after postgres.statement_timeout before its first row is run again
+// as configured by migration.max_retries; once rows are read a timeout fails the table, since
+// reading them again would repeat the documents already buffered.
+func readRows(ctx context.Context, pgConn RowSource, table string, query string, args []interface{}, config Config) (pgx.Rows, bool, error) {
+	var rows pgx.Rows
+	hasRows := false
+	err := retryRead(ctx, table, config, func() error {
+		var err error
+		if rows, err = queryRows(ctx, pgConn, table, query, args, config); err != nil {
+			return err
+		}
+		if hasRows = rows.Next(); !hasRows {
+			if err := rows.Err(); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, statementTimeoutError(err, config)
+	}
+	return rows, hasRows, nil
+}
+
+// cursorRows reads the rows of a server-side cursor as one pgx.Rows, issuing the next FETCH
+// once the rows of the previous one are used up
+type cursorRows struct {
+	ctx       context.Context
+	tx        pgx.Tx
+	fetch     string
+	fetchSize int
+	rows      pgx.Rows // rows of the current FETCH
+	fetched   int      // rows read from the current FETCH
+	err       error
+	closed    bool
+}
+
+func (r *cursorRows) Next() bool {
+	if r.closed || r.err != nil {
+		return false
+	}
+	for {
+		if r.rows.Next() {
+			r.fetched++
+			return true
+		}
+		r.rows.Close()
+		if r.err = r.rows.Err(); r.err != nil || r.fetched < r.fetchSize {
+			return false
+		}
+
+		rows, err := r.tx.Query(r.ctx, r.fetch)
+		if err != nil {
+			r.err = err
+			return false
+		}
+		r.rows, r.fetched = rows, 0
+	}
+}
+
+// Close ends the transaction of the cursor, which also closes the cursor
+func (r *cursorRows) Close() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.rows.Close()
+	r.tx.Rollback(context.Background())
+}
+
+func (r *cursorRows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.rows.Err()
+}
+
+func (r *cursorRows) CommandTag() pgconn.CommandTag {
+	return r.rows.CommandTag()
+}
+
+func (r *cursorRows) FieldDescriptions() []pgproto3.FieldDescription {
+	return r.rows.FieldDescriptions()
+}
+
+func (r *cursorRows) Scan(dest ...interface{}) error {
+	return r.rows.Scan(dest...)
+}
+
+func (r *cursorRows) Values() ([]interface{}, error) {
+	return r.rows.Values()
+}
+
+func (r *cursorRows) RawValues() [][]byte {
+	return r.rows.RawValues()
+}
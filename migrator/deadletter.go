@@ -0,0 +1,78 @@
+package migrator
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DeadLetterSink appends rows skipped in continue-on-error mode to a newline-delimited
+// extended JSON file and enforces the run-wide max_errors budget
+type DeadLetterSink struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	count     int
+	maxErrors int
+}
+
+// NewDeadLetterSink creates a sink writing to path. The file is only created once the first
+// row is recorded. A maxErrors of 0 means no limit.
+func NewDeadLetterSink(path string, maxErrors int) *DeadLetterSink {
+	return &DeadLetterSink{path: path, maxErrors: maxErrors}
+}
+
+// record writes a skipped row and returns an error once more than maxErrors rows were skipped
+func (s *DeadLetterSink) record(table string, row int64, key interface{}, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logger.Warn("Skipping row %d (key %v) of table %s: %s", row, key, table, reason)
+
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open dead-letter file: %v", err)
+		}
+		s.file = file
+	}
+
+	entry := bson.D{
+		{Key: "table", Value: table},
+		{Key: "row", Value: row},
+		{Key: "key", Value: key},
+		{Key: "error", Value: reason},
+		{Key: "time", Value: time.Now().UTC()},
+	}
+	line, err := bson.MarshalExtJSON(entry, false, false)
+	if err != nil {
+		// Keys of rows that failed conversion may hold values BSON can not encode
+		entry[2].Value = fmt.Sprint(key)
+		if line, err = bson.MarshalExtJSON(entry, false, false); err != nil {
+			return fmt.Errorf("failed to encode dead-letter entry: %v", err)
+		}
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write dead-letter file: %v", err)
+	}
+
+	s.count++
+	if s.maxErrors > 0 && s.count > s.maxErrors {
+		return fmt.Errorf("more than %d rows failed, stopping the run", s.maxErrors)
+	}
+	return nil
+}
+
+// Close closes the dead-letter file if one was opened
+func (s *DeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,56 @@
+package migrator
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// documentSize approximates the BSON size of a document without encoding it. Strings and
+// binary values count with their length, so the estimate is close for the wide rows where
+// it matters.
+func documentSize(document bson.D) int {
+	size := 5
+	for _, e := range document {
+		size += len(e.Key) + 2 + valueSize(e.Value)
+	}
+	return size
+}
+
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case int32:
+		return 4
+	case string:
+		return len(v) + 5
+	case []byte:
+		return len(v) + 5
+	case primitive.Binary:
+		return len(v.Data) + 5
+	case primitive.Decimal128:
+		return 16
+	case bson.D:
+		return documentSize(v)
+	case bson.A:
+		size := 5
+		for i, element := range v {
+			// Array elements are keyed by their index
+			size += digits(i) + 2 + valueSize(element)
+		}
+		return size
+	default:
+		return 8
+	}
+}
+
+func digits(n int) int {
+	count := 1
+	for n >= 10 {
+		n /= 10
+		count++
+	}
+	return count
+}
@@ -0,0 +1,185 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxDumpDocumentSize bounds the length prefix accepted from a .bson file; MongoDB documents are
+// at most 16MB, mongodump leaves some room for the command overhead
+const maxDumpDocumentSize = 16*1024*1024 + 16*1024
+
+// DumpDir returns the directory holding the .bson files of the database of config under dir:
+// <dir>/<mongodb.database> as written by output.target bson and mongodump, or dir itself when
+// it has no such subdirectory
+func DumpDir(dir string, config Config) string {
+	nested := filepath.Join(dir, config.MongoDB.Database)
+	if info, err := os.Stat(nested); err == nil && info.IsDir() {
+		return nested
+	}
+	return dir
+}
+
+// ImportDump loads every <collection>.bson file of dir into the collection of the same name in
+// mongodb.database, in batches of mongodb.batch_size (and max_batch_bytes) and honouring mongodb.mode,
+// drop_before_import and max_docs_per_second. The first failing file stops the import.
+func ImportDump(ctx context.Context, mongoClient *mongo.Client, dir string, config Config) ([]TransferResult, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.bson"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .bson files found in %s", dir)
+	}
+	sort.Strings(files)
+	if config.Migration.writeLimiter == nil {
+		config.Migration.writeLimiter = newWriteLimiter(config)
+	}
+
+	var results []TransferResult
+	for _, file := range files {
+		collection := strings.TrimSuffix(filepath.Base(file), ".bson")
+		logger.Info("Importing %s into MongoDB collection %s...", file, collection)
+		start := time.Now()
+		result := TransferResult{Table: filepath.Base(file), Collection: collection}
+		err := importFile(ctx, mongoClient.Database(config.MongoDB.Database).Collection(collection), collection, file, config, &result)
+		result.Duration = time.Since(start)
+		results = append(results, result)
+		if err != nil {
+			return results, fmt.Errorf("error importing %s: %v", file, err)
+		}
+		logger.Info("Imported %d document(s) into MongoDB collection %s.", result.DocsInserted, collection)
+	}
+	return results, nil
+}
+
+// importFile writes the documents of one .bson file to collection
+func importFile(ctx context.Context, collection DocSink, name, file string, config Config, result *TransferResult) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+
+	if config.MongoDB.DropBeforeImport {
+		if err := collection.Drop(ctx); err != nil {
+			return fmt.Errorf("error dropping MongoDB collection: %v", err)
+		}
+	}
+
+	insertOptions := options.InsertMany().SetOrdered(config.MongoDB.Ordered)
+	bulkOptions := options.BulkWrite().SetOrdered(config.MongoDB.Ordered)
+	batch := make([]bson.Raw, 0, config.MongoDB.BatchSize)
+	batchBytes := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := waitToWrite(ctx, config.Migration.writeLimiter, len(batch)); err != nil {
+			return err
+		}
+		var err error
+		if config.MongoDB.Mode == modeInsert {
+			documents := make([]interface{}, len(batch))
+			for i, document := range batch {
+				documents[i] = document
+			}
+			err = retryWrite(ctx, name, config, func(retry bool) error {
+				if retry {
+					_, err := collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+					return ignoreDuplicateKeys(err)
+				}
+				_, err := collection.InsertMany(ctx, documents, insertOptions)
+				return err
+			})
+		} else {
+			documents := make([]bson.D, len(batch))
+			first := result.RowsRead - int64(len(batch)) + 1
+			for i, raw := range batch {
+				if err := bson.Unmarshal(raw, &documents[i]); err != nil {
+					return fmt.Errorf("error decoding document %d: %v", first+int64(i), err)
+				}
+				if len(documents[i]) == 0 || documents[i][0].Key != "_id" {
+					return fmt.Errorf("document %d has no leading _id, which mongodb.mode %s needs", first+int64(i), config.MongoDB.Mode)
+				}
+			}
+			err = retryWrite(ctx, name, config, func(retry bool) error {
+				_, err := collection.BulkWrite(ctx, buildWriteModels(documents, config.MongoDB.Mode), bulkOptions)
+				return err
+			})
+		}
+		result.recordWrite(len(batch), config.MongoDB.Ordered, err)
+		batch, batchBytes = batch[:0], 0
+		if err != nil {
+			return fmt.Errorf("error writing to MongoDB: %v", err)
+		}
+		return nil
+	}
+
+	for {
+		document, err := readDumpDocument(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("document %d: %v", result.RowsRead+1, err)
+		}
+		result.RowsRead++
+		if max := config.MongoDB.MaxBatchBytes; max > 0 {
+			if len(document) > max {
+				return fmt.Errorf("document %d is %d bytes, more than mongodb.max_batch_bytes (%d)", result.RowsRead, len(document), max)
+			}
+			if batchBytes+len(document) > max {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		batch = append(batch, document)
+		batchBytes += len(document)
+		if len(batch) >= config.MongoDB.BatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// readDumpDocument reads the next BSON document of a dump file, returning io.EOF at its end
+func readDumpDocument(reader *bufio.Reader) (bson.Raw, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated document length")
+		}
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(length[:])
+	if size < 5 || size > maxDumpDocumentSize {
+		return nil, fmt.Errorf("invalid document length %d", size)
+	}
+	document := make([]byte, size)
+	copy(document, length[:])
+	if _, err := io.ReadFull(reader, document[4:]); err != nil {
+		return nil, fmt.Errorf("truncated document of %d bytes", size)
+	}
+	if err := bson.Raw(document).Validate(); err != nil {
+		return nil, fmt.Errorf("invalid document: %v", err)
+	}
+	return document, nil
+}
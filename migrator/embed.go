@@ -0,0 +1,184 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// embedChunkSize is the maximum number of parent keys looked up by one child query
+const embedChunkSize = 1000
+
+// EmbedConfig nests the rows of a child table into the documents of their parent rows
+type EmbedConfig struct {
+	Table      string `mapstructure:"table"`       // child table
+	ForeignKey string `mapstructure:"foreign_key"` // column of the child table referencing the parent
+	ParentKey  string `mapstructure:"parent_key"`  // referenced column of the parent, defaults to its primary key
+	Field      string `mapstructure:"field"`       // array field of the parent document, defaults to the child table name
+}
+
+// embedding is an EmbedConfig resolved for one transfer, collecting the parent keys of the buffered documents
+type embedding struct {
+	EmbedConfig
+	keyType     string // type of the foreign key column
+	parentIndex int    // position of the parent key in the parent result columns
+	parentField pgproto3.FieldDescription
+	types       pgTypes
+	keys        []string // parent key of each buffered document
+	hasKey      []bool   // false where the parent key is NULL
+}
+
+// newEmbeddings resolves the embed list of a table against its result columns
+func newEmbeddings(ctx context.Context, pgConn RowSource, table TableConfig, fields []pgproto3.FieldDescription, columnNames []string, types pgTypes, config Config) ([]*embedding, error) {
+	var embeddings []*embedding
+	for _, embed := range table.Embed {
+		embed.Table = qualifyTableName(embed.Table, config.Postgres.Schemas[0])
+		if embed.Field == "" {
+			_, name, _ := splitTableName(embed.Table)
+			embed.Field = fieldName(name, config.MongoDB.FieldNaming)
+		}
+		if embed.ParentKey == "" {
+			keyColumns, err := getPrimaryKeyColumns(ctx, pgConn, table.Name)
+			if err != nil {
+				return nil, err
+			}
+			if len(keyColumns) != 1 {
+				return nil, fmt.Errorf("embedding %s into table %s: parent_key is required, the table has no single-column primary key", embed.Table, table.Name)
+			}
+			embed.ParentKey = keyColumns[0]
+		}
+
+		indexes, err := columnIndexes(columnNames, []string{embed.ParentKey})
+		if err != nil {
+			return nil, fmt.Errorf("embedding %s into table %s: %v", embed.Table, table.Name, err)
+		}
+		keyType, err := getColumnType(ctx, pgConn, embed.Table, embed.ForeignKey)
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, &embedding{
+			EmbedConfig: embed,
+			keyType:     keyType,
+			parentIndex: indexes[0],
+			parentField: fields[indexes[0]],
+			types:       types,
+		})
+	}
+	return embeddings, nil
+}
+
+// addKey records the parent key of the row just buffered
+func (e *embedding) addKey(raw [][]byte) error {
+	key := ""
+	if raw[e.parentIndex] != nil {
+		var err error
+		if key, err = encodeColumnText(e.parentField, raw[e.parentIndex]); err != nil {
+			return err
+		}
+	}
+	e.keys = append(e.keys, key)
+	e.hasKey = append(e.hasKey, raw[e.parentIndex] != nil)
+	return nil
+}
+
+// attach fetches the child rows of the buffered documents and adds them to each document as an
+// array, empty for parents without children, before the trailing metadataCount metadata fields.
+// The children are read in chunks of embedChunkSize parents.
+func (e *embedding) attach(ctx context.Context, pgConn RowSource, documents []bson.D, metadataCount int, config Config) error {
+	children := make(map[string]bson.A)
+	for start := 0; start < len(e.keys); start += embedChunkSize {
+		end := start + embedChunkSize
+		if end > len(e.keys) {
+			end = len(e.keys)
+		}
+		if err := e.fetchChildren(ctx, pgConn, e.keys[start:end], e.hasKey[start:end], children, config); err != nil {
+			return err
+		}
+	}
+
+	for i := range documents {
+		array := bson.A{}
+		if e.hasKey[i] && children[e.keys[i]] != nil {
+			array = children[e.keys[i]]
+		}
+		documents[i] = insertField(documents[i], len(documents[i])-metadataCount, bson.E{Key: e.Field, Value: array})
+	}
+	e.keys, e.hasKey = e.keys[:0], e.hasKey[:0]
+	return nil
+}
+
+// fetchChildren reads the child rows referencing any of the given parent keys into children, grouped by key
+func (e *embedding) fetchChildren(ctx context.Context, pgConn RowSource, keys []string, hasKey []bool, children map[string]bson.A, config Config) error {
+	var lookup []string
+	for i, key := range keys {
+		if hasKey[i] {
+			lookup = append(lookup, key)
+		}
+	}
+	if len(lookup) == 0 {
+		return nil
+	}
+
+	// Casting the keys to the column type keeps an index on the foreign key usable
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s = ANY($1::text[]::%s[])",
+		quoteTableName(e.Table), quoteIdentifier(e.ForeignKey), e.keyType)
+	rows, err := pgConn.Query(ctx, query, lookup)
+	if err != nil {
+		return fmt.Errorf("error querying child table %s: %v", e.Table, err)
+	}
+	defer rows.Close()
+
+	fields := rows.FieldDescriptions()
+	columnNames := make([]string, len(fields))
+	for i, field := range fields {
+		columnNames[i] = string(field.Name)
+	}
+	indexes, err := columnIndexes(columnNames, []string{e.ForeignKey})
+	if err != nil {
+		return fmt.Errorf("error reading child table %s: %v", e.Table, err)
+	}
+	names := fieldNames(e.Table, columnNames, config.MongoDB.FieldNaming)
+	converters := buildConverters(e.Table, fields, e.types, config)
+	nulls := newDocumentNulls(fields, e.types, config)
+
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return fmt.Errorf("error reading row of child table %s: %v", e.Table, err)
+		}
+		raw := rows.RawValues()
+		key, err := encodeColumnText(fields[indexes[0]], raw[indexes[0]])
+		if err != nil {
+			return err
+		}
+		row, err := convertRow(converters, values, raw)
+		if err != nil {
+			return fmt.Errorf("error converting row of child table %s: %v", e.Table, err)
+		}
+		children[key] = append(children[key], buildDocument(names, row, nil, nil, nulls))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows of child table %s: %v", e.Table, err)
+	}
+	return nil
+}
+
+// embedNames lists the child tables embedded into a table, for log messages
+func embedNames(embeddings []*embedding) string {
+	names := make([]string, len(embeddings))
+	for i, e := range embeddings {
+		names[i] = e.Table + " as " + e.Field
+	}
+	return strings.Join(names, ", ")
+}
+
+// insertField returns document with field inserted at position at
+func insertField(document bson.D, at int, field bson.E) bson.D {
+	document = append(document, bson.E{})
+	copy(document[at+1:], document[at:])
+	document[at] = field
+	return document
+}
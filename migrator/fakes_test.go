@@ -0,0 +1,300 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeResult is the answer of a fakeSource to the queries containing match
+type fakeResult struct {
+	match  string
+	fields []pgproto3.FieldDescription
+	rows   [][][]byte
+	err    error
+
+	// answer, when set, computes the rows from the query arguments instead
+	answer func(args []interface{}) [][][]byte
+}
+
+// fakeSource is a RowSource answering queries from canned results in text format. The first
+// result whose match is part of the SQL answers it, and a query no result matches gets no rows,
+// like the catalog lookups of types and extensions a plain table does not need.
+type fakeSource struct {
+	mu      sync.Mutex
+	results []fakeResult
+	queries []string
+}
+
+// textRow turns strings into the raw text values of a row, nil into NULL
+func textRow(values ...interface{}) [][]byte {
+	row := make([][]byte, len(values))
+	for i, value := range values {
+		if value != nil {
+			row[i] = []byte(value.(string))
+		}
+	}
+	return row
+}
+
+// columns describes result columns in text format, given as name and type OID pairs
+func columns(pairs ...interface{}) []pgproto3.FieldDescription {
+	fields := make([]pgproto3.FieldDescription, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		var oid uint32
+		switch v := pairs[i+1].(type) {
+		case int:
+			oid = uint32(v)
+		case uint32:
+			oid = v
+		}
+		fields = append(fields, column(pairs[i].(string), oid))
+	}
+	return fields
+}
+
+func (s *fakeSource) find(sql string, args []interface{}) (*fakeRows, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries = append(s.queries, sql)
+	for _, result := range s.results {
+		if !strings.Contains(sql, result.match) {
+			continue
+		}
+		if result.err != nil {
+			return nil, result.err
+		}
+		rows := result.rows
+		if result.answer != nil {
+			rows = result.answer(args)
+		}
+		return &fakeRows{fields: result.fields, rows: rows, index: -1}, nil
+	}
+	return &fakeRows{index: -1}, nil
+}
+
+// queried returns the queries containing match, in the order they were run
+func (s *fakeSource) queried(match string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []string
+	for _, query := range s.queries {
+		if strings.Contains(query, match) {
+			found = append(found, query)
+		}
+	}
+	return found
+}
+
+func (s *fakeSource) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return s.find(sql, args)
+}
+
+func (s *fakeSource) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	rows, err := s.find(sql, args)
+	return fakeRow{rows: rows, err: err}
+}
+
+func (s *fakeSource) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	return nil, errors.New("fake source: transactions are not supported")
+}
+
+// fakeRows are the rows of a fakeResult, decoded the way pgx decodes text format values
+type fakeRows struct {
+	fields []pgproto3.FieldDescription
+	rows   [][][]byte
+	index  int
+	err    error
+}
+
+func (r *fakeRows) Close()                                         {}
+func (r *fakeRows) Err() error                                     { return r.err }
+func (r *fakeRows) CommandTag() pgconn.CommandTag                  { return nil }
+func (r *fakeRows) FieldDescriptions() []pgproto3.FieldDescription { return r.fields }
+
+func (r *fakeRows) Next() bool {
+	if r.index+1 >= len(r.rows) {
+		r.index = len(r.rows)
+		return false
+	}
+	r.index++
+	return true
+}
+
+func (r *fakeRows) RawValues() [][]byte {
+	return r.rows[r.index]
+}
+
+func (r *fakeRows) Values() ([]interface{}, error) {
+	connInfo := pgtype.NewConnInfo()
+	values := make([]interface{}, len(r.fields))
+	for i, raw := range r.rows[r.index] {
+		if raw == nil {
+			continue
+		}
+		value, err := decodeText(connInfo, r.fields[i].DataTypeOID, raw)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	connInfo := pgtype.NewConnInfo()
+	raw := r.rows[r.index]
+	if len(dest) != len(raw) {
+		return fmt.Errorf("fake rows: %d columns scanned into %d values", len(raw), len(dest))
+	}
+	for i := range dest {
+		if err := connInfo.Scan(r.fields[i].DataTypeOID, pgtype.TextFormatCode, raw[i], dest[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fakeRow is the single row of QueryRow
+type fakeRow struct {
+	rows *fakeRows
+	err  error
+}
+
+func (r fakeRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	if !r.rows.Next() {
+		return pgx.ErrNoRows
+	}
+	return r.rows.Scan(dest...)
+}
+
+// fakeSink is a DocSink keeping the documents in memory. Like a collection it rejects a document
+// whose _id it already holds with a duplicate key error, and an ordered insert stops there.
+type fakeSink struct {
+	mu        sync.Mutex
+	documents []bson.D
+	batches   []int // number of documents of every InsertMany and BulkWrite
+	drops     int
+
+	// failures is how many more InsertMany and BulkWrite calls fail with a primary stepdown once
+	// they wrote their first failAfter documents. An insert reports it as the write error of the
+	// next document, after which an unordered insert goes on.
+	failures, failAfter int
+}
+
+// errSteppedDown is the retryable error of a write failing on a primary that stepped down
+var errSteppedDown = mongo.CommandError{Code: 189, Name: "PrimarySteppedDown", Message: "fake sink: primary stepped down"}
+
+// stepDown reports whether the write is to fail before its document i
+func (s *fakeSink) stepDown(i int) bool {
+	if s.failures > 0 && i == s.failAfter {
+		s.failures--
+		return true
+	}
+	return false
+}
+
+func (s *fakeSink) idIndex(document bson.D) int {
+	if len(document) == 0 || document[0].Key != "_id" {
+		return -1
+	}
+	id := fmt.Sprint(document[0].Value)
+	for i, existing := range s.documents {
+		if len(existing) > 0 && existing[0].Key == "_id" && fmt.Sprint(existing[0].Value) == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *fakeSink) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.documents = append(s.documents, document.(bson.D))
+	return &mongo.InsertOneResult{}, nil
+}
+
+func (s *fakeSink) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, len(documents))
+	ordered := true
+	if o := options.MergeInsertManyOptions(opts...); o.Ordered != nil {
+		ordered = *o.Ordered
+	}
+	var writeErrors []mongo.BulkWriteError
+	for i, document := range documents {
+		if s.stepDown(i) {
+			writeErrors = append(writeErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{
+				Index: i, Code: int(errSteppedDown.Code), Message: errSteppedDown.Message,
+			}})
+			if ordered {
+				break
+			}
+			continue
+		}
+		document := document.(bson.D)
+		if s.idIndex(document) >= 0 {
+			writeErrors = append(writeErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{
+				Index: i, Code: duplicateKeyCode, Message: fmt.Sprintf("E11000 duplicate key error dup key: { _id: %v }", document[0].Value),
+			}})
+			if ordered {
+				break
+			}
+			continue
+		}
+		s.documents = append(s.documents, document)
+	}
+	if len(writeErrors) > 0 {
+		return &mongo.InsertManyResult{}, mongo.BulkWriteException{WriteErrors: writeErrors}
+	}
+	return &mongo.InsertManyResult{}, nil
+}
+
+func (s *fakeSink) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, len(models))
+	for i, model := range models {
+		if s.stepDown(i) {
+			return nil, errSteppedDown
+		}
+		replace, ok := model.(*mongo.ReplaceOneModel)
+		if !ok {
+			return nil, fmt.Errorf("fake sink: unsupported write model %T", model)
+		}
+		document := replace.Replacement.(bson.D)
+		if i := s.idIndex(document); i >= 0 {
+			s.documents[i] = document
+		} else {
+			s.documents = append(s.documents, document)
+		}
+	}
+	return &mongo.BulkWriteResult{}, nil
+}
+
+func (s *fakeSink) Drop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.documents = nil
+	s.drops++
+	return nil
+}
+
+var (
+	_ RowSource = (*fakeSource)(nil)
+	_ DocSink   = (*fakeSink)(nil)
+)
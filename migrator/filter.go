@@ -0,0 +1,95 @@
+package migrator
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// tablePattern matches table names for postgres.include_tables and postgres.exclude_tables
+type tablePattern struct {
+	glob      string         // path.Match pattern, when regex is nil
+	regex     *regexp.Regexp // set for patterns written as /regex/
+	qualified bool           // whether the pattern is matched against schema.table instead of the bare name
+}
+
+// compileTablePattern parses a pattern: /.../ is a regular expression, anything else a glob with
+// * and ?. A pattern containing a dot is matched against the schema-qualified name, others
+// against the table name alone.
+func compileTablePattern(pattern string) (tablePattern, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		expr := pattern[1 : len(pattern)-1]
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			return tablePattern{}, fmt.Errorf("invalid table pattern %s: %v", pattern, err)
+		}
+		return tablePattern{regex: regex, qualified: strings.Contains(expr, `\.`)}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return tablePattern{}, fmt.Errorf("invalid table pattern %s: %v", pattern, err)
+	}
+	return tablePattern{glob: pattern, qualified: strings.Contains(pattern, ".")}, nil
+}
+
+// matches reports whether the schema-qualified table name matches the pattern. Quotes are taken off
+// the name first, so Sales.* matches "Sales".Orders.
+func (p tablePattern) matches(qualifiedName string) bool {
+	schema, name, _ := splitTableName(qualifiedName)
+	if p.qualified {
+		name = schema + "." + name
+	}
+	if p.regex != nil {
+		return p.regex.MatchString(name)
+	}
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+// compileTablePatterns parses every pattern of a list
+func compileTablePatterns(patterns []string) ([]tablePattern, error) {
+	compiled := make([]tablePattern, len(patterns))
+	for i, pattern := range patterns {
+		p, err := compileTablePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = p
+	}
+	return compiled, nil
+}
+
+// FilterTables returns the schema-qualified names that match one of the include patterns (all of
+// them when there are none) and none of the exclude patterns. A table matching both is excluded.
+func FilterTables(names, include, exclude []string) ([]string, error) {
+	includes, err := compileTablePatterns(include)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := compileTablePatterns(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []string
+	for _, name := range names {
+		if len(includes) > 0 && !matchesAny(includes, name) {
+			continue
+		}
+		if matchesAny(excludes, name) {
+			continue
+		}
+		filtered = append(filtered, name)
+	}
+	return filtered, nil
+}
+
+// matchesAny reports whether name matches one of the patterns
+func matchesAny(patterns []tablePattern, name string) bool {
+	for _, p := range patterns {
+		if p.matches(name) {
+			return true
+		}
+	}
+	return false
+}
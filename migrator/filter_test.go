@@ -0,0 +1,69 @@
+package migrator
+
+import (
+	"reflect"
+	"testing"
+)
+
+var filterNames = []string{
+	"public.orders",
+	"public.order_items",
+	"public.customers",
+	"public.tmp_import",
+	"audit.orders",
+	"audit.log_2024",
+	`"Sales".Orders`,
+}
+
+func TestFilterTables(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{"no patterns", nil, nil, filterNames},
+		{"exclude bare name", nil, []string{"customers"}, []string{
+			"public.orders", "public.order_items", "public.tmp_import", "audit.orders", "audit.log_2024", `"Sales".Orders`,
+		}},
+		{"exclude bare name in every schema", nil, []string{"orders"}, []string{
+			"public.order_items", "public.customers", "public.tmp_import", "audit.log_2024", `"Sales".Orders`,
+		}},
+		{"exclude glob", nil, []string{"tmp_*", "log_????"}, []string{
+			"public.orders", "public.order_items", "public.customers", "audit.orders", `"Sales".Orders`,
+		}},
+		{"include qualified glob", []string{"audit.*"}, nil, []string{"audit.orders", "audit.log_2024"}},
+		{"include regex", []string{"/^order/"}, nil, []string{"public.orders", "public.order_items", "audit.orders"}},
+		{"include qualified regex", []string{`/^public\.order/`}, nil, []string{"public.orders", "public.order_items"}},
+		{"include several", []string{"customers", "audit.log_*"}, nil, []string{"public.customers", "audit.log_2024"}},
+		{"exclude wins over include", []string{"order*"}, []string{"public.orders"}, []string{"public.order_items", "audit.orders"}},
+		{"exclude regex wins over include glob", []string{"*"}, []string{"/_[0-9]+$/", "/^tmp_/"}, []string{
+			"public.orders", "public.order_items", "public.customers", "audit.orders", `"Sales".Orders`,
+		}},
+		{"case sensitive", []string{"ORDERS", "Orders"}, nil, []string{`"Sales".Orders`}},
+		{"quoted schema", []string{"Sales.*"}, nil, []string{`"Sales".Orders`}},
+		{"nothing included", []string{"invoices"}, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FilterTables(filterNames, test.include, test.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("include %q exclude %q: got %q, want %q", test.include, test.exclude, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterTablesInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"[orders", "/(orders/"} {
+		if _, err := FilterTables(filterNames, []string{pattern}, nil); err == nil {
+			t.Errorf("include %q: got no error", pattern)
+		}
+		if _, err := FilterTables(filterNames, nil, []string{pattern}); err == nil {
+			t.Errorf("exclude %q: got no error", pattern)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package migrator
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// wgs84SRID is the spatial reference GeoJSON and MongoDB 2dsphere indexes expect
+const wgs84SRID = 4326
+
+// WKB geometry type codes, without the Z/M/SRID flags
+const (
+	wkbPoint              = 1
+	wkbLineString         = 2
+	wkbPolygon            = 3
+	wkbMultiPoint         = 4
+	wkbMultiLineString    = 5
+	wkbMultiPolygon       = 6
+	wkbGeometryCollection = 7
+	wkbCircularString     = 8
+	wkbCompoundCurve      = 9
+	wkbCurvePolygon       = 10
+	wkbMultiCurve         = 11
+	wkbMultiSurface       = 12
+	wkbPolyhedralSurface  = 15
+	wkbTIN                = 16
+	wkbTriangle           = 17
+)
+
+// wkbTypeNames holds the WKT keyword of every geometry type the parser understands
+var wkbTypeNames = map[uint32]string{
+	wkbPoint:              "POINT",
+	wkbLineString:         "LINESTRING",
+	wkbPolygon:            "POLYGON",
+	wkbMultiPoint:         "MULTIPOINT",
+	wkbMultiLineString:    "MULTILINESTRING",
+	wkbMultiPolygon:       "MULTIPOLYGON",
+	wkbGeometryCollection: "GEOMETRYCOLLECTION",
+	wkbCircularString:     "CIRCULARSTRING",
+	wkbCompoundCurve:      "COMPOUNDCURVE",
+	wkbCurvePolygon:       "CURVEPOLYGON",
+	wkbMultiCurve:         "MULTICURVE",
+	wkbMultiSurface:       "MULTISURFACE",
+	wkbPolyhedralSurface:  "POLYHEDRALSURFACE",
+	wkbTIN:                "TIN",
+	wkbTriangle:           "TRIANGLE",
+}
+
+// geoJSONTypeNames holds the GeoJSON type of the geometry types GeoJSON can represent
+var geoJSONTypeNames = map[uint32]string{
+	wkbPoint:              "Point",
+	wkbLineString:         "LineString",
+	wkbPolygon:            "Polygon",
+	wkbMultiPoint:         "MultiPoint",
+	wkbMultiLineString:    "MultiLineString",
+	wkbMultiPolygon:       "MultiPolygon",
+	wkbGeometryCollection: "GeometryCollection",
+}
+
+// geometry is a parsed (E)WKB geometry. Only the X and Y of each position are kept.
+type geometry struct {
+	kind   uint32
+	srid   uint32         // 0 when the value carries no SRID
+	points [][2]float64   // Point, LineString and CircularString
+	rings  [][][2]float64 // Polygon and Triangle
+	parts  []geometry     // multi geometries and collections
+}
+
+// geometryConverter stores PostGIS geometry and geography values as GeoJSON objects. Values
+// without an SRID are taken to be in srid. Geometry types GeoJSON has no equivalent for,
+// empty geometries and values in a spatial reference other than WGS 84 are stored as
+// (E)WKT strings with a warning.
+func geometryConverter(table, column string, srid uint32) convertFunc {
+	warned := false
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		// PostGIS sends geometries as hex-encoded EWKB in text format
+		data, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return nil, fmt.Errorf("column %s: error decoding geometry: %v", column, err)
+		}
+		g, err := parseWKB(data)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: error parsing geometry: %v", column, err)
+		}
+		if g.srid == 0 {
+			g.srid = srid
+		}
+
+		reason := g.geoJSONProblem()
+		if g.srid != wgs84SRID {
+			reason = "uses SRID " + strconv.FormatUint(uint64(g.srid), 10)
+		}
+		if reason != "" {
+			if !warned {
+				logger.Warn("Table %s column %s has a geometry that %s, storing it as WKT", table, column, reason)
+				warned = true
+			}
+			return g.ewkt(), nil
+		}
+		return g.geoJSON(), nil
+	}
+}
+
+// parseWKB parses an ISO WKB or PostGIS EWKB geometry
+func parseWKB(data []byte) (geometry, error) {
+	r := &wkbReader{data: data}
+	g := r.geometry(true)
+	if r.err == nil && r.pos != len(r.data) {
+		r.err = fmt.Errorf("unexpected data after geometry")
+	}
+	return g, r.err
+}
+
+// wkbReader reads a WKB geometry, remembering the first error
+type wkbReader struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+	dims  int
+	err   error
+}
+
+// read returns the next n bytes, or nil once the data is exhausted
+func (r *wkbReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data)-r.pos < n {
+		r.err = fmt.Errorf("geometry is truncated")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// uint32 reads a 4-byte integer in the byte order of the current geometry
+func (r *wkbReader) uint32() uint32 {
+	b := r.read(4)
+	if b == nil {
+		return 0
+	}
+	return r.order.Uint32(b)
+}
+
+// count reads the number of elements that follow, checking that at least size bytes each are left
+func (r *wkbReader) count(size int) int {
+	n := int(r.uint32())
+	if r.err == nil && n > (len(r.data)-r.pos)/size {
+		r.err = fmt.Errorf("geometry is truncated")
+		return 0
+	}
+	return n
+}
+
+// point reads a position, dropping any Z and M values
+func (r *wkbReader) point() [2]float64 {
+	b := r.read(8 * r.dims)
+	if b == nil {
+		return [2]float64{}
+	}
+	return [2]float64{math.Float64frombits(r.order.Uint64(b)), math.Float64frombits(r.order.Uint64(b[8:]))}
+}
+
+// points reads a counted list of positions
+func (r *wkbReader) points() [][2]float64 {
+	n := r.count(8 * r.dims)
+	points := make([][2]float64, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		points = append(points, r.point())
+	}
+	return points
+}
+
+// geometry reads a geometry with its header. Only the outermost geometry of EWKB carries an SRID.
+func (r *wkbReader) geometry(outer bool) geometry {
+	var g geometry
+	header := r.read(1)
+	if header == nil {
+		return g
+	}
+	switch header[0] {
+	case 0:
+		r.order = binary.BigEndian
+	case 1:
+		r.order = binary.LittleEndian
+	default:
+		r.err = fmt.Errorf("invalid byte order %d", header[0])
+		return g
+	}
+
+	code := r.uint32()
+	r.dims = 2
+	// EWKB flags the Z and M dimensions and an SRID in the high bits
+	if code&0x80000000 != 0 {
+		r.dims++
+	}
+	if code&0x40000000 != 0 {
+		r.dims++
+	}
+	if code&0x20000000 != 0 {
+		srid := r.uint32()
+		if outer {
+			g.srid = srid
+		}
+	}
+	// ISO WKB adds 1000 for Z, 2000 for M and 3000 for both to the type code
+	code &= 0x0fffffff
+	switch code / 1000 {
+	case 1, 2:
+		r.dims++
+	case 3:
+		r.dims += 2
+	}
+	g.kind = code % 1000
+
+	switch g.kind {
+	case wkbPoint:
+		p := r.point()
+		// An empty point is encoded with NaN coordinates
+		if !math.IsNaN(p[0]) || !math.IsNaN(p[1]) {
+			g.points = [][2]float64{p}
+		}
+	case wkbLineString, wkbCircularString:
+		g.points = r.points()
+	case wkbPolygon, wkbTriangle:
+		n := r.count(4)
+		for i := 0; i < n && r.err == nil; i++ {
+			g.rings = append(g.rings, r.points())
+		}
+	case wkbMultiPoint, wkbMultiLineString, wkbMultiPolygon, wkbGeometryCollection,
+		wkbCompoundCurve, wkbCurvePolygon, wkbMultiCurve, wkbMultiSurface, wkbPolyhedralSurface, wkbTIN:
+		n := r.count(5)
+		for i := 0; i < n && r.err == nil; i++ {
+			g.parts = append(g.parts, r.geometry(false))
+		}
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unsupported geometry type %d", g.kind)
+		}
+	}
+	return g
+}
+
+// empty reports whether the geometry has no positions at all
+func (g geometry) empty() bool {
+	if len(g.points) > 0 {
+		return false
+	}
+	for _, ring := range g.rings {
+		if len(ring) > 0 {
+			return false
+		}
+	}
+	for _, part := range g.parts {
+		if !part.empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// geoJSONProblem explains why the geometry has no GeoJSON equivalent, or returns "" if it has one
+func (g geometry) geoJSONProblem() string {
+	if g.empty() {
+		return "is empty"
+	}
+	if _, ok := geoJSONTypeNames[g.kind]; !ok {
+		return "is a " + wkbTypeNames[g.kind] + ", which GeoJSON has no type for"
+	}
+	for _, part := range g.parts {
+		if problem := part.geoJSONProblem(); problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+// geoJSON returns the geometry as a GeoJSON object
+func (g geometry) geoJSON() bson.D {
+	document := bson.D{{Key: "type", Value: geoJSONTypeNames[g.kind]}}
+	if g.kind == wkbGeometryCollection {
+		geometries := make(bson.A, len(g.parts))
+		for i, part := range g.parts {
+			geometries[i] = part.geoJSON()
+		}
+		return append(document, bson.E{Key: "geometries", Value: geometries})
+	}
+	return append(document, bson.E{Key: "coordinates", Value: g.coordinates()})
+}
+
+// coordinates returns the GeoJSON coordinates member of the geometry
+func (g geometry) coordinates() interface{} {
+	switch g.kind {
+	case wkbPoint:
+		return position(g.points[0])
+	case wkbLineString:
+		return positions(g.points)
+	case wkbPolygon:
+		rings := make(bson.A, len(g.rings))
+		for i, ring := range g.rings {
+			rings[i] = positions(ring)
+		}
+		return rings
+	default:
+		parts := make(bson.A, len(g.parts))
+		for i, part := range g.parts {
+			parts[i] = part.coordinates()
+		}
+		return parts
+	}
+}
+
+// position returns a GeoJSON position, longitude first
+func position(p [2]float64) bson.A {
+	return bson.A{p[0], p[1]}
+}
+
+// positions returns a list of GeoJSON positions
+func positions(points [][2]float64) bson.A {
+	list := make(bson.A, len(points))
+	for i, p := range points {
+		list[i] = position(p)
+	}
+	return list
+}
+
+// ewkt returns the geometry as WKT, prefixed with SRID=<srid>; when it has one
+func (g geometry) ewkt() string {
+	var b strings.Builder
+	if g.srid != 0 {
+		fmt.Fprintf(&b, "SRID=%d;", g.srid)
+	}
+	g.writeWKT(&b, true)
+	return b.String()
+}
+
+// writeWKT writes the geometry as WKT, with or without its type keyword
+func (g geometry) writeWKT(b *strings.Builder, tagged bool) {
+	if tagged {
+		b.WriteString(wkbTypeNames[g.kind])
+	}
+	if g.empty() {
+		if tagged {
+			b.WriteByte(' ')
+		}
+		b.WriteString("EMPTY")
+		return
+	}
+
+	switch g.kind {
+	case wkbPoint, wkbLineString, wkbCircularString:
+		b.WriteByte('(')
+		writeWKTPoints(b, g.points)
+		b.WriteByte(')')
+	case wkbPolygon, wkbTriangle:
+		b.WriteByte('(')
+		for i, ring := range g.rings {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteByte('(')
+			writeWKTPoints(b, ring)
+			b.WriteByte(')')
+		}
+		b.WriteByte(')')
+	default:
+		b.WriteByte('(')
+		for i, part := range g.parts {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			part.writeWKT(b, !g.bareMember(part.kind))
+		}
+		b.WriteByte(')')
+	}
+}
+
+// bareMember reports whether WKT writes members of the given type in this collection without
+// their type keyword
+func (g geometry) bareMember(kind uint32) bool {
+	switch g.kind {
+	case wkbMultiPoint, wkbMultiLineString, wkbMultiPolygon, wkbPolyhedralSurface, wkbTIN:
+		return true
+	case wkbCompoundCurve, wkbCurvePolygon, wkbMultiCurve:
+		return kind == wkbLineString
+	case wkbMultiSurface:
+		return kind == wkbPolygon
+	}
+	return false
+}
+
+// writeWKTPoints writes a comma separated list of "x y" positions
+func writeWKTPoints(b *strings.Builder, points [][2]float64) {
+	for i, p := range points {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(p[0], 'f', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(p[1], 'f', -1, 64))
+	}
+}
+
+// createGeometryIndexes adds a 2dsphere index on the field of every geometry and geography column.
+// A failure, typically caused by geometries MongoDB considers invalid, is logged as a warning.
+func createGeometryIndexes(ctx context.Context, collection *mongo.Collection, fields []pgproto3.FieldDescription, names []string, types pgTypes, config Config) {
+	for i, field := range fields {
+		if !types.geometries[field.DataTypeOID] {
+			continue
+		}
+		if config.Migration.DryRun {
+			logger.Info("Dry run: would create a 2dsphere index on %s of MongoDB collection %s.", names[i], collection.Name())
+			continue
+		}
+		model := mongo.IndexModel{Keys: bson.D{{Key: names[i], Value: "2dsphere"}}}
+		if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+			logger.Warn("Could not create a 2dsphere index on %s of MongoDB collection %s: %v", names[i], collection.Name(), err)
+			continue
+		}
+		logger.Info("Created a 2dsphere index on %s of MongoDB collection %s.", names[i], collection.Name())
+	}
+}
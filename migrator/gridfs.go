@@ -0,0 +1,311 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// gridFSReadChunk is how many bytes of a large value are read from PostgreSQL per query
+const gridFSReadChunk = 4 << 20
+
+// gridFSColumn is a bytea or text column whose large values go to GridFS
+type gridFSColumn struct {
+	name  string
+	text  bool // text or varchar, stored as its UTF-8 bytes
+	index int  // position in the result columns
+}
+
+// gridFSStreamer moves the values of a table larger than mongodb.gridfs_threshold into a GridFS
+// bucket named like the collection. The table query holds those values back, returning NULL in
+// their place, and appends the primary key as text and the length of every large column; they are
+// then read in chunks by primary key and written to GridFS, so no row holds a whole value.
+type gridFSStreamer struct {
+	table      string
+	bucketName string
+	bucket     *gridfs.Bucket // nil in a dry run
+	threshold  int
+	columns    []gridFSColumn
+	keys       []string // primary key columns
+	keyTypes   []string
+	results    int // result columns of the table, the hidden key and length columns follow
+}
+
+// newGridFSStreamer prepares the streaming of the large columns of a table, setting its
+// projection. It returns nil when the threshold is off or the table has no column to stream.
+func newGridFSStreamer(ctx context.Context, pgConn RowSource, collection DocSink, table *TableConfig, columns []string, config Config) (*gridFSStreamer, error) {
+	threshold := config.MongoDB.GridFSThreshold
+	if threshold == 0 {
+		return nil, nil
+	}
+	target, ok := collection.(*mongo.Collection)
+	if !ok {
+		logger.Warn("Table %s is not written to MongoDB, large values are kept in the documents instead of GridFS", table.Name)
+		return nil, nil
+	}
+	if table.Query != "" {
+		logger.Warn("Table %s is read with a custom query, large values are kept in the documents instead of GridFS", table.Name)
+		return nil, nil
+	}
+
+	keys, err := getPrimaryKeyColumns(ctx, pgConn, table.Name)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT attname, atttypid::int, format_type(atttypid, atttypmod)
+		FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped
+		ORDER BY attnum
+	`
+	rows, err := pgConn.Query(ctx, query, quoteTableName(table.Name))
+	if err != nil {
+		return nil, fmt.Errorf("error querying PostgreSQL for the columns of table %s: %v", table.Name, err)
+	}
+	var all []string
+	typeOIDs := map[string]uint32{}
+	typeNames := map[string]string{}
+	for rows.Next() {
+		var name, typeName string
+		var typeOID int32
+		if err := rows.Scan(&name, &typeOID, &typeName); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning column of table %s: %v", table.Name, err)
+		}
+		all = append(all, name)
+		typeOIDs[name] = uint32(typeOID)
+		typeNames[name] = typeName
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating columns of table %s: %v", table.Name, err)
+	}
+	if len(columns) == 0 {
+		columns = all
+	}
+
+	s := &gridFSStreamer{table: table.Name, bucketName: target.Name(), threshold: threshold, keys: keys, results: len(columns)}
+	isKey := map[string]bool{table.Incremental: true}
+	for _, key := range keys {
+		isKey[key] = true
+		s.keyTypes = append(s.keyTypes, typeNames[key])
+	}
+	for i, column := range columns {
+		switch typeOIDs[column] {
+		case pgtype.ByteaOID, pgtype.TextOID, pgtype.VarcharOID:
+			if !isKey[column] {
+				s.columns = append(s.columns, gridFSColumn{name: column, text: typeOIDs[column] != pgtype.ByteaOID, index: i})
+			}
+		}
+	}
+	if len(s.columns) == 0 {
+		return nil, nil
+	}
+	if len(keys) == 0 {
+		logger.Warn("Table %s has no primary key to read large values by, they are kept in the documents instead of GridFS", table.Name)
+		return nil, nil
+	}
+
+	if !config.Migration.DryRun {
+		bucket, err := gridfs.NewBucket(target.Database(), options.GridFSBucket().SetName(s.bucketName))
+		if err != nil {
+			return nil, fmt.Errorf("error opening GridFS bucket %s: %v", s.bucketName, err)
+		}
+		s.bucket = bucket
+		// Files of earlier runs are looked up by row to be replaced
+		index := mongo.IndexModel{Keys: bson.D{{Key: "metadata.table", Value: 1}, {Key: "metadata.column", Value: 1}, {Key: "metadata.key", Value: 1}}}
+		if _, err := bucket.GetFilesCollection().Indexes().CreateOne(ctx, index); err != nil {
+			return nil, fmt.Errorf("error indexing GridFS bucket %s: %v", s.bucketName, err)
+		}
+	}
+
+	// Large values come back as NULL, with their length and the primary key after the columns
+	projection := make([]string, 0, len(columns)+len(keys)+len(s.columns))
+	held := map[string]bool{}
+	for _, c := range s.columns {
+		held[c.name] = true
+	}
+	for _, column := range columns {
+		quoted := quoteIdentifier(column)
+		if held[column] {
+			projection = append(projection, fmt.Sprintf("CASE WHEN octet_length(%s) > %d THEN NULL ELSE %s END AS %s", quoted, threshold, quoted, quoted))
+		} else {
+			projection = append(projection, quoted)
+		}
+	}
+	for _, key := range keys {
+		projection = append(projection, quoteIdentifier(key)+"::text")
+	}
+	for _, c := range s.columns {
+		projection = append(projection, fmt.Sprintf("octet_length(%s)", quoteIdentifier(c.name)))
+	}
+	table.projection = strings.Join(projection, ", ")
+
+	logger.Info("Values of table %s columns %s over %d bytes are stored in GridFS bucket %s.", table.Name, gridFSColumnNames(s.columns), threshold, s.bucketName)
+	return s, nil
+}
+
+// gridFSColumnNames lists the names of columns for logs
+func gridFSColumnNames(columns []gridFSColumn) string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// wrap hides the key and length columns the table query appends
+func (s *gridFSStreamer) wrap(rows pgx.Rows) pgx.Rows {
+	return gridFSRows{Rows: rows, columns: s.results}
+}
+
+// gridFSRows are the rows of a table query with large values held back, see gridFSStreamer
+type gridFSRows struct {
+	pgx.Rows
+	columns int
+}
+
+func (r gridFSRows) FieldDescriptions() []pgproto3.FieldDescription {
+	return r.Rows.FieldDescriptions()[:r.columns]
+}
+
+func (r gridFSRows) Values() ([]interface{}, error) {
+	values, err := r.Rows.Values()
+	if err != nil {
+		return nil, err
+	}
+	return values[:r.columns], nil
+}
+
+func (r gridFSRows) RawValues() [][]byte {
+	return r.Rows.RawValues()[:r.columns]
+}
+
+// store uploads the values the current row held back to GridFS and puts a reference to each file
+// in values: {bucket, file_id, length}. A file stored for the same row and column by an earlier run
+// is replaced.
+func (s *gridFSStreamer) store(ctx context.Context, pgConn RowSource, rows pgx.Rows, values []interface{}, config Config) error {
+	wrapped := rows.(gridFSRows)
+	fields := wrapped.Rows.FieldDescriptions()[s.results:]
+	hidden := wrapped.Rows.RawValues()[s.results:]
+
+	key := make([]string, len(s.keys))
+	for i := range s.keys {
+		key[i] = string(hidden[i])
+	}
+	for i, c := range s.columns {
+		raw := hidden[len(s.keys)+i]
+		if raw == nil {
+			continue
+		}
+		var length pgtype.Int4
+		var err error
+		if fields[len(s.keys)+i].Format == pgtype.TextFormatCode {
+			err = length.DecodeText(nil, raw)
+		} else {
+			err = length.DecodeBinary(nil, raw)
+		}
+		if err != nil {
+			return fmt.Errorf("error reading the length of column %s: %v", c.name, err)
+		}
+		if int(length.Int) <= s.threshold {
+			continue
+		}
+
+		if config.Migration.DryRun {
+			logger.Debug("Dry run: would store column %s of table %s row %v (%d bytes) in GridFS bucket %s", c.name, s.table, key, length.Int, s.bucketName)
+			values[c.index] = bson.D{{Key: "bucket", Value: s.bucketName}, {Key: "file_id", Value: nil}, {Key: "length", Value: int64(length.Int)}}
+			continue
+		}
+		reference, err := s.upload(ctx, pgConn, c, key)
+		if err != nil {
+			return err
+		}
+		values[c.index] = reference
+	}
+	return nil
+}
+
+// upload copies one value to a new GridFS file in chunks of gridFSReadChunk bytes, deleting the
+// files an earlier run stored for it
+func (s *gridFSStreamer) upload(ctx context.Context, pgConn RowSource, c gridFSColumn, key []string) (bson.D, error) {
+	metadata := bson.D{{Key: "table", Value: s.table}, {Key: "column", Value: c.name}, {Key: "key", Value: key}}
+	previous, err := s.bucket.FindContext(ctx, bson.D{{Key: "metadata.table", Value: s.table}, {Key: "metadata.column", Value: c.name}, {Key: "metadata.key", Value: key}})
+	if err != nil {
+		return nil, fmt.Errorf("error looking up GridFS files of column %s: %v", c.name, err)
+	}
+	var files []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := previous.All(ctx, &files); err != nil {
+		return nil, fmt.Errorf("error looking up GridFS files of column %s: %v", c.name, err)
+	}
+	for _, file := range files {
+		if err := s.bucket.DeleteContext(ctx, file.ID); err != nil {
+			return nil, fmt.Errorf("error deleting GridFS file %v of column %s: %v", file.ID, c.name, err)
+		}
+	}
+
+	value := quoteIdentifier(c.name)
+	if c.text {
+		value = fmt.Sprintf("convert_to(%s, 'UTF8')", value)
+	}
+	conditions := make([]string, len(s.keys))
+	for i, k := range s.keys {
+		conditions[i] = fmt.Sprintf("%s = $%d::text::%s", quoteIdentifier(k), i+3, s.keyTypes[i])
+	}
+	query := fmt.Sprintf("SELECT substring(%s FROM $1 FOR $2) FROM %s WHERE %s", value, quoteTableName(s.table), strings.Join(conditions, " AND "))
+
+	name := fmt.Sprintf("%s/%s/%s", s.table, c.name, strings.Join(key, ","))
+	stream, err := s.bucket.OpenUploadStream(name, options.GridFSUpload().SetMetadata(metadata))
+	if err != nil {
+		return nil, fmt.Errorf("error opening GridFS upload of column %s: %v", c.name, err)
+	}
+	var length int64
+	for {
+		var chunk []byte
+		args := []interface{}{length + 1, gridFSReadChunk}
+		for _, k := range key {
+			args = append(args, k)
+		}
+		if err := pgConn.QueryRow(ctx, query, args...).Scan(&chunk); err != nil {
+			stream.Abort()
+			return nil, fmt.Errorf("error reading column %s of table %s row %v: %v", c.name, s.table, key, err)
+		}
+		if _, err := stream.Write(chunk); err != nil {
+			stream.Abort()
+			return nil, fmt.Errorf("error writing GridFS file of column %s: %v", c.name, err)
+		}
+		length += int64(len(chunk))
+		if len(chunk) < gridFSReadChunk {
+			break
+		}
+	}
+	if err := stream.Close(); err != nil {
+		return nil, fmt.Errorf("error writing GridFS file of column %s: %v", c.name, err)
+	}
+	return bson.D{{Key: "bucket", Value: s.bucketName}, {Key: "file_id", Value: stream.FileID}, {Key: "length", Value: length}}, nil
+}
+
+// dropGridFSBucket drops the GridFS bucket of a collection that is dropped before import
+func dropGridFSBucket(ctx context.Context, db *mongo.Database, name string, config Config) error {
+	if config.MongoDB.GridFSThreshold == 0 {
+		return nil
+	}
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(name))
+	if err != nil {
+		return fmt.Errorf("error opening GridFS bucket %s: %v", name, err)
+	}
+	if err := bucket.DropContext(ctx); err != nil {
+		return fmt.Errorf("error dropping GridFS bucket %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package migrator
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// hstoreConverter stores an hstore as a sub-document of string values in key order, so that its
+// keys can be queried like any other field. NULL values become BSON null.
+func hstoreConverter(column string) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		// hstore comes from an extension pgx does not register, so it is sent in text format
+		var hstore pgtype.Hstore
+		if err := hstore.DecodeText(nil, raw); err != nil {
+			return nil, fmt.Errorf("column %s: error decoding hstore: %v", column, err)
+		}
+
+		keys := make([]string, 0, len(hstore.Map))
+		for key := range hstore.Map {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		document := make(bson.D, 0, len(keys))
+		for _, key := range keys {
+			var v interface{}
+			if text := hstore.Map[key]; text.Status == pgtype.Present {
+				v = text.String
+			}
+			document = append(document, bson.E{Key: key, Value: v})
+		}
+		return document, nil
+	}
+}
@@ -0,0 +1,50 @@
+package migrator
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// hstoreOID stands for the OID the hstore extension got in the test database
+const hstoreOID = 16400
+
+func TestHstore(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want bson.D
+	}{
+		{``, bson.D{}},
+		{`"b"=>"2", "a"=>"1"`, bson.D{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}},
+		{`"color"=>NULL, "size"=>"XL"`, bson.D{{Key: "color", Value: nil}, {Key: "size", Value: "XL"}}},
+		{`"color"=>"NULL"`, bson.D{{Key: "color", Value: "NULL"}}},
+		{`"quote \"q\""=>"back\\slash", "comma, arrow=>"=>""`, bson.D{
+			{Key: "comma, arrow=>", Value: ""},
+			{Key: `quote "q"`, Value: `back\slash`},
+		}},
+		{`"with space"=>"multi word value"`, bson.D{{Key: "with space", Value: "multi word value"}}},
+		{`"ключ"=>"значение"`, bson.D{{Key: "ключ", Value: "значение"}}},
+	}
+	types := pgTypes{hstores: map[uint32]bool{hstoreOID: true}}
+	field := column("attributes", hstoreOID)
+	for _, test := range tests {
+		got, _ := convertColumn(t, field, []byte(test.raw), types, testConfig(t))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %#v, want %#v", test.raw, got, test.want)
+		}
+	}
+
+	if got, _ := convertColumn(t, field, nil, types, testConfig(t)); got != nil {
+		t.Errorf("NULL: got %#v, want nil", got)
+	}
+}
+
+func TestHstoreInvalid(t *testing.T) {
+	convert := hstoreConverter("attributes")
+	for _, raw := range []string{`"a"=>`, `"a"="1"`, `"a`} {
+		if got, err := convert(raw, []byte(raw)); err == nil {
+			t.Errorf("%q: got %#v, want an error", raw, got)
+		}
+	}
+}
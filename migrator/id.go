@@ -0,0 +1,79 @@
+package migrator
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sourceIDField keeps the values of a column named _id when mongodb.id_column_policy is always_objectid
+const sourceIDField = "source_id"
+
+// checkIDField applies mongodb.id_column_policy to a column whose field is named _id. It is the
+// _id itself when nothing else builds one, and so is a lone key column holding the plain value;
+// otherwise it would give the documents a second _id. always_objectid renames it to source_id
+// (and keeps it from becoming the _id), the other policies fail the table.
+func checkIDField(table string, names []string, keyIndexes []int, config Config) error {
+	for i, name := range names {
+		if name != "_id" {
+			continue
+		}
+		whole := len(keyIndexes) == 1 && keyIndexes[0] == i && newIDFunc(nil, keyIndexes, config) == nil
+		switch {
+		case whole:
+		case config.MongoDB.IDColumnPolicy == idPolicyAlwaysObjectID:
+			names[i] = sourceIDField
+		case len(keyIndexes) > 0:
+			return fmt.Errorf("table %s has a column _id besides the _id built from its key columns, set mongodb.id_column_policy or id_column: _id", table)
+		}
+	}
+	return nil
+}
+
+// idFunc builds the _id of a row from the raw values of its columns, replacing the plain key values
+type idFunc func(raw [][]byte) (interface{}, error)
+
+// newIDFunc picks how the _id of a row is built from its key columns: hashed with id_strategy hash,
+// joined into a string with composite_id string, and nil (the key values as they are) otherwise
+func newIDFunc(fields []pgproto3.FieldDescription, keyIndexes []int, config Config) idFunc {
+	switch {
+	case len(keyIndexes) == 0:
+		return nil
+	case config.idStrategy() == idStrategyHash:
+		return func(raw [][]byte) (interface{}, error) {
+			return hashKey(fields, raw, keyIndexes, config.MongoDB.IDHashFormat)
+		}
+	case len(keyIndexes) > 1 && config.MongoDB.CompositeID == compositeIDString:
+		return func(raw [][]byte) (interface{}, error) {
+			return joinKey(fields, raw, keyIndexes, config.MongoDB.CompositeIDSeparator)
+		}
+	}
+	return nil
+}
+
+// hashKey builds a deterministic _id from the SHA-1 of the PostgreSQL text form of the key
+// columns, separated by a NUL byte (which text values cannot contain). The objectid format uses
+// the first 12 bytes of the hash, hex all 20 of them as a string.
+func hashKey(fields []pgproto3.FieldDescription, raw [][]byte, keyIndexes []int, format string) (interface{}, error) {
+	hash := sha1.New()
+	for i, index := range keyIndexes {
+		text, err := encodeColumnText(fields[index], raw[index])
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			hash.Write([]byte{0})
+		}
+		hash.Write([]byte(text))
+	}
+	sum := hash.Sum(nil)
+	if format == idHashHex {
+		return hex.EncodeToString(sum), nil
+	}
+	var id primitive.ObjectID
+	copy(id[:], sum)
+	return id, nil
+}
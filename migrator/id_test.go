@@ -0,0 +1,105 @@
+package migrator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgtype"
+)
+
+// idSource is a fakeSource with tables whose columns are named id, _id, both or neither:
+// accounts (id, name), events (_id, name), users (_id, id) and tags (code, name), each keyed by
+// its first column except users, whose primary key is id.
+func idSource(table string) *fakeSource {
+	tables := map[string]struct {
+		names []string
+		oids  []uint32
+		row   []interface{}
+		pk    string
+	}{
+		"accounts": {[]string{"id", "name"}, []uint32{pgtype.Int4OID, pgtype.TextOID}, []interface{}{"1", "alice"}, "id"},
+		"events":   {[]string{"_id", "name"}, []uint32{pgtype.Int4OID, pgtype.TextOID}, []interface{}{"1", "login"}, "_id"},
+		"users":    {[]string{"_id", "id"}, []uint32{pgtype.TextOID, pgtype.Int4OID}, []interface{}{"u1", "1"}, "id"},
+		"tags":     {[]string{"code", "name"}, []uint32{pgtype.Int4OID, pgtype.TextOID}, []interface{}{"7", "red"}, "code"},
+	}[table]
+	names := columns("attname", pgtype.TextOID)
+	fields := columns(tables.names[0], tables.oids[0], tables.names[1], tables.oids[1])
+	return &fakeSource{results: []fakeResult{
+		{match: "indisprimary", fields: names, rows: [][][]byte{textRow(tables.pk)}},
+		{match: "ORDER BY attnum", fields: names, rows: [][][]byte{textRow(tables.names[0]), textRow(tables.names[1])}},
+		{match: `FROM "public"."` + table + `"`, fields: fields, rows: [][][]byte{textRow(tables.row...)}},
+	}}
+}
+
+func TestIDColumnPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		strategy string
+		table    string
+		fields   string // fields of the document, or the start of the error
+		id       interface{}
+	}{
+		{idPolicyErrorOnConflict, idStrategyObjectID, "accounts", "id name", nil},
+		{idPolicyErrorOnConflict, idStrategyObjectID, "events", "_id name", int32(1)},
+		{idPolicyErrorOnConflict, idStrategyObjectID, "users", "_id id", "u1"},
+		{idPolicyErrorOnConflict, idStrategyObjectID, "tags", "code name", nil},
+		{idPolicyErrorOnConflict, idStrategyFromPK, "accounts", "_id id name", int32(1)},
+		{idPolicyErrorOnConflict, idStrategyFromPK, "events", "_id name", int32(1)},
+		{idPolicyErrorOnConflict, idStrategyFromPK, "users", "table public.users has a column _id besides", nil},
+		{idPolicyErrorOnConflict, idStrategyFromPK, "tags", "_id code name", int32(7)},
+
+		{idPolicyUseIDColumn, idStrategyObjectID, "accounts", "_id id name", int32(1)},
+		{idPolicyUseIDColumn, idStrategyObjectID, "events", "_id name", int32(1)},
+		{idPolicyUseIDColumn, idStrategyObjectID, "users", "_id id", "u1"},
+		{idPolicyUseIDColumn, idStrategyObjectID, "tags", "code name", nil},
+		{idPolicyUseIDColumn, idStrategyFromPK, "accounts", "_id id name", int32(1)},
+		{idPolicyUseIDColumn, idStrategyFromPK, "events", "_id name", int32(1)},
+		{idPolicyUseIDColumn, idStrategyFromPK, "users", "_id id", "u1"},
+		{idPolicyUseIDColumn, idStrategyFromPK, "tags", "_id code name", int32(7)},
+
+		{idPolicyAlwaysObjectID, idStrategyObjectID, "accounts", "id name", nil},
+		{idPolicyAlwaysObjectID, idStrategyObjectID, "events", "source_id name", nil},
+		{idPolicyAlwaysObjectID, idStrategyObjectID, "users", "source_id id", nil},
+		{idPolicyAlwaysObjectID, idStrategyObjectID, "tags", "code name", nil},
+		{idPolicyAlwaysObjectID, idStrategyFromPK, "accounts", "id name", nil},
+		{idPolicyAlwaysObjectID, idStrategyFromPK, "events", "source_id name", nil},
+		{idPolicyAlwaysObjectID, idStrategyFromPK, "users", "source_id id", nil},
+		{idPolicyAlwaysObjectID, idStrategyFromPK, "tags", "code name", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.policy+" "+test.strategy+" "+test.table, func(t *testing.T) {
+			config := testConfig(t)
+			config.MongoDB.IDColumnPolicy = test.policy
+			config.MongoDB.IDStrategy = test.strategy
+			sink, _, err := runTransfer(t, idSource(test.table), TableConfig{Name: "public." + test.table}, config)
+			if err != nil {
+				if !strings.HasPrefix(err.Error(), test.fields) {
+					t.Errorf("got error %v, want a document with %s", err, test.fields)
+				}
+				return
+			}
+			if len(sink.documents) != 1 {
+				t.Fatalf("got %d documents, want 1", len(sink.documents))
+			}
+			document := sink.documents[0]
+			var keys []string
+			ids := 0
+			for _, field := range document {
+				keys = append(keys, field.Key)
+				if field.Key == "_id" {
+					ids++
+				}
+			}
+			if got := strings.Join(keys, " "); got != test.fields {
+				t.Errorf("got fields %q, want %q", got, test.fields)
+			}
+			if ids > 1 {
+				t.Errorf("got %d _id fields in %v", ids, document)
+			}
+			if ids == 1 && !reflect.DeepEqual(document[0].Value, test.id) {
+				t.Errorf("got _id %#v, want %#v", document[0].Value, test.id)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package migrator
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// idCollisionSamples caps how many collisions of a table are reported in full
+const idCollisionSamples = 10
+
+// idChecker finds rows of a table that get the same _id (migration.check_ids). It keeps a hash of
+// every _id with the number of the first row that got it, about 60 bytes per row.
+type idChecker struct {
+	table      string
+	seen       map[[16]byte]int64
+	collisions int64
+	samples    []string
+}
+
+// newIDChecker returns the checker of a table, or nil when ids are not checked or MongoDB
+// generates them
+func newIDChecker(table string, keyIndexes []int, config Config) *idChecker {
+	if !config.Migration.CheckIDs {
+		return nil
+	}
+	if len(keyIndexes) == 0 {
+		logger.Info("Table %s gets ObjectIDs, which cannot collide, so its _id values are not checked.", table)
+		return nil
+	}
+	return &idChecker{table: table, seen: map[[16]byte]int64{}}
+}
+
+// add records the _id of a built document, noting a collision when an earlier row got the same one.
+// key is the source key of the row, see keyValue.
+func (c *idChecker) add(document bson.D, row int64, key interface{}) error {
+	if len(document) == 0 || document[0].Key != "_id" {
+		return nil
+	}
+	data, err := bson.Marshal(bson.D{document[0]})
+	if err != nil {
+		return fmt.Errorf("error encoding _id of row %d: %v", row, err)
+	}
+	sum := sha256.Sum256(data)
+	var hash [16]byte
+	copy(hash[:], sum[:])
+
+	first, ok := c.seen[hash]
+	if !ok {
+		c.seen[hash] = row
+		return nil
+	}
+	c.collisions++
+	if len(c.samples) < idCollisionSamples {
+		c.samples = append(c.samples, fmt.Sprintf("row %d (key %v) has the _id %v of row %d", row, key, document[0].Value, first))
+	}
+	return nil
+}
+
+// report logs the collisions of the table and counts them in result
+func (c *idChecker) report(result *TransferResult) {
+	result.IDCollisions = c.collisions
+	if c.collisions == 0 {
+		logger.Info("Table %s: no _id collisions in %d rows.", c.table, len(c.seen))
+		return
+	}
+	logger.Warn("Table %s: %d rows get an _id an earlier row already got (%d distinct ids); first collisions:\n  %s",
+		c.table, c.collisions, len(c.seen), strings.Join(c.samples, "\n  "))
+}
@@ -0,0 +1,108 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// watermark is a lower bound on an ordered column: only rows whose column is greater than
+// the last transferred value are read. It backs both incremental sync and keyset pagination.
+type watermark struct {
+	column     string
+	columnType string
+	value      string
+	hasValue   bool // false on the first run, when the whole table is read
+}
+
+// loadWatermark prepares the incremental filter of a table from the state store
+func loadWatermark(ctx context.Context, pgConn RowSource, table TableConfig, state *StateStore) (*watermark, error) {
+	columnType, err := getColumnType(ctx, pgConn, table.Name, table.Incremental)
+	if err != nil {
+		return nil, err
+	}
+
+	wm := &watermark{column: table.Incremental, columnType: columnType}
+	if tableState, ok := state.get(table.Name); ok && tableState.Watermark != "" {
+		wm.value = tableState.Watermark
+		wm.hasValue = true
+	}
+	return wm, nil
+}
+
+// loadPageKey prepares keyset pagination on the primary key of a table. Tables without a
+// single-column primary key return nil and are read with a single query.
+func loadPageKey(ctx context.Context, pgConn RowSource, table TableConfig) (*watermark, error) {
+	keyColumns, err := getPrimaryKeyColumns(ctx, pgConn, table.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyColumns) != 1 {
+		logger.Warn("Table %s has no single-column primary key, reading it without keyset pagination", table.Name)
+		return nil, nil
+	}
+
+	columnType, err := getColumnType(ctx, pgConn, table.Name, keyColumns[0])
+	if err != nil {
+		return nil, err
+	}
+	return &watermark{column: keyColumns[0], columnType: columnType}, nil
+}
+
+// getColumnType retrieves the SQL type of a column, e.g. "timestamp with time zone"
+func getColumnType(ctx context.Context, pgConn RowSource, table, column string) (string, error) {
+	query := `
+		SELECT format_type(atttypid, atttypmod)
+		FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attname = $2 AND NOT attisdropped
+	`
+
+	var columnType string
+	if err := pgConn.QueryRow(ctx, query, quoteTableName(table), column).Scan(&columnType); err != nil {
+		return "", fmt.Errorf("error looking up type of column %s in table %s: %v", column, table, err)
+	}
+	return columnType, nil
+}
+
+// condition returns the SQL predicate selecting rows after the watermark, or "" on a first run.
+// The value is passed as text and cast to the column type so any comparable type works.
+func (wm *watermark) condition(placeholder string) string {
+	if !wm.hasValue {
+		return ""
+	}
+	return fmt.Sprintf("%s > %s::text::%s", quoteIdentifier(wm.column), placeholder, wm.columnType)
+}
+
+// encodeColumnText returns the PostgreSQL text form of a raw column value
+func encodeColumnText(field pgproto3.FieldDescription, raw []byte) (string, error) {
+	if field.Format == pgtype.TextFormatCode {
+		return string(raw), nil
+	}
+
+	connInfo := pgtype.NewConnInfo()
+	dataType, ok := connInfo.DataTypeForOID(field.DataTypeOID)
+	if !ok {
+		return "", fmt.Errorf("unsupported type OID %d for column %s", field.DataTypeOID, field.Name)
+	}
+
+	value := pgtype.NewValue(dataType.Value)
+	decoder, ok := value.(pgtype.BinaryDecoder)
+	if !ok {
+		return "", fmt.Errorf("unsupported type OID %d for column %s", field.DataTypeOID, field.Name)
+	}
+	if err := decoder.DecodeBinary(connInfo, raw); err != nil {
+		return "", fmt.Errorf("error decoding column %s: %v", field.Name, err)
+	}
+
+	encoder, ok := value.(pgtype.TextEncoder)
+	if !ok {
+		return "", fmt.Errorf("unsupported type OID %d for column %s", field.DataTypeOID, field.Name)
+	}
+	text, err := encoder.EncodeText(connInfo, nil)
+	if err != nil {
+		return "", fmt.Errorf("error encoding column %s: %v", field.Name, err)
+	}
+	return string(text), nil
+}
@@ -0,0 +1,172 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// pgIndex is an index definition read from pg_index
+type pgIndex struct {
+	name       string
+	unique     bool
+	primary    bool
+	method     string
+	partial    bool
+	columns    []string // key columns in order, "" for an expression
+	descending []bool
+}
+
+// getTableIndexes retrieves the index definitions of a schema-qualified table
+func getTableIndexes(ctx context.Context, pgConn RowSource, table string) ([]pgIndex, error) {
+	query := `
+		SELECT c.relname, i.indisunique, i.indisprimary, am.amname, i.indpred IS NOT NULL,
+			array(
+				SELECT coalesce(a.attname, '')
+				FROM unnest(i.indkey) WITH ORDINALITY AS k(attnum, ord)
+				LEFT JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+				WHERE k.ord <= i.indnkeyatts
+				ORDER BY k.ord
+			),
+			i.indoption::int2[]
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_am am ON am.oid = c.relam
+		WHERE i.indrelid = $1::regclass
+		ORDER BY c.relname
+	`
+
+	rows, err := pgConn.Query(ctx, query, quoteTableName(table))
+	if err != nil {
+		return nil, fmt.Errorf("error querying PostgreSQL for indexes: %v", err)
+	}
+	defer rows.Close()
+
+	var indexes []pgIndex
+	for rows.Next() {
+		var index pgIndex
+		var options []int16
+		if err := rows.Scan(&index.name, &index.unique, &index.primary, &index.method, &index.partial, &index.columns, &options); err != nil {
+			return nil, fmt.Errorf("error scanning index definition: %v", err)
+		}
+		index.descending = make([]bool, len(index.columns))
+		for i := range index.columns {
+			// Bit 0 of indoption is INDOPTION_DESC
+			index.descending[i] = i < len(options) && options[i]&1 != 0
+		}
+		indexes = append(indexes, index)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating index definitions: %v", err)
+	}
+
+	return indexes, nil
+}
+
+// createIndexes creates the MongoDB counterparts of the btree indexes of a table. Indexes
+// MongoDB cannot represent (expressions, partial indexes, other access methods, columns that are
+// not migrated) are skipped with a warning, and so is the index backing the _id columns.
+func createIndexes(ctx context.Context, pgConn RowSource, collection *mongo.Collection, table TableConfig, config Config) error {
+	indexes, err := getTableIndexes(ctx, pgConn, table.Name)
+	if err != nil {
+		return err
+	}
+
+	// The columns that make up _id, mirroring resolveIDColumns. A hashed _id does not keep
+	// the columns unique, so their index is still needed.
+	var keyColumns []string
+	idColumn := ""
+	if config.MongoDB.IDColumnPolicy == idPolicyUseIDColumn {
+		if idColumn, err = existingIDColumn(ctx, pgConn, table); err != nil {
+			return err
+		}
+	}
+	switch strategy := config.idStrategy(); {
+	case strategy == idStrategyHash:
+	case len(tableIDColumns(table)) > 0:
+		keyColumns = tableIDColumns(table)
+	case config.MongoDB.IDColumnPolicy == idPolicyAlwaysObjectID:
+	case idColumn != "":
+		keyColumns = []string{idColumn}
+	case strategy == idStrategyFromColumns:
+		keyColumns = config.MongoDB.IDColumns
+	case strategy == idStrategyFromPK:
+		if keyColumns, err = getPrimaryKeyColumns(ctx, pgConn, table.Name); err != nil {
+			return err
+		}
+	}
+
+	selected, err := resolveColumns(ctx, pgConn, table)
+	if err != nil {
+		return err
+	}
+	migrated := make(map[string]bool, len(selected))
+	for _, column := range selected {
+		migrated[column] = true
+	}
+
+	var models []mongo.IndexModel
+	for _, index := range indexes {
+		if index.unique && len(keyColumns) > 0 && strings.Join(index.columns, ",") == strings.Join(keyColumns, ",") {
+			logger.Debug("Index %s of table %s is covered by the _id index", index.name, table.Name)
+			continue
+		}
+
+		reason := ""
+		switch {
+		case index.method != "btree":
+			reason = "uses the " + index.method + " access method"
+		case index.partial:
+			reason = "is a partial index"
+		}
+		keys := bson.D{}
+		for i, column := range index.columns {
+			if reason != "" {
+				break
+			}
+			if column == "" {
+				reason = "indexes an expression"
+			} else if len(selected) > 0 && !migrated[column] {
+				reason = "includes the column " + column + ", which is not migrated"
+			}
+			order := 1
+			if index.descending[i] {
+				order = -1
+			}
+			keys = append(keys, bson.E{Key: fieldName(column, config.MongoDB.FieldNaming), Value: order})
+		}
+		if reason != "" {
+			logger.Warn("Skipping index %s of table %s: it %s", index.name, table.Name, reason)
+			continue
+		}
+
+		// Every merged table asks for its indexes on the same collection, under the default name of
+		// the keys so that the requests match, and a unique index would span the rows of all of them
+		indexOptions := options.Index()
+		if table.merge == nil {
+			indexOptions.SetName(index.name)
+		}
+		if index.unique && table.merge == nil {
+			indexOptions.SetUnique(true)
+		}
+		models = append(models, mongo.IndexModel{Keys: keys, Options: indexOptions})
+	}
+
+	if len(models) == 0 {
+		return nil
+	}
+	if config.Migration.DryRun {
+		logger.Info("Dry run: would create %d index(es) on MongoDB collection %s.", len(models), collection.Name())
+		return nil
+	}
+	if _, err := collection.Indexes().CreateMany(ctx, models); err != nil {
+		return fmt.Errorf("error creating indexes on MongoDB collection %s: %v", collection.Name(), err)
+	}
+	logger.Info("Created %d index(es) on MongoDB collection %s.", len(models), collection.Name())
+	return nil
+}
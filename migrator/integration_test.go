@@ -0,0 +1,200 @@
+//go:build integration
+
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/spf13/viper"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The integration test runs the whole migration against PostgreSQL and MongoDB in containers:
+//
+//	go test -tags integration -run Integration ./migrator/
+//
+// It is skipped when no Docker daemon is reachable.
+
+const integrationSchema = `
+CREATE TYPE mood AS ENUM ('sad', 'ok', 'happy');
+CREATE TABLE sample (
+    id          integer PRIMARY KEY,
+    name        text NOT NULL,
+    price       numeric(12, 2),
+    created_at  timestamptz,
+    attributes  jsonb,
+    tags        text[],
+    external_id uuid,
+    payload     bytea,
+    feeling     mood
+);
+INSERT INTO sample VALUES
+    (1, 'first', 10.50, '2024-03-01 12:30:00+02', '{"color": "red", "sizes": [1, 2]}', '{a,b}',
+     'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', '\x0102', 'happy'),
+    (2, 'second', NULL, NULL, NULL, '{}', NULL, NULL, NULL);
+`
+
+// startContainer starts a container of image and returns its host and the mapped port
+func startContainer(ctx context.Context, t testing.TB, request testcontainers.ContainerRequest) (string, string) {
+	t.Helper()
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{ContainerRequest: request, Started: true})
+	if err != nil {
+		t.Fatalf("starting %s: %v", request.Image, err)
+	}
+	t.Cleanup(func() { container.Terminate(context.Background()) })
+
+	host, err := container.Host(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := container.MappedPort(ctx, nat.Port(request.ExposedPorts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port.Port()
+}
+
+// postgresContainer is the PostgreSQL server of database shop, created by initScript
+func postgresContainer(initScript string) testcontainers.ContainerRequest {
+	return testcontainers.ContainerRequest{
+		Image:        "postgres:16",
+		ExposedPorts: []string{"5432/tcp"},
+		Env:          map[string]string{"POSTGRES_DB": "shop", "POSTGRES_USER": "app", "POSTGRES_PASSWORD": "secret"},
+		Files:        []testcontainers.ContainerFile{{HostFilePath: initScript, ContainerFilePath: "/docker-entrypoint-initdb.d/init.sql", FileMode: 0o644}},
+		// The server restarts once the init script ran, so wait for the second start
+		WaitingFor: wait.ForLog("database system is ready to accept connections").WithOccurrence(2).WithStartupTimeout(2 * time.Minute),
+	}
+}
+
+func TestIntegrationMigrateTables(t *testing.T) {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	dir := t.TempDir()
+	initScript := filepath.Join(dir, "init.sql")
+	if err := os.WriteFile(initScript, []byte(integrationSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pgHost, pgPort := startContainer(ctx, t, postgresContainer(initScript))
+	mongoHost, mongoPort := startContainer(ctx, t, testcontainers.ContainerRequest{
+		Image:        "mongo:6",
+		ExposedPorts: []string{"27017/tcp"},
+		WaitingFor:   wait.ForLog("Waiting for connections").WithStartupTimeout(2 * time.Minute),
+	})
+
+	viper.Reset()
+	configFile := filepath.Join(dir, "config.yml")
+	content := fmt.Sprintf(`
+postgres:
+  host: %s
+  port: %s
+  database: shop
+  user: app
+  password: secret
+  tables: [sample]
+mongodb:
+  uri: mongodb://%s:%s
+  database: shop
+  id_strategy: from_pk
+migration:
+  state_file: %s
+  dead_letter_file: %s
+`, pgHost, pgPort, mongoHost, mongoPort, filepath.Join(dir, "state.json"), filepath.Join(dir, "failed_rows.jsonl"))
+	if err := os.WriteFile(configFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pgConn, err := ConnectToPostgreSQL(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pgConn.Close()
+	mongoClient, err := ConnectToMongoDB(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mongoClient.Disconnect(context.Background())
+
+	if config.Postgres.Tables, err = ResolveTables(ctx, pgConn, config); err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadStateStore(config.Migration.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters := NewDeadLetterSink(config.Migration.DeadLetterFile, 0)
+	defer deadLetters.Close()
+	results, err := MigrateTables(ctx, pgConn, mongoClient, state, deadLetters, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].DocsInserted != 2 {
+		t.Fatalf("got results %+v, want 2 documents inserted", results)
+	}
+
+	cursor, err := mongoClient.Database("shop").Collection("sample").Find(ctx, bson.D{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var documents []bson.M
+	if err := cursor.All(ctx, &documents); err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) != 2 {
+		t.Fatalf("got %d documents, want 2", len(documents))
+	}
+	byID := map[int32]bson.M{}
+	for _, document := range documents {
+		byID[document["_id"].(int32)] = document
+	}
+
+	first := byID[1]
+	price, _ := primitive.ParseDecimal128("10.50")
+	created := primitive.NewDateTimeFromTime(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC))
+	checks := []struct {
+		field string
+		want  interface{}
+	}{
+		{"name", "first"},
+		{"price", price},
+		{"created_at", created},
+		{"external_id", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"},
+		{"payload", primitive.Binary{Subtype: 0, Data: []byte{1, 2}}},
+		{"feeling", "happy"},
+	}
+	for _, check := range checks {
+		if got := first[check.field]; fmt.Sprint(got) != fmt.Sprint(check.want) {
+			t.Errorf("row 1 %s: got %#v, want %#v", check.field, got, check.want)
+		}
+	}
+	if attributes, ok := first["attributes"].(bson.M); !ok || attributes["color"] != "red" {
+		t.Errorf("row 1 attributes: got %#v, want a sub-document", first["attributes"])
+	}
+	if tags, ok := first["tags"].(bson.A); !ok || len(tags) != 2 || tags[0] != "a" {
+		t.Errorf("row 1 tags: got %#v, want [a b]", first["tags"])
+	}
+
+	second := byID[2]
+	for _, field := range []string{"price", "created_at", "attributes", "external_id", "payload", "feeling"} {
+		if value, ok := second[field]; !ok || value != nil {
+			t.Errorf("row 2 %s: got %#v, want null", field, value)
+		}
+	}
+	if tags, ok := second["tags"].(bson.A); !ok || len(tags) != 0 {
+		t.Errorf("row 2 tags: got %#v, want []", second["tags"])
+	}
+}
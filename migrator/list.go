@@ -0,0 +1,49 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+)
+
+// TableEstimate is a table found by GetAllPostgresTables with the row count estimated by PostgreSQL
+type TableEstimate struct {
+	Table string
+	Rows  int64 // -1 when there is no estimate: views, and tables never analyzed on PostgreSQL 14 and later
+}
+
+// ListTables returns the tables postgres.all_tables would pick up with the configured schemas,
+// view settings and table patterns, together with their estimated row counts. Nothing is counted,
+// so it is cheap also for large tables.
+func ListTables(ctx context.Context, pgConn RowSource, config Config) ([]TableEstimate, error) {
+	tables, err := GetAllPostgresTables(ctx, pgConn, config)
+	if err != nil {
+		return nil, err
+	}
+	tables, err = FilterTables(tables, config.Postgres.IncludeTables, config.Postgres.ExcludeTables)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT CASE WHEN relkind = 'v' THEN -1 ELSE reltuples::bigint END
+		FROM pg_class
+		WHERE oid = $1::regclass
+	`
+
+	estimates := make([]TableEstimate, len(tables))
+	for i, table := range tables {
+		estimates[i].Table = table
+		if err := pgConn.QueryRow(ctx, query, quoteTableName(table)).Scan(&estimates[i].Rows); err != nil {
+			return nil, fmt.Errorf("error estimating the row count of table %s: %v", table, err)
+		}
+	}
+	return estimates, nil
+}
+
+// PrintTableList writes one "table<TAB>estimated rows" line per table to stdout, without a header
+// so the output can be piped into other tools
+func PrintTableList(tables []TableEstimate) {
+	for _, t := range tables {
+		fmt.Printf("%s\t%d\n", t.Table, t.Rows)
+	}
+}
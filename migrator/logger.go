@@ -0,0 +1,149 @@
+package migrator
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logger is the logging interface used throughout the tool. Messages are printf-style.
+type Logger interface {
+	Debug(format string, args ...interface{})
+	Info(format string, args ...interface{})
+	Warn(format string, args ...interface{})
+	Error(format string, args ...interface{})
+}
+
+// logLevel orders the severities a Logger can be limited to
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logger is the process-wide logger, replaced once the configuration is loaded
+var logger Logger = newStdLogger(levelInfo)
+
+// parseLogLevel turns a log_level setting into a logLevel
+func parseLogLevel(level string) (logLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return levelDebug, nil
+	case "", "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	default:
+		return levelInfo, fmt.Errorf("invalid log_level %q: must be one of debug, info, warn, error", level)
+	}
+}
+
+// NewLogger builds the logger selected by log_format and log_level
+func NewLogger(format, level string) (Logger, error) {
+	minLevel, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "", "text":
+		return newStdLogger(minLevel), nil
+	case "json":
+		return newZapLogger(minLevel)
+	default:
+		return nil, fmt.Errorf("invalid log_format %q: must be text or json", format)
+	}
+}
+
+// SetLogger replaces the logger used by the package
+func SetLogger(l Logger) {
+	logger = l
+}
+
+// CurrentLogger returns the logger used by the package
+func CurrentLogger() Logger {
+	return logger
+}
+
+// stdLogger writes level-tagged lines through the standard log package
+type stdLogger struct {
+	minLevel logLevel
+	out      *log.Logger
+}
+
+func newStdLogger(minLevel logLevel) *stdLogger {
+	return &stdLogger{minLevel: minLevel, out: log.New(os.Stderr, "", log.LstdFlags)}
+}
+
+func (l *stdLogger) logf(level logLevel, tag, format string, args ...interface{}) {
+	if level < l.minLevel {
+		return
+	}
+	l.out.Printf(tag+" "+format, args...)
+}
+
+func (l *stdLogger) Debug(format string, args ...interface{}) {
+	l.logf(levelDebug, "DEBUG", format, args...)
+}
+
+func (l *stdLogger) Info(format string, args ...interface{}) {
+	l.logf(levelInfo, "INFO", format, args...)
+}
+
+func (l *stdLogger) Warn(format string, args ...interface{}) {
+	l.logf(levelWarn, "WARN", format, args...)
+}
+
+func (l *stdLogger) Error(format string, args ...interface{}) {
+	l.logf(levelError, "ERROR", format, args...)
+}
+
+// zapLogger writes JSON lines to stderr through zap
+type zapLogger struct {
+	sugar *zap.SugaredLogger
+}
+
+func newZapLogger(minLevel logLevel) (*zapLogger, error) {
+	zapLevels := map[logLevel]zapcore.Level{
+		levelDebug: zapcore.DebugLevel,
+		levelInfo:  zapcore.InfoLevel,
+		levelWarn:  zapcore.WarnLevel,
+		levelError: zapcore.ErrorLevel,
+	}
+
+	config := zap.NewProductionConfig()
+	config.Level = zap.NewAtomicLevelAt(zapLevels[minLevel])
+	config.EncoderConfig.TimeKey = "time"
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	log, err := config.Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build JSON logger: %v", err)
+	}
+	return &zapLogger{sugar: log.Sugar()}, nil
+}
+
+func (l *zapLogger) Debug(format string, args ...interface{}) {
+	l.sugar.Debugf(format, args...)
+}
+
+func (l *zapLogger) Info(format string, args ...interface{}) {
+	l.sugar.Infof(format, args...)
+}
+
+func (l *zapLogger) Warn(format string, args ...interface{}) {
+	l.sugar.Warnf(format, args...)
+}
+
+func (l *zapLogger) Error(format string, args ...interface{}) {
+	l.sugar.Errorf(format, args...)
+}
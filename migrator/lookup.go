@@ -0,0 +1,178 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// LookupConfig denormalizes a small reference table into the documents of a table: the row of the
+// lookup table whose key matches the column supplies the values stored in the field
+type LookupConfig struct {
+	Column  string   `mapstructure:"column"`  // column of the table referencing the lookup table
+	Table   string   `mapstructure:"table"`   // lookup table, read into memory once per transfer
+	Key     string   `mapstructure:"key"`     // column of the lookup table matched, defaults to its primary key
+	Values  []string `mapstructure:"values"`  // columns of the lookup table stored in the field
+	Field   string   `mapstructure:"field"`   // document field, defaults to <column>_<value>, or the lookup table name for several values
+	Missing string   `mapstructure:"missing"` // null (default) or error, for a value no lookup row matches
+}
+
+// What happens to a row whose column matches no row of its lookup table (missing of a lookup)
+const (
+	lookupMissingNull  = "null"  // the field is null, or left out with omit_nulls
+	lookupMissingError = "error" // the row fails, or goes to the dead-letter file with continue_on_error
+)
+
+// lookup is a LookupConfig resolved for one transfer, with the lookup table cached by key
+type lookup struct {
+	LookupConfig
+	index  int // position of the referencing column in the result columns
+	field  pgproto3.FieldDescription
+	values map[string]interface{} // text form of the key -> stored value
+}
+
+// newLookups reads the lookup tables of a table. It runs before the table query, whose rows keep
+// the connection busy until they are read; bindLookups then finds the referencing columns.
+func newLookups(ctx context.Context, pgConn RowSource, table TableConfig, types pgTypes, config Config) ([]*lookup, error) {
+	var lookups []*lookup
+	for _, l := range table.Lookups {
+		l.Table = qualifyTableName(l.Table, config.Postgres.Schemas[0])
+		if l.Field == "" && len(l.Values) == 1 {
+			l.Field = fieldName(l.Column+"_"+l.Values[0], config.MongoDB.FieldNaming)
+		} else if l.Field == "" {
+			_, name, _ := splitTableName(l.Table)
+			l.Field = fieldName(name, config.MongoDB.FieldNaming)
+		}
+		if l.Missing == "" {
+			l.Missing = lookupMissingNull
+		}
+		if l.Key == "" {
+			keyColumns, err := getPrimaryKeyColumns(ctx, pgConn, l.Table)
+			if err != nil {
+				return nil, err
+			}
+			if len(keyColumns) != 1 {
+				return nil, fmt.Errorf("lookup of %s in table %s: key is required, the table has no single-column primary key", l.Table, table.Name)
+			}
+			l.Key = keyColumns[0]
+		}
+
+		resolved := &lookup{LookupConfig: l}
+		if err := resolved.load(ctx, pgConn, types, config); err != nil {
+			return nil, err
+		}
+		logger.Info("Looked up %d rows of table %s for field %s of table %s.", len(resolved.values), l.Table, l.Field, table.Name)
+		lookups = append(lookups, resolved)
+	}
+	return lookups, nil
+}
+
+// bindLookups resolves the referencing column of every lookup against the result columns of the table
+func bindLookups(lookups []*lookup, table string, fields []pgproto3.FieldDescription, columnNames []string) error {
+	for _, l := range lookups {
+		indexes, err := columnIndexes(columnNames, []string{l.Column})
+		if err != nil {
+			return fmt.Errorf("lookup of %s in table %s: %v", l.Table, table, err)
+		}
+		l.index, l.field = indexes[0], fields[indexes[0]]
+	}
+	return nil
+}
+
+// load reads the key and value columns of the whole lookup table, converted like any other row.
+// A single value is stored as it is, several as a sub-document of their fields.
+func (l *lookup) load(ctx context.Context, pgConn RowSource, types pgTypes, config Config) error {
+	columns := make([]string, 0, len(l.Values)+1)
+	for _, column := range append([]string{l.Key}, l.Values...) {
+		columns = append(columns, quoteIdentifier(column))
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), quoteTableName(l.Table))
+	rows, err := pgConn.Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("error querying lookup table %s: %v", l.Table, err)
+	}
+	defer rows.Close()
+
+	fields := rows.FieldDescriptions()
+	names := fieldNames(l.Table, l.Values, config.MongoDB.FieldNaming)
+	converters := buildConverters(l.Table, fields, types, config)
+	l.values = map[string]interface{}{}
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return fmt.Errorf("error reading row of lookup table %s: %v", l.Table, err)
+		}
+		raw := rows.RawValues()
+		if raw[0] == nil {
+			continue
+		}
+		key, err := encodeColumnText(fields[0], raw[0])
+		if err != nil {
+			return err
+		}
+		row, err := convertRow(converters, values, raw)
+		if err != nil {
+			return fmt.Errorf("error converting row of lookup table %s: %v", l.Table, err)
+		}
+		if len(l.Values) == 1 {
+			l.values[key] = row.values[1]
+			continue
+		}
+		document := make(bson.D, len(names))
+		for i, name := range names {
+			document[i] = bson.E{Key: name, Value: row.values[i+1]}
+		}
+		l.values[key] = document
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows of lookup table %s: %v", l.Table, err)
+	}
+	return nil
+}
+
+// value returns what the field of a row holds: the cached value of its key, or nil when the column
+// is NULL or, with missing: null, matches no lookup row
+func (l *lookup) value(raw [][]byte) (interface{}, error) {
+	if raw[l.index] == nil {
+		return nil, nil
+	}
+	key, err := encodeColumnText(l.field, raw[l.index])
+	if err != nil {
+		return nil, err
+	}
+	value, ok := l.values[key]
+	if !ok && l.Missing == lookupMissingError {
+		return nil, fmt.Errorf("no row of lookup table %s has %s %s", l.Table, l.Key, key)
+	}
+	return value, nil
+}
+
+// applyLookups sets the lookup fields of a built document, in place when the field exists and before
+// the metadata fields otherwise. A null value leaves the field out with omit_nulls.
+func applyLookups(document bson.D, lookups []*lookup, raw [][]byte, metadataFields int, nulls documentNulls) (bson.D, error) {
+	for _, l := range lookups {
+		value, err := l.value(raw)
+		if err != nil {
+			return document, err
+		}
+		if value == nil && nulls.omit {
+			document = withoutField(document, l.Field)
+			continue
+		}
+		document = setField(document, l.Field, value, metadataFields)
+	}
+	return document, nil
+}
+
+// withoutField returns document without the field, if it has it
+func withoutField(document bson.D, field string) bson.D {
+	for i := range document {
+		if document[i].Key == field {
+			return append(document[:i], document[i+1:]...)
+		}
+	}
+	return document
+}
@@ -0,0 +1,58 @@
+package migrator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTransferLookups(t *testing.T) {
+	config := testConfig(t)
+	config.MongoDB.IDStrategy = idStrategyFromPK
+	source := &fakeSource{results: []fakeResult{
+		{match: "indisprimary", fields: columns("attname", pgtype.TextOID), rows: [][][]byte{textRow("id")}},
+		{match: `FROM "public"."customers"`, fields: columns("id", pgtype.Int4OID, "name", pgtype.TextOID), rows: [][][]byte{textRow("10", "Ann"), textRow("11", "Bob")}},
+		{match: `FROM "public"."orders"`, fields: columns("id", pgtype.Int4OID, "customer_id", pgtype.Int4OID), rows: [][][]byte{
+			textRow("1", "11"), textRow("2", "12"), textRow("3", nil),
+		}},
+	}}
+	table := TableConfig{Name: "public.orders", Lookups: []LookupConfig{{Column: "customer_id", Table: "customers", Values: []string{"name"}}}}
+	sink, _, err := runTransfer(t, source, table, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []bson.D{
+		{{Key: "_id", Value: int32(1)}, {Key: "id", Value: int32(1)}, {Key: "customer_id", Value: int32(11)}, {Key: "customer_id_name", Value: "Bob"}},
+		{{Key: "_id", Value: int32(2)}, {Key: "id", Value: int32(2)}, {Key: "customer_id", Value: int32(12)}, {Key: "customer_id_name", Value: nil}},
+		{{Key: "_id", Value: int32(3)}, {Key: "id", Value: int32(3)}, {Key: "customer_id", Value: nil}, {Key: "customer_id_name", Value: nil}},
+	}
+	if !reflect.DeepEqual(sink.documents, want) {
+		t.Errorf("got %v, want %v", sink.documents, want)
+	}
+
+	// The lookup table is read before the rows of the table are opened
+	lookupQuery, tableQuery := -1, -1
+	for i, query := range source.queried("SELECT") {
+		switch {
+		case strings.Contains(query, `FROM "public"."customers"`):
+			lookupQuery = i
+		case strings.Contains(query, `FROM "public"."orders"`):
+			tableQuery = i
+		}
+	}
+	if lookupQuery < 0 || tableQuery < 0 || lookupQuery > tableQuery {
+		t.Errorf("lookup query at %d, table query at %d, want the lookup first", lookupQuery, tableQuery)
+	}
+}
+
+func TestBindLookupsUnknownColumn(t *testing.T) {
+	lookups := []*lookup{{LookupConfig: LookupConfig{Column: "customer", Table: "public.customers"}}}
+	err := bindLookups(lookups, "public.orders", columns("id", pgtype.Int4OID), []string{"id"})
+	if err == nil || !strings.Contains(err.Error(), "lookup of public.customers in table public.orders") {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MergeConfig sends every table matching one of Tables into the single collection Collection,
+// such as the monthly partitions of an events table (mongodb.merge)
+type MergeConfig struct {
+	Tables     []string `mapstructure:"tables"`
+	Collection string   `mapstructure:"collection"`
+
+	// SourceField adds the table name to every document under this field
+	SourceField string `mapstructure:"source_field"`
+
+	// KeepIDs builds _id as for any table, for keys that are unique across the tables already
+	KeepIDs bool `mapstructure:"keep_ids"`
+}
+
+// merged applies the first mongodb.merge entry matching a table without a collection of its own
+func merged(table TableConfig, config Config) TableConfig {
+	if table.Collection != "" || table.Query != "" {
+		return table
+	}
+	for i, merge := range config.MongoDB.Merge {
+		// The patterns were checked by validateConfig
+		patterns, _ := compileTablePatterns(merge.Tables)
+		if !matchesAny(patterns, table.Name) {
+			continue
+		}
+		table.Collection = merge.Collection
+		if table.SourceField == "" {
+			table.SourceField = merge.SourceField
+		}
+		table.merge = &config.MongoDB.Merge[i]
+		return table
+	}
+	return table
+}
+
+// sourceTable is the table name a merged document records in its source field and _id
+func sourceTable(table TableConfig, config Config) string {
+	return bareTableName(table.Name, config)
+}
+
+// mergedID makes the _id built from the key of a merged table unique across its tables by
+// adding the table name: a composite string _id is prefixed with it, a sub-document _id gets it
+// as its first field and any other _id becomes { <field>: table, id: value }. The field is the
+// source field, or table without one.
+func mergedID(id interface{}, table TableConfig, config Config) interface{} {
+	source := sourceTable(table, config)
+	if s, ok := id.(string); ok && config.MongoDB.CompositeID == compositeIDString {
+		return source + config.MongoDB.CompositeIDSeparator + s
+	}
+	field := table.SourceField
+	if field == "" {
+		field = "table"
+	}
+	if key, ok := id.(bson.D); ok {
+		return append(bson.D{{Key: field, Value: source}}, key...)
+	}
+	return bson.D{{Key: field, Value: source}, {Key: "id", Value: id}}
+}
+
+// dropMergedCollections drops the collection of a mongodb.merge entry once before any of its
+// tables is copied, where a drop by each table would remove the documents of the ones before it.
+// The collection is dropped when one of its tables is dropped before import, and kept while
+// one of them resumes from a checkpoint.
+func dropMergedCollections(ctx context.Context, mongoClient *mongo.Client, state *StateStore, config Config) error {
+	if !config.WritesToMongoDB() {
+		return nil
+	}
+	type target struct{ database, collection string }
+	var targets []target
+	drop := map[target]bool{}
+	resuming := map[target]string{}
+	for _, table := range config.Postgres.Tables {
+		if table.merge == nil {
+			continue
+		}
+		t := target{databaseName(table, config), collectionName(table, config)}
+		if _, seen := drop[t]; !seen {
+			targets = append(targets, t)
+		}
+		dropBeforeImport := config.MongoDB.DropBeforeImport
+		if table.DropBeforeImport != nil {
+			dropBeforeImport = *table.DropBeforeImport
+		}
+		drop[t] = drop[t] || dropBeforeImport
+		if tableState, ok := state.get(table.Name); ok && tableState.Checkpoint != "" && config.Migration.Resume {
+			resuming[t] = table.Name
+		}
+	}
+
+	for _, t := range targets {
+		if !drop[t] {
+			continue
+		}
+		if table, ok := resuming[t]; ok {
+			logger.Info("Not dropping MongoDB collection %s while table %s resumes from a checkpoint.", t.collection, table)
+			continue
+		}
+		if config.Migration.DryRun {
+			logger.Info("Dry run: would drop MongoDB collection %s before import.", t.collection)
+			continue
+		}
+		if err := mongoClient.Database(t.database).Collection(t.collection).Drop(ctx); err != nil {
+			return fmt.Errorf("error dropping MongoDB collection %s: %v", t.collection, err)
+		}
+		if err := dropGridFSBucket(ctx, mongoClient.Database(t.database), t.collection, config); err != nil {
+			return err
+		}
+		logger.Info("Dropped MongoDB collection %s before import.", t.collection)
+	}
+	return nil
+}
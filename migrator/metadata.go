@@ -0,0 +1,32 @@
+package migrator
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// metadataFields returns the source metadata appended to every document of a table,
+// or nil when the metadata block enables none of the fields
+func metadataFields(table string, fieldNames []string, config Config) []bson.E {
+	metadata := config.Metadata
+	naming := config.MongoDB.FieldNaming
+	var fields []bson.E
+	if metadata.Table {
+		fields = append(fields, bson.E{Key: fieldName(metadata.Prefix+"table", naming), Value: table})
+	}
+	if metadata.MigratedAt {
+		fields = append(fields, bson.E{Key: fieldName(metadata.Prefix+"migrated_at", naming), Value: primitive.NewDateTimeFromTime(metadata.StartedAt)})
+	}
+	if metadata.RunID {
+		fields = append(fields, bson.E{Key: fieldName(metadata.Prefix+"run_id", naming), Value: metadata.ID})
+	}
+
+	for _, field := range fields {
+		for _, name := range fieldNames {
+			if name == field.Key {
+				logger.Warn("Column %s of table %s has the same name as a metadata field, the document will contain it twice", name, table)
+			}
+		}
+	}
+	return fields
+}
@@ -0,0 +1,111 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the migration metrics, kept apart from the global registry so that
+// embedding the package does not add metrics to the host program
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	rowsReadTotal     = newCounterVec("pg_mongo_rows_read_total", "Rows read from PostgreSQL.")
+	docsInsertedTotal = newCounterVec("pg_mongo_documents_inserted_total", "Documents written to MongoDB.")
+	docsFailedTotal   = newCounterVec("pg_mongo_documents_failed_total", "Documents rejected by MongoDB.")
+	rowsSkippedTotal  = newCounterVec("pg_mongo_rows_skipped_total", "Rows skipped and dead-lettered in continue-on-error mode.")
+
+	tableDurationSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pg_mongo_table_duration_seconds",
+		Help: "Duration of the last transfer of each table.",
+	}, []string{"table"})
+	tablesInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pg_mongo_tables_in_progress",
+		Help: "Tables currently being transferred.",
+	})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pg_mongo_build_info",
+		Help: "Always 1, labelled with the version, commit and build date of the running build.",
+	}, []string{"version", "commit", "build_date"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(rowsReadTotal, docsInsertedTotal, docsFailedTotal, rowsSkippedTotal, tableDurationSeconds, tablesInProgress, buildInfo)
+	buildInfo.WithLabelValues(Version, Commit, BuildDate).Set(1)
+}
+
+// newCounterVec creates a counter labelled by table
+func newCounterVec(name, help string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, []string{"table"})
+}
+
+// tableMetrics forwards the counts of a TransferResult to the metrics of its table
+type tableMetrics struct {
+	rowsRead, docsInserted, docsFailed, rowsSkipped prometheus.Counter
+	reported                                        TransferResult
+}
+
+func newTableMetrics(table string) *tableMetrics {
+	return &tableMetrics{
+		rowsRead:     rowsReadTotal.WithLabelValues(table),
+		docsInserted: docsInsertedTotal.WithLabelValues(table),
+		docsFailed:   docsFailedTotal.WithLabelValues(table),
+		rowsSkipped:  rowsSkippedTotal.WithLabelValues(table),
+	}
+}
+
+// observe adds what result counted since the previous call
+func (m *tableMetrics) observe(result *TransferResult) {
+	m.rowsRead.Add(float64(result.RowsRead - m.reported.RowsRead))
+	m.docsInserted.Add(float64(result.DocsInserted - m.reported.DocsInserted))
+	m.docsFailed.Add(float64(result.DocsFailed - m.reported.DocsFailed))
+	m.rowsSkipped.Add(float64(result.RowsSkipped - m.reported.RowsSkipped))
+	m.reported = *result
+}
+
+// ServeMetrics exposes the metrics in the Prometheus format on address under /metrics until
+// ctx is done or the returned stop function is called
+func ServeMetrics(ctx context.Context, address string) (stop func(), err error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server stopped: %v", err)
+		}
+	}()
+	logger.Info("Serving metrics on %s/metrics", listener.Addr())
+
+	done := make(chan struct{})
+	stop = func() {
+		select {
+		case <-done:
+			return
+		default:
+			close(done)
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-done:
+		}
+	}()
+	return stop, nil
+}
@@ -0,0 +1,1019 @@
+// Package migrator copies PostgreSQL tables into MongoDB collections. Every failure is
+// returned as an error, leaving it to the caller to decide whether the process exits.
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/sync/errgroup"
+)
+
+// ResolveTables returns the tables to migrate with schema-qualified names. When all_tables
+// is set every table in the configured schemas is returned, keeping the options of any
+// matching entry from the tables list. Tables without a limit get the one of migration.sample,
+// tables without a collection the one of the mongodb.merge entry they match.
+func ResolveTables(ctx context.Context, pgConn RowSource, config Config) ([]TableConfig, error) {
+	tables, err := resolveTables(ctx, pgConn, config)
+	for i := range tables {
+		tables[i] = merged(sampled(tables[i], config), config)
+	}
+	return tables, err
+}
+
+// sampled gives a table without a limit the one of migration.sample
+func sampled(table TableConfig, config Config) TableConfig {
+	if table.Limit == 0 {
+		table.Limit = config.Migration.Sample
+		table.RandomSample = table.RandomSample || config.Migration.SampleRandom
+	}
+	return table
+}
+
+func resolveTables(ctx context.Context, pgConn RowSource, config Config) ([]TableConfig, error) {
+	configured := make(map[string]TableConfig, len(config.Postgres.Tables))
+	var tables []TableConfig
+	var queries []TableConfig
+	for _, table := range config.Postgres.Tables {
+		// A custom query names no relation, so its name stays as written
+		if table.Query != "" {
+			if table.Name == "" {
+				table.Name = table.Collection
+			}
+			queries = append(queries, table)
+			tables = append(tables, table)
+			continue
+		}
+		table.Name = qualifyTableName(table.Name, config.Postgres.Schemas[0])
+		configured[table.Name] = table
+		tables = append(tables, table)
+	}
+
+	if !config.Postgres.AllTables {
+		return checkTablesExist(ctx, pgConn, tables, config)
+	}
+
+	names, err := GetAllPostgresTables(ctx, pgConn, config)
+	if err != nil {
+		return nil, err
+	}
+	names, err = FilterTables(names, config.Postgres.IncludeTables, config.Postgres.ExcludeTables)
+	if err != nil {
+		return nil, err
+	}
+
+	tables = make([]TableConfig, 0, len(names))
+	for _, name := range names {
+		table, ok := configured[name]
+		if !ok {
+			table = TableConfig{Name: name}
+		}
+		tables = append(tables, table)
+	}
+	return append(tables, queries...), nil
+}
+
+// checkTablesExist looks up every configured table up front, so that typos and dropped tables are
+// reported together before anything is migrated. With postgres.missing_tables: skip they are
+// left out with a warning instead.
+func checkTablesExist(ctx context.Context, pgConn RowSource, tables []TableConfig, config Config) ([]TableConfig, error) {
+	var names []string
+	for _, table := range tables {
+		if table.Query == "" {
+			names = append(names, table.Name)
+		}
+	}
+	if len(names) == 0 {
+		return tables, nil
+	}
+	missing, err := missingTables(ctx, pgConn, names)
+	if err != nil || len(missing) == 0 {
+		return tables, err
+	}
+	if config.Postgres.MissingTables != missingTablesSkip {
+		return nil, fmt.Errorf("tables not found: %s (set postgres.missing_tables: skip to migrate the others)", strings.Join(missing, ", "))
+	}
+
+	logger.Warn("Skipping tables that do not exist: %s", strings.Join(missing, ", "))
+	isMissing := make(map[string]bool, len(missing))
+	for _, name := range missing {
+		isMissing[name] = true
+	}
+	found := tables[:0]
+	for _, table := range tables {
+		if table.Query != "" || !isMissing[table.Name] {
+			found = append(found, table)
+		}
+	}
+	return found, nil
+}
+
+// MigrateTables transfers every configured table using a pool of concurrent workers.
+// The first failing table cancels the remaining transfers, unless it has required: false: then
+// the failure is logged and the other tables go on. Results are returned in the order the
+// transfers finished, including failed and cancelled ones.
+func MigrateTables(ctx context.Context, pgConn RowSource, mongoClient *mongo.Client, state *StateStore, deadLetters *DeadLetterSink, config Config) ([]TransferResult, error) {
+	if config.Metadata.ID == "" {
+		config.Metadata.ID = primitive.NewObjectID().Hex()
+	}
+	if config.Metadata.StartedAt.IsZero() {
+		config.Metadata.StartedAt = time.Now()
+	}
+	if config.Metadata.RunID {
+		logger.Info("Run id %s", config.Metadata.ID)
+	}
+	if config.Migration.writeLimiter == nil {
+		config.Migration.writeLimiter = newWriteLimiter(config)
+	}
+	var openedOutput *fileOutput
+	if !config.WritesToMongoDB() && config.Output.files == nil {
+		out, err := newFileOutput(config)
+		if err != nil {
+			return nil, err
+		}
+		config.Output.files = out
+		openedOutput = out
+	}
+
+	if err := dropMergedCollections(ctx, mongoClient, state, config); err != nil {
+		return nil, err
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	tableCh := make(chan TableConfig)
+	group.Go(func() error {
+		defer close(tableCh)
+		for _, table := range config.Postgres.Tables {
+			select {
+			case tableCh <- table:
+			case <-groupCtx.Done():
+				return nil
+			}
+		}
+		return nil
+	})
+
+	var mu sync.Mutex
+	var failed, failedNotRequired, cancelled []string
+	var results []TransferResult
+
+	for i := 0; i < config.Migration.Concurrency; i++ {
+		group.Go(func() error {
+			for table := range tableCh {
+				ctx, cancel := context.WithCancel(groupCtx)
+				// A missing relation is reported by the transfer itself
+				kind := "table"
+				if table.Query != "" {
+					kind = "query"
+				} else if k, err := relationKind(ctx, pgConn, table.Name); err == nil {
+					kind = k
+				}
+				logger.Info("Transferring data from %s %s...", kind, table.Name)
+				collection := collectionName(table, config)
+				result, err := FetchDataFromPostgresAndInsertToMongo(ctx, pgConn, mongoClient, table, databaseName(table, config), collection, state, deadLetters, config)
+				cancel()
+
+				// The group context is already done when the run was cancelled or another table failed first
+				wasCancelled := err != nil && groupCtx.Err() != nil
+				result.Status, result.Err = StatusOK, err
+				result.NotRequired = table.Required != nil && !*table.Required
+				if wasCancelled {
+					result.Status = StatusCancelled
+				} else if err != nil {
+					result.Status = StatusFailed
+				}
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+
+				// A table that is not required fails alone, the others go on
+				if err != nil && !wasCancelled && result.NotRequired {
+					mu.Lock()
+					failedNotRequired = append(failedNotRequired, table.Name)
+					mu.Unlock()
+					logger.Error("Error transferring data from table %s, which is not required, continuing: %v", table.Name, err)
+					continue
+				}
+				if err != nil {
+					mu.Lock()
+					defer mu.Unlock()
+					if wasCancelled {
+						logger.Info("Transfer of table %s cancelled.", table.Name)
+						cancelled = append(cancelled, table.Name)
+						return nil
+					}
+					failed = append(failed, table.Name)
+					logger.Error("Error transferring data from table %s: %v", table.Name, err)
+					return fmt.Errorf("error transferring data from table %s: %v", table.Name, err)
+				}
+				logger.Info("Data transfer from PostgreSQL table %s to MongoDB completed successfully.", table.Name)
+			}
+			return nil
+		})
+	}
+
+	err := group.Wait()
+	if openedOutput != nil {
+		if closeErr := openedOutput.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("error writing the %s output: %v", config.Output.Target, closeErr)
+		}
+	}
+	if len(failed) > 0 {
+		logger.Error("%d table(s) failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	if len(failedNotRequired) > 0 {
+		logger.Error("%d table(s) not required failed: %s", len(failedNotRequired), strings.Join(failedNotRequired, ", "))
+	}
+	if len(cancelled) > 0 {
+		logger.Warn("%d table(s) cancelled: %s", len(cancelled), strings.Join(cancelled, ", "))
+	}
+	return results, err
+}
+
+// columnIndexes returns the position of each wanted column in the result columns
+func columnIndexes(columnNames, wanted []string) ([]int, error) {
+	indexes := make([]int, len(wanted))
+	for i, column := range wanted {
+		indexes[i] = -1
+		for j, columnName := range columnNames {
+			if columnName == column {
+				indexes[i] = j
+				break
+			}
+		}
+		if indexes[i] < 0 {
+			return nil, fmt.Errorf("column %s is not part of the selected columns", column)
+		}
+	}
+	return indexes, nil
+}
+
+// buildID builds the _id value from the key columns of a row. A single key column is
+// used as is, a composite key becomes a sub-document of the key fields.
+func buildID(columnNames []string, columnValues []interface{}, keyIndexes []int) interface{} {
+	if len(keyIndexes) == 1 {
+		return columnValues[keyIndexes[0]]
+	}
+	id := make(bson.D, 0, len(keyIndexes))
+	for _, i := range keyIndexes {
+		id = append(id, bson.E{Key: columnNames[i], Value: columnValues[i]})
+	}
+	return id
+}
+
+// joinKey builds a string _id from the text form of the key columns of a row
+func joinKey(fields []pgproto3.FieldDescription, raw [][]byte, keyIndexes []int, separator string) (string, error) {
+	parts := make([]string, len(keyIndexes))
+	for i, index := range keyIndexes {
+		text, err := encodeColumnText(fields[index], raw[index])
+		if err != nil {
+			return "", err
+		}
+		parts[i] = text
+	}
+	return strings.Join(parts, separator), nil
+}
+
+// keyValue returns the _id value of a row, or nil when the table has no key columns
+func keyValue(columnNames []string, values []interface{}, keyIndexes []int) interface{} {
+	if len(keyIndexes) == 0 {
+		return nil
+	}
+	return buildID(columnNames, values, keyIndexes)
+}
+
+// documentKey returns the _id of a built document, or nil when MongoDB generates it
+func documentKey(document bson.D, keyIndexes []int) interface{} {
+	if len(keyIndexes) == 0 {
+		return nil
+	}
+	return document[0].Value
+}
+
+// checkKey fails when a key column of the row is NULL, since the row would get a null _id
+func checkKey(columnNames []string, values []interface{}, keyIndexes []int) error {
+	for _, i := range keyIndexes {
+		if isNil(values[i]) {
+			return fmt.Errorf("_id column %s is NULL", columnNames[i])
+		}
+	}
+	return nil
+}
+
+// buildDocument creates the MongoDB document of a converted row: _id first when key columns
+// are set, then every column in query order, each followed by its companion fields, and the metadata last.
+// Embedded child arrays are inserted before the metadata later on, see embedding.attach.
+// nulls decides how empty strings and NULL arrays are stored and whether NULL columns and their
+// companions are left out. A column named _id (see checkIDField) is moved first when it is the _id
+// and left out when it is the whole key.
+func buildDocument(columnNames []string, row convertedRow, keyIndexes []int, metadata []bson.E, nulls documentNulls) bson.D {
+	document := bson.D{}
+	if len(keyIndexes) > 0 {
+		id := row.id
+		if id == nil {
+			id = buildID(columnNames, row.values, keyIndexes)
+		}
+		document = append(document, bson.E{Key: "_id", Value: id})
+	}
+	for i, columnName := range columnNames {
+		value := nulls.value(i, row.values[i])
+		if nulls.omit && value == nil {
+			continue
+		}
+		if columnName == "_id" && len(keyIndexes) == 1 && keyIndexes[0] == i && row.id == nil {
+			continue
+		}
+		if columnName == "_id" && len(keyIndexes) == 0 {
+			document = append(bson.D{{Key: columnName, Value: value}}, document...)
+			continue
+		}
+		document = append(document, bson.E{Key: columnName, Value: value})
+		document = append(document, row.companions[i]...)
+	}
+	return append(document, metadata...)
+}
+
+// FetchDataFromPostgresAndInsertToMongo retrieves data from PostgreSQL and inserts it into MongoDB.
+// The result is filled in as far as the transfer got, also when an error is returned.
+func FetchDataFromPostgresAndInsertToMongo(ctx context.Context, pgConn RowSource, mongoClient *mongo.Client, table TableConfig, mongoDBName, mongoCollectionName string, state *StateStore, deadLetters *DeadLetterSink, config Config) (TransferResult, error) {
+	result := TransferResult{Table: table.Name, Collection: mongoCollectionName}
+	start := time.Now()
+	if config.Migration.writeLimiter == nil {
+		config.Migration.writeLimiter = newWriteLimiter(config)
+	}
+	var openedOutput *fileOutput
+	if !config.WritesToMongoDB() && config.Output.files == nil {
+		out, err := newFileOutput(config)
+		if err != nil {
+			return result, err
+		}
+		config.Output.files = out
+		openedOutput = out
+	}
+	tablesInProgress.Inc()
+	defer tablesInProgress.Dec()
+
+	if !config.WritesToMongoDB() {
+		sink := config.Output.files.sink(mongoDBName, mongoCollectionName)
+		err := transferTable(ctx, pgConn, sink, table, mongoCollectionName, state, deadLetters, config, &result)
+		if openedOutput != nil {
+			if closeErr := openedOutput.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("error writing the %s output: %v", config.Output.Target, closeErr)
+			}
+		}
+		result.Duration = time.Since(start)
+		tableDurationSeconds.WithLabelValues(table.Name).Set(result.Duration.Seconds())
+		return result, err
+	}
+
+	collection := mongoClient.Database(mongoDBName).Collection(mongoCollectionName)
+	err := transferTable(ctx, pgConn, collection, table, mongoCollectionName, state, deadLetters, config, &result)
+	// Indexes are built once the data is loaded, which is faster than maintaining them per insert
+	skipped := result.RowsRead == 0 && config.Postgres.SkipEmpty
+	if err == nil && config.MongoDB.CreateIndexes && !skipped && table.Query == "" {
+		err = createIndexes(ctx, pgConn, collection, table, config)
+	}
+	if err == nil && table.TTL != nil && !skipped {
+		err = createTTLIndex(ctx, collection, *table.TTL, config)
+	}
+	if result.DocsDuplicate > 0 {
+		logger.Info("Left out %d documents of table %s whose _id is already in collection %s.", result.DocsDuplicate, table.Name, mongoCollectionName)
+	}
+	if prunes(table, config) && table.Limit > 0 {
+		// Every document outside the sample would look like a deleted row
+		logger.Warn("Table %s is sampled, so collection %s is not pruned", table.Name, mongoCollectionName)
+	} else if prunes(table, config) && table.merge != nil {
+		// So would every document of the other merged tables
+		logger.Warn("Table %s is merged with other tables, so collection %s is not pruned", table.Name, mongoCollectionName)
+	} else if err == nil && prunes(table, config) && !skipped {
+		result.DocsPruned, err = pruneCollection(ctx, pgConn, collection, table, config)
+		if err == nil && config.Migration.DryRun {
+			logger.Info("Dry run: pruning would delete %d documents of collection %s.", result.DocsPruned, mongoCollectionName)
+		} else if err == nil {
+			logger.Info("Pruned %d documents of deleted rows from collection %s.", result.DocsPruned, mongoCollectionName)
+		}
+	}
+	result.Duration = time.Since(start)
+	tableDurationSeconds.WithLabelValues(table.Name).Set(result.Duration.Seconds())
+	return result, err
+}
+
+// transferTable does the work of FetchDataFromPostgresAndInsertToMongo, writing the documents
+// to mongoCollection and counting into result
+func transferTable(ctx context.Context, pgConn RowSource, mongoCollection DocSink, table TableConfig, mongoCollectionName string, state *StateStore, deadLetters *DeadLetterSink, config Config, result *TransferResult) (err error) {
+	metrics := newTableMetrics(table.Name)
+	defer metrics.observe(result)
+
+	batchSize := config.MongoDB.BatchSize
+
+	// PostgreSQL query
+	columns, err := resolveColumns(ctx, pgConn, table)
+	if err != nil {
+		return err
+	}
+
+	keyColumns, err := resolveIDColumns(ctx, pgConn, table, config)
+	if err != nil {
+		return err
+	}
+
+	var wm *watermark
+	if table.Incremental != "" {
+		if wm, err = loadWatermark(ctx, pgConn, table, state); err != nil {
+			return err
+		}
+	}
+
+	// Keyset pagination reads the table in short queries ordered by its primary key
+	var page *watermark
+	pageSize := 0
+	if config.Postgres.PageSize > 0 && table.Query != "" {
+		logger.Warn("Table %s is read with a custom query, keyset pagination is disabled", table.Name)
+	} else if config.Postgres.PageSize > 0 && table.Limit > 0 {
+		logger.Info("Table %s is sampled, keyset pagination is disabled.", table.Name)
+	} else if config.Postgres.PageSize > 0 && wm == nil {
+		if page, err = loadPageKey(ctx, pgConn, table); err != nil {
+			return err
+		}
+		if page != nil {
+			pageSize = config.Postgres.PageSize
+			if tableState, ok := state.get(table.Name); ok && tableState.Checkpoint != "" && config.Migration.Resume {
+				page.value = tableState.Checkpoint
+				page.hasValue = true
+				logger.Info("Resuming table %s after checkpoint %s.", table.Name, page.value)
+			}
+		}
+	} else if config.Postgres.PageSize > 0 {
+		logger.Warn("Table %s is read incrementally, keyset pagination is disabled", table.Name)
+	}
+
+	order := wm
+	if page != nil {
+		order = page
+	}
+	if wm != nil && table.Limit > 0 && table.RandomSample {
+		logger.Warn("Table %s is read incrementally, so its sample is the first %d new rows instead of random ones", table.Name, table.Limit)
+	}
+	// Enum types are looked up before the query, which keeps the connection busy while its rows are read
+	types, err := loadTypes(ctx, pgConn)
+	if err != nil {
+		return err
+	}
+
+	var tracker *progress
+	if config.Migration.Progress {
+		if tracker, err = newProgress(ctx, pgConn, table, order, config); err != nil {
+			return err
+		}
+		defer tracker.done()
+	}
+
+	// Large values are held back by the table query and streamed to GridFS row by row
+	streamer, err := newGridFSStreamer(ctx, pgConn, mongoCollection, &table, columns, config)
+	if err != nil {
+		return err
+	}
+
+	// Lookup tables and the NOT NULL columns of the validator are read before the query as well
+	lookups, err := newLookups(ctx, pgConn, table, types, config)
+	if err != nil {
+		return err
+	}
+
+	var declaredNotNull map[attribute]bool
+	if _, ok := mongoCollection.(*mongo.Collection); ok && config.MongoDB.CreateValidator {
+		if declaredNotNull, err = loadNotNullColumns(ctx, pgConn, table); err != nil {
+			return err
+		}
+	}
+
+	query, args := buildSelectQuery(table, columns, order, pageSize)
+	rows, hasRows, err := readRows(ctx, pgConn, table.Name, query, args, config)
+	if err != nil {
+		return fmt.Errorf("error querying PostgreSQL: %v", err)
+	}
+	if streamer != nil {
+		rows = streamer.wrap(rows)
+	}
+	defer func() { rows.Close() }()
+
+	// Check if the table is empty
+	resuming := page != nil && page.hasValue
+	if !hasRows && resuming {
+		logger.Info("Table %s has no rows past the checkpoint %s.", table.Name, page.value)
+		return state.update(table.Name, func(s *tableState) { s.Checkpoint = "" })
+	}
+	if !hasRows && wm != nil && wm.hasValue {
+		logger.Info("Table %s has no rows past the last watermark %s.", table.Name, wm.value)
+		return nil
+	}
+	if !hasRows && config.Postgres.SkipEmpty {
+		logger.Info("Table %s is empty. Skipping...", table.Name)
+		return nil
+	}
+
+	// Only drop the target once the source query has succeeded
+	dropBeforeImport := config.MongoDB.DropBeforeImport
+	if table.DropBeforeImport != nil {
+		dropBeforeImport = *table.DropBeforeImport
+	}
+	// The collection of merged tables is dropped once for all of them by MigrateTables
+	if table.merge != nil {
+		dropBeforeImport = false
+	}
+	if dropBeforeImport && resuming {
+		logger.Info("Not dropping MongoDB collection %s while resuming from a checkpoint.", mongoCollectionName)
+	} else if dropBeforeImport && config.Migration.DryRun {
+		logger.Info("Dry run: would drop MongoDB collection %s before import.", mongoCollectionName)
+	} else if dropBeforeImport {
+		if err := mongoCollection.Drop(ctx); err != nil {
+			return fmt.Errorf("error dropping MongoDB collection %s: %v", mongoCollectionName, err)
+		}
+		if collection, ok := mongoCollection.(*mongo.Collection); ok {
+			if err := dropGridFSBucket(ctx, collection.Database(), mongoCollectionName, config); err != nil {
+				return err
+			}
+		}
+		logger.Info("Dropped MongoDB collection %s before import.", mongoCollectionName)
+	}
+
+	// A capped collection has to exist before the first document creates a regular one
+	if collection, ok := mongoCollection.(*mongo.Collection); ok && table.Capped != nil {
+		if err := createCappedCollection(ctx, collection, *table.Capped, config); err != nil {
+			return err
+		}
+	}
+
+	if !hasRows && config.Migration.DryRun {
+		logger.Info("Dry run: table %s is empty, would create an empty collection in MongoDB.", table.Name)
+		return nil
+	}
+	if !hasRows && table.merge != nil {
+		logger.Info("Table %s is empty, collection %s gets its documents from the other merged tables.", table.Name, mongoCollectionName)
+		return nil
+	}
+	if !hasRows {
+		// Create an empty collection
+		_, err := mongoCollection.InsertOne(ctx, bson.D{})
+		if err != nil {
+			return fmt.Errorf("error creating empty collection in MongoDB: %v", err)
+		}
+		logger.Info("Table %s is empty. Created empty collection in MongoDB.", table.Name)
+		return nil
+	}
+
+	// Get column names
+	fields := rows.FieldDescriptions()
+	columnNames := make([]string, len(fields))
+	for i, field := range fields {
+		columnNames[i] = string(field.Name)
+	}
+
+	// Document field names, in the configured naming style
+	names := fieldNames(table.Name, columnNames, config.MongoDB.FieldNaming)
+	metadata := metadataFields(table.Name, names, config)
+	if table.SourceField != "" {
+		for _, name := range names {
+			if name == table.SourceField {
+				return fmt.Errorf("table %s: source_field %s is also a column of the table", table.Name, name)
+			}
+		}
+		metadata = append(metadata, bson.E{Key: table.SourceField, Value: sourceTable(table, config)})
+	}
+
+	keyIndexes, err := columnIndexes(columnNames, keyColumns)
+	if err != nil {
+		return fmt.Errorf("error mapping table %s to _id: %v", table.Name, err)
+	}
+	if err := checkIDField(table.Name, names, keyIndexes, config); err != nil {
+		return err
+	}
+
+	transforms, err := compileTransforms(table)
+	if err != nil {
+		return err
+	}
+
+	embeddings, err := newEmbeddings(ctx, pgConn, table, fields, columnNames, types, config)
+	if err != nil {
+		return err
+	}
+	if len(embeddings) > 0 {
+		logger.Info("Embedding %s into the documents of table %s.", embedNames(embeddings), table.Name)
+	}
+
+	if err := bindLookups(lookups, table.Name, fields, columnNames); err != nil {
+		return err
+	}
+
+	if collection, ok := mongoCollection.(*mongo.Collection); ok && config.MongoDB.CreateValidator {
+		// Transforms and embedded arrays replace what the column held
+		skip := map[string]bool{}
+		for _, t := range transforms {
+			skip[t.field] = true
+		}
+		for _, e := range embeddings {
+			skip[e.Field] = true
+		}
+		for _, l := range lookups {
+			skip[l.Field] = true
+		}
+		validator := documentValidator(fields, names, notNullColumns(fields, declaredNotNull), skip, types, config)
+		if err := applyValidator(ctx, collection, validator, config); err != nil {
+			return err
+		}
+	}
+
+	watermarkIndex := -1
+	if wm != nil {
+		indexes, err := columnIndexes(columnNames, []string{wm.column})
+		if err != nil {
+			return fmt.Errorf("error reading incremental column of table %s: %v", table.Name, err)
+		}
+		watermarkIndex = indexes[0]
+	}
+	// Raw value of the incremental column in the last buffered row
+	var pendingWatermark []byte
+
+	pageKeyIndex := -1
+	if page != nil {
+		indexes, err := columnIndexes(columnNames, []string{page.column})
+		if err != nil {
+			return fmt.Errorf("error reading page key of table %s: %v", table.Name, err)
+		}
+		pageKeyIndex = indexes[0]
+	}
+	// Raw page key of the last row read and the number of rows in the current page
+	var lastPageKey []byte
+	pageRows := 0
+
+	// Upserts and replacements are keyed on _id, so without one every row is a plain insert
+	mode := config.MongoDB.Mode
+	if mode != modeInsert && len(keyIndexes) == 0 {
+		logger.Warn("Table %s has no _id columns, falling back to insert mode", table.Name)
+		mode = modeInsert
+	}
+	// Inserts that would collide with an existing _id replace the document with on_duplicate: replace,
+	// and are left out with skip, which needs an unordered insert to write the rest of the batch
+	if mode == modeInsert && len(keyIndexes) > 0 && config.MongoDB.OnDuplicate == onDuplicateReplace {
+		mode = modeReplace
+	}
+	skipDuplicates := mode == modeInsert && config.MongoDB.OnDuplicate == onDuplicateSkip
+	ordered := config.MongoDB.Ordered && !skipDuplicates
+
+	// Documents are buffered and flushed once batchSize is reached, or before their approximate
+	// size would pass maxBatchBytes
+	maxBatchBytes := config.MongoDB.MaxBatchBytes
+	insertOptions := options.InsertMany().SetOrdered(ordered)
+	bulkOptions := options.BulkWrite().SetOrdered(ordered)
+	batch := make([]bson.D, 0, batchSize)
+	// Row numbers and source keys of the buffered documents, for dead-letter entries
+	batchRows := make([]int64, 0, batchSize)
+	batchKeys := make([]interface{}, 0, batchSize)
+	batchBytes := 0
+	printed := 0
+	// write sends documents to MongoDB and returns how many of them were left out as duplicates,
+	// and whether it wrote them in order
+	write := func(documents []bson.D) (int, bool, error) {
+		if config.Migration.DryRun {
+			// Print the first documents instead of writing anything
+			for _, document := range documents {
+				if printed >= config.Migration.DryRunDocs {
+					break
+				}
+				text, err := bson.MarshalExtJSONIndent(document, false, false, "", "  ")
+				if err != nil {
+					return 0, ordered, fmt.Errorf("error encoding document as JSON: %v", err)
+				}
+				fmt.Printf("Dry run: document %d of table %s:\n%s\n", printed+1, table.Name, text)
+				printed++
+			}
+			return 0, ordered, nil
+		}
+		if err := waitToWrite(ctx, config.Migration.writeLimiter, len(documents)); err != nil {
+			return 0, ordered, err
+		}
+		if mode == modeInsert {
+			inserts := make([]interface{}, len(documents))
+			for i, document := range documents {
+				if config.Migration.MaxRetries > 0 && config.WritesToMongoDB() {
+					documents[i] = withID(document)
+				}
+				inserts[i] = documents[i]
+			}
+			duplicates, insertOrdered := 0, ordered
+			// Documents a failed attempt could have written, whose duplicate key errors a retry ignores
+			var written []bool
+			err := retryWrite(ctx, mongoCollectionName, config, func(retry bool) error {
+				if !retry {
+					_, err := mongoCollection.InsertMany(ctx, inserts, insertOptions)
+					if err != nil {
+						written = make([]bool, len(inserts))
+						markMaybeWritten(written, err, ordered)
+					}
+					if skipDuplicates {
+						duplicates, err = dropDuplicateKeys(err)
+					}
+					return err
+				}
+				// A retry cannot tell which documents the failed attempts wrote, so it sends all of
+				// them unordered
+				insertOrdered = false
+				_, insertErr := mongoCollection.InsertMany(ctx, inserts, options.InsertMany().SetOrdered(false))
+				var err error
+				duplicates, err = dropRetriedDuplicates(insertErr, written, skipDuplicates)
+				markMaybeWritten(written, insertErr, false)
+				return err
+			})
+			return duplicates, insertOrdered, err
+		}
+		return 0, ordered, retryWrite(ctx, mongoCollectionName, config, func(retry bool) error {
+			_, err := mongoCollection.BulkWrite(ctx, buildWriteModels(documents, mode), bulkOptions)
+			return err
+		})
+	}
+	// Result counts are shared with the writers of a pipelined transfer
+	var resultMu sync.Mutex
+	// store writes one batch, dead-lettering the documents MongoDB rejects in continue-on-error mode
+	store := func(b *writeBatch) error {
+		documents, rows, keys := b.documents, b.rows, b.keys
+		for len(documents) > 0 {
+			duplicates, writeOrdered, err := write(documents)
+			resultMu.Lock()
+			result.DocsDuplicate += int64(duplicates)
+			resultMu.Unlock()
+
+			var bulkErr mongo.BulkWriteException
+			skippable := config.Migration.ContinueOnError && errors.As(err, &bulkErr) &&
+				len(bulkErr.WriteErrors) > 0 && bulkErr.WriteConcernError == nil
+			if !skippable {
+				resultMu.Lock()
+				result.recordWrite(len(documents)-duplicates, writeOrdered, err)
+				resultMu.Unlock()
+				if err != nil {
+					return fmt.Errorf("error writing %d documents into MongoDB: %v", len(documents), describeWriteErrors(err, rows, keys, writeOrdered))
+				}
+				break
+			}
+
+			// Dead-letter the rejected documents. An ordered write stops at its first error,
+			// so the documents after it are sent again.
+			attempted := len(documents)
+			if writeOrdered {
+				attempted = bulkErr.WriteErrors[0].Index + 1
+			}
+			resultMu.Lock()
+			result.recordWrite(attempted-duplicates, writeOrdered, err)
+			result.RowsSkipped += int64(len(bulkErr.WriteErrors))
+			resultMu.Unlock()
+			for _, writeErr := range bulkErr.WriteErrors {
+				reason := fmt.Sprintf("MongoDB rejected the document (code %d): %s", writeErr.Code, writeErr.Message)
+				if err := deadLetters.record(table.Name, rows[writeErr.Index], keys[writeErr.Index], reason); err != nil {
+					return err
+				}
+			}
+			documents, rows, keys = documents[attempted:], rows[attempted:], keys[attempted:]
+		}
+		resultMu.Lock()
+		metrics.observe(result)
+		resultMu.Unlock()
+		return nil
+	}
+	// save records in the state file how far the table got once a batch is written
+	save := func(b *writeBatch) error {
+		// Advance the watermark only once the batch is safely written
+		if b.watermark != nil {
+			value, err := encodeColumnText(fields[watermarkIndex], b.watermark)
+			if err != nil {
+				return err
+			}
+			if err := state.update(table.Name, func(s *tableState) { s.Watermark = value }); err != nil {
+				return err
+			}
+		}
+
+		// Record how far a paginated transfer got so a failed run can resume from there
+		if b.pageKey != nil {
+			value, err := encodeColumnText(fields[pageKeyIndex], b.pageKey)
+			if err != nil {
+				return err
+			}
+			if err := state.update(table.Name, func(s *tableState) { s.Checkpoint = value }); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// With several writers the batches are handed to a pipeline while the next rows are read
+	var pipeline *writePipeline
+	if config.Migration.Writers > 1 && !config.Migration.DryRun {
+		pipeline = newWritePipeline(config.Migration.Writers, config.Migration.WriteQueue, store, save)
+		// The writers finish before the transfer returns, and the error of the earliest failed
+		// batch wins over a later one of the reader
+		defer func() {
+			if werr := pipeline.close(); werr != nil {
+				err = werr
+			}
+		}()
+	}
+	flush := func() error {
+		for _, e := range embeddings {
+			if err := e.attach(ctx, pgConn, batch, len(metadata), config); err != nil {
+				return err
+			}
+		}
+
+		b := &writeBatch{documents: batch, rows: batchRows, keys: batchKeys, watermark: pendingWatermark}
+		if lastPageKey != nil {
+			b.pageKey = append([]byte(nil), lastPageKey...)
+		}
+		pendingWatermark = nil
+		batchBytes = 0
+		if pipeline != nil {
+			batch, batchRows, batchKeys = make([]bson.D, 0, batchSize), make([]int64, 0, batchSize), make([]interface{}, 0, batchSize)
+			return pipeline.send(ctx, b)
+		}
+
+		if err := store(b); err != nil {
+			return err
+		}
+		batch, batchRows, batchKeys = batch[:0], batchRows[:0], batchKeys[:0]
+		return save(b)
+	}
+
+	converters := buildConverters(table.Name, fields, types, config)
+	nulls := newDocumentNulls(fields, types, config)
+	makeID := newIDFunc(fields, keyIndexes, config)
+	ids := newIDChecker(table.Name, keyIndexes, config)
+	// The keys of merged tables usually repeat across them, so their _id gets the table name
+	mergeIDs := table.merge != nil && !table.merge.KeepIDs && len(keyIndexes) > 0
+
+	// Iterate through PostgreSQL rows and insert into MongoDB
+	for {
+		// Decode the row and convert each column to its BSON representation
+		values, err := rows.Values()
+		if err != nil {
+			return fmt.Errorf("error reading PostgreSQL row: %v", err)
+		}
+		resultMu.Lock()
+		result.RowsRead++
+		resultMu.Unlock()
+		if tracker != nil {
+			tracker.update(result.RowsRead)
+		}
+		raw := rows.RawValues()
+
+		row, err := convertRow(converters, values, raw)
+		if err == nil && streamer != nil {
+			err = streamer.store(ctx, pgConn, rows, row.values, config)
+		}
+		if err == nil {
+			err = checkKey(columnNames, values, keyIndexes)
+		}
+		if err == nil && makeID != nil {
+			row.id, err = makeID(raw)
+		}
+		var document bson.D
+		size := 0
+		if err == nil {
+			document = buildDocument(names, row, keyIndexes, metadata, nulls)
+			if mergeIDs {
+				document[0].Value = mergedID(document[0].Value, table, config)
+			}
+			if len(lookups) > 0 {
+				document, err = applyLookups(document, lookups, raw, len(metadata), nulls)
+			}
+			if err == nil && len(transforms) > 0 {
+				document, err = applyTransforms(document, transforms, columnNames, row.values, len(metadata))
+			}
+		}
+		if err == nil {
+			// JSON lines have no size limit, MongoDB and BSON files do
+			if config.Output.Target != outputJSONL {
+				size, err = fitDocument(document, result.RowsRead, documentKey(document, keyIndexes), config)
+			} else if maxBatchBytes > 0 {
+				size = documentSize(document)
+			}
+			if err == nil && maxBatchBytes > 0 && size > maxBatchBytes {
+				err = fmt.Errorf("document of row %d (_id %v) is about %d bytes, more than mongodb.max_batch_bytes (%d)", result.RowsRead, documentKey(document, keyIndexes), size, maxBatchBytes)
+			}
+		}
+		// A document that would overflow the batch starts the next one. The batch is flushed before
+		// the position of this row is recorded, so the state does not skip it.
+		if err == nil && maxBatchBytes > 0 && len(batch) > 0 && batchBytes+size > maxBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		if watermarkIndex >= 0 && raw[watermarkIndex] != nil {
+			// pgx reuses its read buffer for the next row, so keep a copy
+			pendingWatermark = append(pendingWatermark[:0], raw[watermarkIndex]...)
+		}
+		if pageKeyIndex >= 0 {
+			lastPageKey = append(lastPageKey[:0], raw[pageKeyIndex]...)
+			pageRows++
+		}
+		if err != nil && (config.Migration.ContinueOnError || skipsOversized(err, config)) {
+			resultMu.Lock()
+			result.RowsSkipped++
+			resultMu.Unlock()
+			key := keyValue(names, values, keyIndexes)
+			if err := deadLetters.record(table.Name, result.RowsRead, key, err.Error()); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return fmt.Errorf("error converting PostgreSQL row: %v", err)
+		} else {
+			batch = append(batch, document)
+			batchRows = append(batchRows, result.RowsRead)
+			key := keyValue(names, row.values, keyIndexes)
+			batchKeys = append(batchKeys, key)
+			if ids != nil {
+				if err := ids.add(document, result.RowsRead, key); err != nil {
+					return err
+				}
+			}
+			batchBytes += size
+			for _, e := range embeddings {
+				if err := e.addKey(raw); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		if rows.Next() {
+			continue
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating PostgreSQL rows: %v", statementTimeoutError(err, config))
+		}
+
+		// A short page means the end of the table, otherwise read the page after the last key
+		if page == nil || pageRows < pageSize {
+			break
+		}
+		rows.Close()
+		if page.value, err = encodeColumnText(fields[pageKeyIndex], lastPageKey); err != nil {
+			return err
+		}
+		page.hasValue = true
+		pageRows = 0
+
+		query, args := buildSelectQuery(table, columns, page, pageSize)
+		queried := time.Now()
+		next, more, err := readRows(ctx, pgConn, table.Name, query, args, config)
+		if err != nil {
+			return fmt.Errorf("error querying PostgreSQL: %v", err)
+		}
+		rows = next
+		if streamer != nil {
+			rows = streamer.wrap(rows)
+		}
+		logger.Debug("Page of table %s after %s answered in %s", table.Name, page.value, time.Since(queried))
+		if !more {
+			break
+		}
+	}
+
+	// Insert whatever is left of the last partial batch
+	if err := flush(); err != nil {
+		return err
+	}
+	if pipeline != nil {
+		if err := pipeline.close(); err != nil {
+			return err
+		}
+	}
+
+	if ids != nil {
+		ids.report(result)
+	}
+
+	if collection, ok := mongoCollection.(*mongo.Collection); ok && config.Types.GeometryIndex {
+		createGeometryIndexes(ctx, collection, fields, names, types, config)
+	}
+
+	// The table is complete, so the next run starts from the beginning again
+	if page != nil {
+		return state.update(table.Name, func(s *tableState) { s.Checkpoint = "" })
+	}
+	return nil
+}
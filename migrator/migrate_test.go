@@ -0,0 +1,286 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ordersSource is a fakeSource with a table public.orders of n rows and the primary key id
+func ordersSource(n int) *fakeSource {
+	rows := make([][][]byte, n)
+	for i := range rows {
+		rows[i] = textRow(fmt.Sprint(i+1), fmt.Sprintf("order %d", i+1), nil)
+	}
+	return &fakeSource{results: []fakeResult{
+		{match: "indisprimary", fields: columns("attname", pgtype.TextOID), rows: [][][]byte{textRow("id")}},
+		{match: `FROM "public"."orders"`, fields: columns("id", pgtype.Int4OID, "name", pgtype.TextOID, "shipped_at", pgtype.TimestamptzOID), rows: rows},
+	}}
+}
+
+// runTransfer transfers table from source into a fakeSink, with the state and dead-letter files in
+// a temporary directory
+func runTransfer(t *testing.T, source *fakeSource, table TableConfig, config Config) (*fakeSink, TransferResult, error) {
+	t.Helper()
+	sink := &fakeSink{}
+	state, err := LoadStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := transferInto(t, source, sink, table, state, config)
+	return sink, result, err
+}
+
+// transferInto transfers table from source into sink with the given state store
+func transferInto(t *testing.T, source *fakeSource, sink *fakeSink, table TableConfig, state *StateStore, config Config) (TransferResult, error) {
+	t.Helper()
+	deadLetters := NewDeadLetterSink(filepath.Join(t.TempDir(), "failed_rows.jsonl"), config.Migration.MaxErrors)
+	defer deadLetters.Close()
+	result := TransferResult{Table: table.Name}
+	err := transferTable(context.Background(), source, sink, table, "orders", state, deadLetters, config, &result)
+	return result, err
+}
+
+func TestTransferBatches(t *testing.T) {
+	tests := []struct {
+		rows      int
+		batchSize int
+		writers   int
+		batches   []int
+	}{
+		{rows: 7, batchSize: 3, writers: 1, batches: []int{3, 3, 1}},
+		{rows: 6, batchSize: 3, writers: 1, batches: []int{3, 3}},
+		{rows: 2, batchSize: 1000, writers: 1, batches: []int{2}},
+		{rows: 1, batchSize: 1, writers: 1, batches: []int{1}},
+		{rows: 10, batchSize: 4, writers: 3, batches: []int{4, 4, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d rows in batches of %d with %d writers", tt.rows, tt.batchSize, tt.writers), func(t *testing.T) {
+			config := testConfig(t)
+			config.MongoDB.BatchSize = tt.batchSize
+			config.MongoDB.IDStrategy = idStrategyFromPK
+			config.Migration.Writers = tt.writers
+			config.Migration.WriteQueue = tt.writers
+			sink, result, err := runTransfer(t, ordersSource(tt.rows), TableConfig{Name: "public.orders"}, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Parallel writers may finish the batches in any order
+			batches := map[int]int{}
+			for _, n := range sink.batches {
+				batches[n]++
+			}
+			want := map[int]int{}
+			for _, n := range tt.batches {
+				want[n]++
+			}
+			if !reflect.DeepEqual(batches, want) {
+				t.Errorf("batches: got %v, want %v", sink.batches, tt.batches)
+			}
+			if result.RowsRead != int64(tt.rows) || result.DocsInserted != int64(tt.rows) || len(sink.documents) != tt.rows {
+				t.Errorf("got %d rows read, %d inserted, %d documents, want %d", result.RowsRead, result.DocsInserted, len(sink.documents), tt.rows)
+			}
+
+			ids := map[int32]bool{}
+			for _, document := range sink.documents {
+				ids[document[0].Value.(int32)] = true
+			}
+			if len(ids) != tt.rows {
+				t.Errorf("got %d distinct _id values, want %d", len(ids), tt.rows)
+			}
+		})
+	}
+}
+
+func TestTransferDocument(t *testing.T) {
+	config := testConfig(t)
+	config.MongoDB.IDStrategy = idStrategyFromPK
+	sink, _, err := runTransfer(t, ordersSource(1), TableConfig{Name: "public.orders"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{{Key: "_id", Value: int32(1)}, {Key: "id", Value: int32(1)}, {Key: "name", Value: "order 1"}, {Key: "shipped_at", Value: nil}}
+	if len(sink.documents) != 1 || !reflect.DeepEqual(sink.documents[0], want) {
+		t.Errorf("got %v, want %v", sink.documents, want)
+	}
+}
+
+func TestTransferEmptyTable(t *testing.T) {
+	config := testConfig(t)
+	sink, result, err := runTransfer(t, ordersSource(0), TableConfig{Name: "public.orders"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An empty table still creates its collection, with an empty document
+	if result.RowsRead != 0 || len(sink.batches) != 0 || len(sink.documents) != 1 || len(sink.documents[0]) != 0 {
+		t.Errorf("got %d rows read, batches %v, documents %v", result.RowsRead, sink.batches, sink.documents)
+	}
+
+	config.Postgres.SkipEmpty = true
+	sink, _, err = runTransfer(t, ordersSource(0), TableConfig{Name: "public.orders"}, config)
+	if err != nil || len(sink.documents) != 0 {
+		t.Errorf("skip_empty: got %v, error %v, want nothing written", sink.documents, err)
+	}
+}
+
+func TestTransferFieldOrder(t *testing.T) {
+	config := testConfig(t)
+	config.MongoDB.IDStrategy = idStrategyFromPK
+	config.Types.TimestampOffsetField = true
+	config.Metadata.Prefix = "_"
+	config.Metadata.Table = true
+	config.Metadata.RunID = true
+	config.Metadata.ID = "run-1"
+	source := ordersSource(2)
+	source.results = append(source.results,
+		fakeResult{match: "format_type", fields: columns("format_type", pgtype.TextOID), rows: [][][]byte{textRow("integer")}},
+		fakeResult{match: `FROM "public"."order_items"`, fields: columns("item_id", pgtype.Int4OID, "order_id", pgtype.Int4OID), rows: [][][]byte{textRow("10", "1")}},
+		fakeResult{match: `FROM "public"."payments"`, fields: columns("payment_id", pgtype.Int4OID, "order_id", pgtype.Int4OID), rows: [][][]byte{textRow("20", "2")}},
+	)
+	table := TableConfig{Name: "public.orders", Embed: []EmbedConfig{
+		{Table: "payments", ForeignKey: "order_id"},
+		{Table: "order_items", ForeignKey: "order_id", Field: "items"},
+	}}
+	sink, _, err := runTransfer(t, source, table, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Columns in query order with their companions, then the embedded arrays in the order of the
+	// embed list, then the metadata
+	want := []string{"_id", "id", "name", "shipped_at", "shipped_at_offset", "payments", "items", "_table", "_run_id"}
+	if len(sink.documents) != 2 {
+		t.Fatalf("got %d documents, want 2", len(sink.documents))
+	}
+	for _, document := range sink.documents {
+		keys := make([]string, len(document))
+		for i, field := range document {
+			keys[i] = field.Key
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("got fields %q, want %q", keys, want)
+		}
+	}
+	if items := sink.documents[0][6].Value.(bson.A); len(items) != 1 {
+		t.Errorf("document 1 items: got %v, want one item", items)
+	}
+	if payments := sink.documents[1][5].Value.(bson.A); len(payments) != 1 {
+		t.Errorf("document 2 payments: got %v, want one payment", payments)
+	}
+}
+
+func TestTransferSkipsDuplicates(t *testing.T) {
+	existing := func() *fakeSink {
+		// Documents with _id 1 and 4 are already in the collection, 1 the first of its batch
+		return &fakeSink{documents: []bson.D{
+			{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "kept 1"}},
+			{{Key: "_id", Value: int32(4)}, {Key: "name", Value: "kept 4"}},
+		}}
+	}
+	state, err := LoadStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t)
+	config.MongoDB.IDStrategy = idStrategyFromPK
+	config.MongoDB.BatchSize = 2
+	config.MongoDB.Ordered = true
+	config.MongoDB.OnDuplicate = onDuplicateSkip
+	table := TableConfig{Name: "public.orders"}
+
+	sink := existing()
+	result, err := transferInto(t, ordersSource(5), sink, table, state, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DocsDuplicate != 2 || result.DocsInserted != 3 || result.RowsRead != 5 {
+		t.Errorf("got %d read, %d inserted, %d duplicates, want 5, 3 and 2", result.RowsRead, result.DocsInserted, result.DocsDuplicate)
+	}
+	names := map[int32]interface{}{}
+	for _, document := range sink.documents {
+		for _, field := range document {
+			if field.Key == "name" {
+				names[document[0].Value.(int32)] = field.Value
+			}
+		}
+	}
+	want := map[int32]interface{}{1: "kept 1", 2: "order 2", 3: "order 3", 4: "kept 4", 5: "order 5"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got documents %v, want %v", names, want)
+	}
+
+	// Without skip the first duplicate fails the table
+	config.MongoDB.OnDuplicate = onDuplicateFail
+	result, err = transferInto(t, ordersSource(5), existing(), table, state, config)
+	if err == nil || !strings.Contains(err.Error(), "duplicate key") || result.DocsDuplicate != 0 {
+		t.Errorf("on_duplicate fail: got error %v and %d duplicates, want a duplicate key error", err, result.DocsDuplicate)
+	}
+}
+
+func TestTransferRetriesAfterDuplicates(t *testing.T) {
+	tests := []struct {
+		onDuplicate string
+		err         string
+		inserted    int64
+		duplicates  int64
+		name        string // of the document with _id 4 afterwards
+	}{
+		// The documents the failed attempt wrote are not duplicates, the one already there is
+		{onDuplicate: onDuplicateFail, err: "row 4 (key 4): code 11000", inserted: 4, name: "kept 4"},
+		{onDuplicate: onDuplicateSkip, inserted: 4, duplicates: 1, name: "kept 4"},
+		{onDuplicate: onDuplicateReplace, inserted: 5, name: "order 4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onDuplicate, func(t *testing.T) {
+			// The first write steps down after two documents, the document with _id 4 is already there
+			sink := &fakeSink{
+				documents: []bson.D{{{Key: "_id", Value: int32(4)}, {Key: "name", Value: "kept 4"}}},
+				failures:  1,
+				failAfter: 2,
+			}
+			state, err := LoadStateStore(filepath.Join(t.TempDir(), "state.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := testConfig(t)
+			config.MongoDB.IDStrategy = idStrategyFromPK
+			config.MongoDB.Ordered = true
+			config.MongoDB.OnDuplicate = tt.onDuplicate
+			config.Migration.MaxRetries = 1
+			config.Migration.RetryDelay = time.Millisecond
+			result, err := transferInto(t, ordersSource(5), sink, TableConfig{Name: "public.orders"}, state, config)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got error %v, want one with %q", err, tt.err)
+			}
+			if result.DocsInserted != tt.inserted || result.DocsDuplicate != tt.duplicates {
+				t.Errorf("got %d inserted and %d duplicates, want %d and %d", result.DocsInserted, result.DocsDuplicate, tt.inserted, tt.duplicates)
+			}
+			if len(sink.batches) != 2 {
+				t.Errorf("got writes %v, want the batch and one retry", sink.batches)
+			}
+			names := map[int32]interface{}{}
+			for _, document := range sink.documents {
+				for _, field := range document {
+					if field.Key == "name" {
+						names[document[0].Value.(int32)] = field.Value
+					}
+				}
+			}
+			want := map[int32]interface{}{1: "order 1", 2: "order 2", 3: "order 3", 4: tt.name, 5: "order 5"}
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("got documents %v, want %v", names, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package migrator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// moneyOID is the type OID of money, which pgtype does not register, so pgx returns its text
+const moneyOID = 790
+
+// Storage formats of bit and varbit columns (types.bit_format)
+const (
+	bitFormatString  = "string"  // the bits as a string of 0 and 1, e.g. 10110
+	bitFormatBinary  = "binary"  // BSON binary of the bits packed into bytes, padded with zero bits
+	bitFormatBoolean = "boolean" // a single bit as true or false, longer values as with string
+)
+
+// moneyConverter stores money values as Decimal128. The text form PostgreSQL sends depends on
+// lc_monetary; it is parsed assuming a . decimal point and , or space digit grouping, as in the C
+// and en_US locales. Currency symbols are dropped and a leading - or parentheses mean negative.
+func moneyConverter(value interface{}, raw []byte) (interface{}, error) {
+	text, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected money value of type %T", value)
+	}
+	number, err := parseMoney(text)
+	if err != nil {
+		return nil, err
+	}
+	return primitive.ParseDecimal128(number)
+}
+
+// parseMoney returns the number of a money text such as -$1,234.56 or ($0.50) as -1234.56 or -0.50
+func parseMoney(text string) (string, error) {
+	var b strings.Builder
+	negative, points := false, 0
+	for _, r := range text {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '.':
+			points++
+			b.WriteRune(r)
+		case r == '-' || r == '(':
+			negative = true
+		case r == ',':
+			if points > 0 {
+				return "", fmt.Errorf("unsupported money value %q: lc_monetary must use . as the decimal point", text)
+			}
+		}
+	}
+	number := b.String()
+	if number == "" || points > 1 {
+		return "", fmt.Errorf("unsupported money value %q: lc_monetary must use . as the decimal point", text)
+	}
+	if negative {
+		number = "-" + number
+	}
+	return number, nil
+}
+
+// bitConverter stores bit and varbit values in the configured format
+func bitConverter(format string) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		var bits pgtype.Varbit
+		switch v := value.(type) {
+		case pgtype.Varbit:
+			bits = v
+		case pgtype.Bit:
+			bits = pgtype.Varbit(v)
+		default:
+			return nil, fmt.Errorf("unexpected bit value of type %T", value)
+		}
+		switch {
+		case format == bitFormatBinary:
+			// pgx decodes into the buffer of the row, which the next row overwrites
+			return primitive.Binary{Subtype: bson.TypeBinaryGeneric, Data: append([]byte(nil), bits.Bytes...)}, nil
+		case format == bitFormatBoolean && bits.Len == 1:
+			return bits.Bytes[0]&0x80 != 0, nil
+		}
+		text := make([]byte, bits.Len)
+		for i := range text {
+			text[i] = '0' + bits.Bytes[i/8]>>(7-uint(i%8))&1
+		}
+		return string(text), nil
+	}
+}
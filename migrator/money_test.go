@@ -0,0 +1,103 @@
+package migrator
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMoney(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"$1,234.56", "1234.56"},
+		{"$0.05", "0.05"},
+		{"-$0.50", "-0.50"},
+		{"($0.50)", "-0.50"},
+		{"-$1 234 567.89", "-1234567.89"},
+		{"$12.00", "12.00"},
+		{"EUR 3.5", "3.5"},
+	}
+	field := column("price", moneyOID)
+	for _, test := range tests {
+		got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, testConfig(t))
+		if want := decimal(t, test.want); got != want {
+			t.Errorf("%q: got %v, want %v", test.raw, got, want)
+		}
+	}
+}
+
+func TestMoneyUnsupportedLocale(t *testing.T) {
+	for _, text := range []string{"1.234,56 €", "$1.2.3", "$"} {
+		if number, err := parseMoney(text); err == nil {
+			t.Errorf("%q: got %q, want an error", text, number)
+		}
+	}
+}
+
+func TestBitFormats(t *testing.T) {
+	tests := []struct {
+		oid     uint32
+		raw     string
+		text    string
+		data    []byte
+		boolean interface{}
+	}{
+		{pgtype.BitOID, "1", "1", []byte{0x80}, true},
+		{pgtype.BitOID, "0", "0", []byte{0x00}, false},
+		{pgtype.BitOID, "10110011", "10110011", []byte{0xb3}, "10110011"},
+		// 11 bits, the rest of the second byte is padding
+		{pgtype.VarbitOID, "10110011101", "10110011101", []byte{0xb3, 0xa0}, "10110011101"},
+		{pgtype.VarbitOID, "1", "1", []byte{0x80}, true},
+		{pgtype.VarbitOID, "", "", []byte{}, ""},
+	}
+	for _, test := range tests {
+		field := column("flags", test.oid)
+		config := testConfig(t)
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); got != test.text {
+			t.Errorf("string %q: got %#v, want %q", test.raw, got, test.text)
+		}
+		config.Types.BitFormat = bitFormatBinary
+		got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config)
+		if binary, ok := got.(primitive.Binary); !ok || !bytes.Equal(binary.Data, test.data) {
+			t.Errorf("binary %q: got %#v, want %x", test.raw, got, test.data)
+		}
+		config.Types.BitFormat = bitFormatBoolean
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); got != test.boolean {
+			t.Errorf("boolean %q: got %#v, want %#v", test.raw, got, test.boolean)
+		}
+	}
+}
+
+func TestBitBinaryCopiesTheRowBuffer(t *testing.T) {
+	field := column("flags", pgtype.VarbitOID)
+	field.Format = pgtype.BinaryFormatCode
+	config := testConfig(t)
+	config.Types.BitFormat = bitFormatBinary
+	// 11 bits in binary format: the bit length, then the packed bits
+	raw := []byte{0, 0, 0, 11, 0xb3, 0xa0}
+	got, _ := convertColumn(t, field, raw, pgTypes{}, config)
+
+	// pgx reads the next row into the same buffer
+	copy(raw, []byte{0, 0, 0, 11, 0xff, 0xff})
+	want := primitive.Binary{Data: []byte{0xb3, 0xa0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v after reusing the buffer, want %#v", got, want)
+	}
+}
+
+func TestMoneyAndBitNull(t *testing.T) {
+	for _, format := range []string{bitFormatString, bitFormatBinary, bitFormatBoolean} {
+		config := testConfig(t)
+		config.Types.BitFormat = format
+		for _, oid := range []uint32{moneyOID, pgtype.BitOID, pgtype.VarbitOID} {
+			if got, _ := convertColumn(t, column("value", oid), nil, pgTypes{}, config); got != nil {
+				t.Errorf("%s NULL of type %d: got %#v, want nil", format, oid, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package migrator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+// ConnectToMongoDB establishes a connection to MongoDB, retrying as configured by migration.max_retries
+func ConnectToMongoDB(ctx context.Context, mongoConfig Config) (*mongo.Client, error) {
+	var client *mongo.Client
+	err := retryConnect(ctx, "MongoDB", mongoConfig, func() error {
+		var err error
+		client, err = connectToMongoDBOnce(ctx, mongoConfig)
+		return err
+	})
+	return client, err
+}
+
+// connectToMongoDBOnce makes a single connection attempt
+func connectToMongoDBOnce(ctx context.Context, mongoConfig Config) (*mongo.Client, error) {
+	clientOptions := options.Client().ApplyURI(mongoConfig.MongoDB.URI)
+	if mongoConfig.MongoDB.TLS.Enabled {
+		tlsConfig, err := buildMongoTLSConfig(mongoConfig)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+	if err := applyMongoAuth(clientOptions, mongoConfig); err != nil {
+		return nil, err
+	}
+	writeConcern, err := buildWriteConcern(mongoConfig)
+	if err != nil {
+		return nil, err
+	}
+	if writeConcern != nil {
+		clientOptions.SetWriteConcern(writeConcern)
+	}
+	if mongoConfig.MongoDB.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(mongoConfig.MongoDB.ReadPreference)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mongodb.read_preference: %v", err)
+		}
+		readPreference, err := readpref.New(mode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mongodb.read_preference: %v", err)
+		}
+		clientOptions.SetReadPreference(readPreference)
+	}
+	// Retryable writes resend a write once after a stepdown or network error; retryWrites=false in
+	// the URI turns them off
+	if clientOptions.RetryWrites == nil {
+		clientOptions.SetRetryWrites(true)
+	}
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the connection
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// buildMongoTLSConfig builds the TLS configuration of the mongodb.tls block, failing when
+// one of the referenced files cannot be read
+func buildMongoTLSConfig(mongoConfig Config) (*tls.Config, error) {
+	settings := mongoConfig.MongoDB.TLS
+	tlsConfig := &tls.Config{InsecureSkipVerify: settings.InsecureSkipVerify}
+
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading mongodb.tls.ca_file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mongodb.tls.ca_file %s contains no PEM certificates", settings.CAFile)
+		}
+	}
+
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		return nil, fmt.Errorf("mongodb.tls.cert_file and mongodb.tls.key_file must be set together")
+	}
+	if settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading mongodb.tls client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// MongoDB authentication mechanisms accepted by mongodb.auth_mechanism
+const (
+	authSCRAMSHA1   = "SCRAM-SHA-1"
+	authSCRAMSHA256 = "SCRAM-SHA-256"
+	authPlain       = "PLAIN"
+	authX509        = "MONGODB-X509"
+	authAWS         = "MONGODB-AWS"
+	authGSSAPI      = "GSSAPI"
+)
+
+// applyMongoAuth merges the credential settings of the mongodb block into the credential
+// parsed from the URI and checks that the result has what its mechanism needs. Without any
+// of those settings the URI is left to the driver.
+func applyMongoAuth(clientOptions *options.ClientOptions, mongoConfig Config) error {
+	settings := mongoConfig.MongoDB
+	if settings.AuthMechanism == "" && settings.AuthSource == "" && settings.Username == "" && settings.Password == "" {
+		return nil
+	}
+
+	var credential options.Credential
+	if clientOptions.Auth != nil {
+		credential = *clientOptions.Auth
+	} else if cs, err := connstring.Parse(mongoConfig.MongoDB.URI); err == nil {
+		// The driver keeps no credential for a URI without a user, but its authSource or
+		// database still name where the user of the config is defined
+		credential.AuthSource = cs.AuthSource
+		if credential.AuthSource == "" {
+			credential.AuthSource = cs.Database
+		}
+	}
+	if settings.AuthMechanism != "" {
+		credential.AuthMechanism = strings.ToUpper(settings.AuthMechanism)
+	}
+	if settings.AuthSource != "" {
+		credential.AuthSource = settings.AuthSource
+	}
+	if settings.Username != "" {
+		credential.Username = settings.Username
+	}
+	if settings.Password != "" {
+		credential.Password = settings.Password
+		credential.PasswordSet = true
+	}
+
+	mechanism := credential.AuthMechanism
+	if mechanism == "" {
+		mechanism = "the default mechanism"
+	}
+	switch credential.AuthMechanism {
+	case "", authSCRAMSHA1, authSCRAMSHA256, authPlain:
+		if credential.Username == "" {
+			return fmt.Errorf("MongoDB authentication with %s needs mongodb.username", mechanism)
+		}
+		if !credential.PasswordSet {
+			return fmt.Errorf("MongoDB authentication with %s needs mongodb.password", mechanism)
+		}
+	case authX509:
+		if credential.PasswordSet {
+			return fmt.Errorf("MongoDB authentication with %s does not take a password", mechanism)
+		}
+		if credential.AuthSource != "" && credential.AuthSource != "$external" {
+			return fmt.Errorf("MongoDB authentication with %s needs mongodb.auth_source $external, got %s", mechanism, credential.AuthSource)
+		}
+		if clientOptions.TLSConfig == nil || len(clientOptions.TLSConfig.Certificates) == 0 {
+			return fmt.Errorf("MongoDB authentication with %s needs a client certificate in mongodb.tls", mechanism)
+		}
+	case authGSSAPI:
+		if credential.Username == "" {
+			return fmt.Errorf("MongoDB authentication with %s needs mongodb.username", mechanism)
+		}
+	case authAWS:
+		if (credential.Username == "") != !credential.PasswordSet {
+			return fmt.Errorf("MongoDB authentication with %s needs mongodb.username and mongodb.password together, or neither", mechanism)
+		}
+	}
+
+	clientOptions.SetAuth(credential)
+	return nil
+}
+
+// buildWriteConcern returns the write concern of the mongodb.write_concern block, or nil when
+// the block is empty so the URI and driver defaults apply. A numeric w is a node count, any
+// other value such as majority is passed on as a mode or tag set name.
+func buildWriteConcern(mongoConfig Config) (*writeconcern.WriteConcern, error) {
+	settings := mongoConfig.MongoDB.WriteConcern
+	if settings.W == "" && settings.Journal == nil && settings.WTimeout == 0 {
+		return nil, nil
+	}
+
+	writeConcern := &writeconcern.WriteConcern{Journal: settings.Journal, WTimeout: settings.WTimeout}
+	if settings.W != "" {
+		if n, err := strconv.Atoi(settings.W); err == nil {
+			if n < 0 {
+				return nil, fmt.Errorf("invalid mongodb.write_concern.w %d: must not be negative", n)
+			}
+			writeConcern.W = n
+		} else {
+			writeConcern.W = settings.W
+		}
+	}
+	if settings.WTimeout < 0 {
+		return nil, fmt.Errorf("invalid mongodb.write_concern.wtimeout %s: must not be negative", settings.WTimeout)
+	}
+	if writeConcern.W == 0 && settings.Journal != nil && *settings.Journal {
+		return nil, fmt.Errorf("mongodb.write_concern.journal cannot be true with w: 0")
+	}
+	return writeConcern, nil
+}
+
+// databaseName is the MongoDB database of a table: its target_db, or mongodb.database
+func databaseName(table TableConfig, config Config) string {
+	if table.TargetDB != "" {
+		return table.TargetDB
+	}
+	return config.MongoDB.Database
+}
+
+// collectionName derives the MongoDB collection name of a table. An explicit collection
+// wins, otherwise the table name gets the configured prefix and suffix.
+func collectionName(table TableConfig, config Config) string {
+	if table.Collection != "" {
+		return table.Collection
+	}
+	return config.MongoDB.CollectionPrefix + bareTableName(table.Name, config) + config.MongoDB.CollectionSuffix
+}
+
+// bareTableName drops the schema from a table name unless mongodb.collection_include_schema is set
+func bareTableName(name string, config Config) string {
+	if !config.MongoDB.CollectionIncludeSchema {
+		_, bare, _ := splitTableName(name)
+		return bare
+	}
+	return name
+}
+
+// buildWriteModels turns documents whose first element is _id into upsert models for BulkWrite
+func buildWriteModels(documents []bson.D, mode string) []mongo.WriteModel {
+	models := make([]mongo.WriteModel, len(documents))
+	for i, document := range documents {
+		filter := bson.D{document[0]}
+		if mode == modeReplace {
+			models[i] = mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(document).SetUpsert(true)
+		} else {
+			// $set must not be empty, setting _id to its own value is a no-op
+			fields := document[1:]
+			if len(fields) == 0 {
+				fields = filter
+			}
+			update := bson.D{{Key: "$set", Value: fields}}
+			models[i] = mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true)
+		}
+	}
+	return models
+}
@@ -0,0 +1,60 @@
+package migrator
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Field naming styles (mongodb.field_naming)
+const (
+	fieldNamingPreserve = "preserve" // keep the PostgreSQL column name
+	fieldNamingCamel    = "camel"    // order_id -> orderId
+	fieldNamingPascal   = "pascal"   // order_id -> OrderId
+)
+
+// fieldName converts a snake_case column name to the configured naming style. Leading
+// underscores are kept, and words written in capitals (acronyms such as ID or HTTP) are
+// treated as ordinary words, so HTTP_STATUS becomes httpStatus.
+func fieldName(column, naming string) string {
+	if naming != fieldNamingCamel && naming != fieldNamingPascal {
+		return column
+	}
+
+	trimmed := strings.TrimLeft(column, "_")
+	prefix := column[:len(column)-len(trimmed)]
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	first := true
+	for _, word := range strings.Split(trimmed, "_") {
+		if word == "" {
+			continue
+		}
+		if strings.ToUpper(word) == word {
+			word = strings.ToLower(word)
+		}
+		runes := []rune(word)
+		if first && naming == fieldNamingCamel {
+			runes[0] = unicode.ToLower(runes[0])
+		} else {
+			runes[0] = unicode.ToUpper(runes[0])
+		}
+		b.WriteString(string(runes))
+		first = false
+	}
+	return b.String()
+}
+
+// fieldNames converts every column name of a table, warning when two columns end up with the same field name
+func fieldNames(table string, columns []string, naming string) []string {
+	names := make([]string, len(columns))
+	seen := make(map[string]string, len(columns))
+	for i, column := range columns {
+		names[i] = fieldName(column, naming)
+		if other, ok := seen[names[i]]; ok {
+			logger.Warn("Columns %s and %s of table %s both map to the field %s", other, column, table, names[i])
+		}
+		seen[names[i]] = column
+	}
+	return names
+}
@@ -0,0 +1,56 @@
+package migrator
+
+import "testing"
+
+func TestFieldName(t *testing.T) {
+	tests := []struct {
+		column string
+		camel  string
+		pascal string
+	}{
+		{"order_id", "orderId", "OrderId"},
+		{"id", "id", "Id"},
+		{"created_at_utc", "createdAtUtc", "CreatedAtUtc"},
+		{"HTTP_STATUS", "httpStatus", "HttpStatus"},
+		{"user_ID", "userId", "UserId"},
+		{"api_URL_path", "apiUrlPath", "ApiUrlPath"},
+		{"_id", "_id", "_Id"},
+		{"__private_field", "__privateField", "__PrivateField"},
+		{"a__b", "aB", "AB"},
+		{"trailing_", "trailing", "Trailing"},
+		{"orderId", "orderId", "OrderId"},
+		{"été_prévu", "étéPrévu", "ÉtéPrévu"},
+		{"__", "__", "__"},
+	}
+	for _, tt := range tests {
+		if got := fieldName(tt.column, fieldNamingPreserve); got != tt.column {
+			t.Errorf("fieldName(%q, preserve) = %q, want %q", tt.column, got, tt.column)
+		}
+		if got := fieldName(tt.column, fieldNamingCamel); got != tt.camel {
+			t.Errorf("fieldName(%q, camel) = %q, want %q", tt.column, got, tt.camel)
+		}
+		if got := fieldName(tt.column, fieldNamingPascal); got != tt.pascal {
+			t.Errorf("fieldName(%q, pascal) = %q, want %q", tt.column, got, tt.pascal)
+		}
+	}
+}
+
+func TestFieldNamesDeterministic(t *testing.T) {
+	columns := []string{"order_id", "HTTP_STATUS", "customer_name"}
+	first := fieldNames("public.orders", columns, fieldNamingCamel)
+	for i := 0; i < 10; i++ {
+		names := fieldNames("public.orders", columns, fieldNamingCamel)
+		for j := range names {
+			if names[j] != first[j] {
+				t.Fatalf("run %d: got %v, want %v", i, names, first)
+			}
+		}
+	}
+	want := []string{"orderId", "httpStatus", "customerName"}
+	for i := range want {
+		if first[i] != want[i] {
+			t.Errorf("fieldNames = %v, want %v", first, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package migrator
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Storage formats of inet and cidr columns (types.inet_format)
+const (
+	inetFormatString   = "string"   // text form of PostgreSQL, e.g. 192.168.0.1/24 or 2001:db8::1
+	inetFormatDocument = "document" // {address, prefix} sub-document
+)
+
+// inetConverter stores inet and cidr values in the configured format. PostgreSQL prints an inet
+// holding a single host without its prefix length, a cidr always with it.
+func inetConverter(format string, cidr bool) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		ipnet, ok := value.(*net.IPNet)
+		if !ok || ipnet == nil {
+			return nil, fmt.Errorf("unexpected inet value of type %T", value)
+		}
+		address := ipnet.IP.String()
+		prefix, bits := ipnet.Mask.Size()
+		if bits == 0 {
+			// An IPv4-mapped IPv6 address decodes to IPv4 with a mask pgx could not shorten
+			prefix, bits = len(ipnet.IP)*8, len(ipnet.IP)*8
+		}
+		if format == inetFormatDocument {
+			return bson.D{{Key: "address", Value: address}, {Key: "prefix", Value: int32(prefix)}}, nil
+		}
+		if prefix == bits && !cidr {
+			return address, nil
+		}
+		return address + "/" + strconv.Itoa(prefix), nil
+	}
+}
+
+// macaddrConverter stores macaddr values as lowercase colon-separated hex, e.g. 08:00:2b:01:02:03
+func macaddrConverter(value interface{}, raw []byte) (interface{}, error) {
+	addr, ok := value.(net.HardwareAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected macaddr value of type %T", value)
+	}
+	return addr.String(), nil
+}
@@ -0,0 +1,72 @@
+package migrator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestInetFormats(t *testing.T) {
+	tests := []struct {
+		oid     uint32
+		raw     string
+		text    string
+		address string
+		prefix  int32
+	}{
+		{pgtype.InetOID, "192.168.0.1", "192.168.0.1", "192.168.0.1", 32},
+		{pgtype.InetOID, "192.168.0.1/24", "192.168.0.1/24", "192.168.0.1", 24},
+		{pgtype.InetOID, "2001:db8::1", "2001:db8::1", "2001:db8::1", 128},
+		{pgtype.InetOID, "2001:db8::1/64", "2001:db8::1/64", "2001:db8::1", 64},
+		{pgtype.InetOID, "::ffff:10.0.0.1", "10.0.0.1", "10.0.0.1", 32},
+		// A cidr keeps its prefix length also for a single host
+		{pgtype.CIDROID, "10.0.0.0/8", "10.0.0.0/8", "10.0.0.0", 8},
+		{pgtype.CIDROID, "10.1.2.3/32", "10.1.2.3/32", "10.1.2.3", 32},
+		{pgtype.CIDROID, "2001:db8::/32", "2001:db8::/32", "2001:db8::", 32},
+	}
+	for _, test := range tests {
+		field := column("address", test.oid)
+		config := testConfig(t)
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); got != test.text {
+			t.Errorf("string %q: got %#v, want %q", test.raw, got, test.text)
+		}
+		config.Types.InetFormat = inetFormatDocument
+		want := bson.D{{Key: "address", Value: test.address}, {Key: "prefix", Value: test.prefix}}
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); !reflect.DeepEqual(got, want) {
+			t.Errorf("document %q: got %#v, want %v", test.raw, got, want)
+		}
+	}
+}
+
+func TestInetBinary(t *testing.T) {
+	field := column("address", pgtype.InetOID)
+	field.Format = pgtype.BinaryFormatCode
+	// family AF_INET, 24 bits, not cidr, 4 address bytes
+	raw := []byte{2, 24, 0, 4, 172, 16, 5, 9}
+	if got, _ := convertColumn(t, field, raw, pgTypes{}, testConfig(t)); got != "172.16.5.9/24" {
+		t.Errorf("got %#v, want 172.16.5.9/24", got)
+	}
+}
+
+func TestMacaddr(t *testing.T) {
+	field := column("mac", pgtype.MacaddrOID)
+	for _, raw := range []string{"08:00:2b:01:02:03", "08-00-2B-01-02-03", "0800.2b01.0203"} {
+		if got, _ := convertColumn(t, field, []byte(raw), pgTypes{}, testConfig(t)); got != "08:00:2b:01:02:03" {
+			t.Errorf("%q: got %#v, want 08:00:2b:01:02:03", raw, got)
+		}
+	}
+}
+
+func TestNetworkTypesNull(t *testing.T) {
+	for _, format := range []string{inetFormatString, inetFormatDocument} {
+		config := testConfig(t)
+		config.Types.InetFormat = format
+		for _, oid := range []uint32{pgtype.InetOID, pgtype.CIDROID, pgtype.MacaddrOID} {
+			if got, _ := convertColumn(t, column("address", oid), nil, pgTypes{}, config); got != nil {
+				t.Errorf("%s NULL of type %d: got %#v, want nil", format, oid, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package migrator
+
+import (
+	"github.com/jackc/pgproto3/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// documentNulls is how buildDocument treats NULL and empty column values
+type documentNulls struct {
+	omit              bool   // leave NULL columns out (mongodb.omit_nulls)
+	emptyStringAsNull bool   // store empty strings as NULL (mongodb.empty_string_as_null)
+	nullArrayAsEmpty  []bool // array columns whose NULL is stored as [] (mongodb.null_array_as_empty)
+}
+
+// newDocumentNulls reads the NULL handling of the result columns from the config
+func newDocumentNulls(fields []pgproto3.FieldDescription, types pgTypes, config Config) documentNulls {
+	nulls := documentNulls{omit: config.MongoDB.OmitNulls, emptyStringAsNull: config.MongoDB.EmptyStringAsNull}
+	if config.MongoDB.NullArrayAsEmpty {
+		nulls.nullArrayAsEmpty = make([]bool, len(fields))
+		for i, field := range fields {
+			_, array := arrayElementOIDs[field.DataTypeOID]
+			_, enumArray := types.enumArrays[field.DataTypeOID]
+			nulls.nullArrayAsEmpty[i] = array || enumArray
+		}
+	}
+	return nulls
+}
+
+// value is what the converted value of column i is stored as. An empty string becomes NULL
+// before a NULL array becomes [], so omit applies to the strings made NULL but not to the arrays.
+func (n documentNulls) value(i int, value interface{}) interface{} {
+	if s, ok := value.(string); ok && s == "" && n.emptyStringAsNull {
+		return nil
+	}
+	if value == nil && n.nullArrayAsEmpty != nil && n.nullArrayAsEmpty[i] {
+		return bson.A{}
+	}
+	return value
+}
@@ -0,0 +1,149 @@
+package migrator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// nullColumns are a column of each kind whose NULL must be stored the same way
+var nullColumns = []pgproto3.FieldDescription{
+	column("name", pgtype.TextOID),
+	column("quantity", pgtype.Int4OID),
+	column("created_at", pgtype.TimestamptzOID),
+	column("attributes", pgtype.JSONBOID),
+	column("tags", pgtype.TextArrayOID),
+}
+
+// nullRowDocument converts a row of NULLs given as values and builds its document, encoded to BSON.
+// With typed the raw values are not nil, so only the values tell the columns are NULL.
+func nullRowDocument(t *testing.T, values []interface{}, typed bool, config Config) bson.Raw {
+	t.Helper()
+	names := make([]string, len(nullColumns))
+	raw := make([][]byte, len(nullColumns))
+	for i, field := range nullColumns {
+		names[i] = string(field.Name)
+		if typed {
+			raw[i] = []byte{}
+		}
+	}
+	converters := buildConverters("public.test", nullColumns, pgTypes{}, config)
+	row, err := convertRow(converters, values, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := buildDocument(names, row, nil, nil, newDocumentNulls(nullColumns, pgTypes{}, config))
+	data, err := bson.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestNullColumns(t *testing.T) {
+	// pgx returns nil for NULL, but a nil of a typed pointer, slice or map must be stored the same
+	var (
+		text  *string
+		tags  []string
+		attrs map[string]interface{}
+	)
+	inputs := []struct {
+		name   string
+		values []interface{}
+		typed  bool
+	}{
+		{"untyped nil", []interface{}{nil, nil, nil, nil, nil}, false},
+		{"typed nil", []interface{}{text, (*int32)(nil), (*pgtype.Timestamptz)(nil), attrs, tags}, true},
+	}
+	for _, input := range inputs {
+		values, typed := input.values, input.typed
+		t.Run(input.name, func(t *testing.T) {
+			config := testConfig(t)
+			document := nullRowDocument(t, values, typed, config)
+			for _, field := range nullColumns {
+				value, err := document.LookupErr(string(field.Name))
+				if err != nil {
+					t.Errorf("%s: missing, want null", field.Name)
+					continue
+				}
+				if value.Type != bson.TypeNull {
+					t.Errorf("%s: got BSON type %s, want null", field.Name, value.Type)
+				}
+			}
+
+			config.MongoDB.OmitNulls = true
+			document = nullRowDocument(t, values, typed, config)
+			elements, err := document.Elements()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(elements) != 0 {
+				t.Errorf("omit_nulls: got %s, want an empty document", document)
+			}
+		})
+	}
+}
+
+func TestEmptyStringsAndNullArrays(t *testing.T) {
+	fields := []pgproto3.FieldDescription{
+		column("name", pgtype.TextOID),
+		column("note", pgtype.TextOID),
+		column("tags", pgtype.TextArrayOID),
+		column("labels", pgtype.TextArrayOID),
+		column("quantity", pgtype.Int4OID),
+	}
+	raw := [][]byte{[]byte(""), nil, nil, []byte("{}"), nil}
+	tests := []struct {
+		emptyStringAsNull bool
+		nullArrayAsEmpty  bool
+		want              bson.D
+	}{
+		{false, false, bson.D{{Key: "name", Value: ""}, {Key: "note", Value: nil}, {Key: "tags", Value: nil}, {Key: "labels", Value: bson.A{}}, {Key: "quantity", Value: nil}}},
+		{true, false, bson.D{{Key: "name", Value: nil}, {Key: "note", Value: nil}, {Key: "tags", Value: nil}, {Key: "labels", Value: bson.A{}}, {Key: "quantity", Value: nil}}},
+		{false, true, bson.D{{Key: "name", Value: ""}, {Key: "note", Value: nil}, {Key: "tags", Value: bson.A{}}, {Key: "labels", Value: bson.A{}}, {Key: "quantity", Value: nil}}},
+		{true, true, bson.D{{Key: "name", Value: nil}, {Key: "note", Value: nil}, {Key: "tags", Value: bson.A{}}, {Key: "labels", Value: bson.A{}}, {Key: "quantity", Value: nil}}},
+	}
+	for _, test := range tests {
+		config := testConfig(t)
+		config.MongoDB.EmptyStringAsNull = test.emptyStringAsNull
+		config.MongoDB.NullArrayAsEmpty = test.nullArrayAsEmpty
+		document := convertTextRow(t, fields, raw, config)
+		if !reflect.DeepEqual(document, test.want) {
+			t.Errorf("empty_string_as_null %v, null_array_as_empty %v: got %v, want %v", test.emptyStringAsNull, test.nullArrayAsEmpty, document, test.want)
+		}
+
+		// omit_nulls leaves out the strings made NULL but keeps the arrays made empty
+		config.MongoDB.OmitNulls = true
+		var want bson.D
+		for _, field := range test.want {
+			if field.Value != nil {
+				want = append(want, field)
+			}
+		}
+		if document := convertTextRow(t, fields, raw, config); !reflect.DeepEqual(document, want) {
+			t.Errorf("omit_nulls, empty_string_as_null %v, null_array_as_empty %v: got %v, want %v", test.emptyStringAsNull, test.nullArrayAsEmpty, document, want)
+		}
+	}
+}
+
+// convertTextRow decodes a row given in text format, nil for NULL, and builds its document
+func convertTextRow(t *testing.T, fields []pgproto3.FieldDescription, raw [][]byte, config Config) bson.D {
+	t.Helper()
+	rows := &fakeRows{fields: fields, rows: [][][]byte{raw}, index: 0}
+	values, err := rows.Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = string(field.Name)
+	}
+	row, err := convertRow(buildConverters("public.test", fields, pgTypes{}, config), values, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buildDocument(names, row, nil, nil, newDocumentNulls(fields, pgTypes{}, config))
+}
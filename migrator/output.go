@@ -0,0 +1,225 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Destinations of the documents (output.target)
+const (
+	outputMongo = "mongo" // insert into MongoDB
+	outputJSONL = "jsonl" // write newline-delimited extended JSON to output.path
+	outputBSON  = "bson"  // write mongodump-compatible <database>/<collection>.bson files under output.path
+)
+
+// stdoutPath is the output.path writing every document to stdout
+const stdoutPath = "-"
+
+// WritesToMongoDB reports whether the documents go to MongoDB, which needs a MongoDB connection
+func (c Config) WritesToMongoDB() bool {
+	return c.Output.Target != outputJSONL && c.Output.Target != outputBSON
+}
+
+// WritesDocumentsToStdout reports whether the documents are written to stdout, where nothing else
+// may then be printed
+func (c Config) WritesDocumentsToStdout() bool {
+	return c.Output.Target == outputJSONL && (c.Output.Path == "" || c.Output.Path == stdoutPath)
+}
+
+// fileOutput writes the documents of a run to files instead of MongoDB. With jsonl every document
+// is a line of relaxed extended JSON, on stdout or in a <collection>.jsonl file per collection in a
+// directory. With bson the documents are concatenated BSON in <database>/<collection>.bson, the
+// layout mongodump writes and mongorestore reads. It is safe for the concurrent workers of a run.
+type fileOutput struct {
+	mu      sync.Mutex
+	format  string // outputJSONL or outputBSON
+	dir     string // empty for stdout
+	stdout  *bufio.Writer
+	files   map[string]*os.File
+	writers map[string]*bufio.Writer
+}
+
+// newFileOutput creates the output configured by output.target and output.path, creating the
+// directory if needed
+func newFileOutput(config Config) (*fileOutput, error) {
+	out := &fileOutput{format: config.Output.Target, files: map[string]*os.File{}, writers: map[string]*bufio.Writer{}}
+	path := config.Output.Path
+	if out.format == outputJSONL && (path == "" || path == stdoutPath) {
+		out.stdout = bufio.NewWriter(os.Stdout)
+		return out, nil
+	}
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating the output directory %s: %v", path, err)
+	}
+	out.dir = path
+	return out, nil
+}
+
+// writer returns the writer of a collection, opening its file for appending on first use
+func (o *fileOutput) writer(collection string) (*bufio.Writer, error) {
+	if o.stdout != nil {
+		return o.stdout, nil
+	}
+	if w, ok := o.writers[collection]; ok {
+		return w, nil
+	}
+	name := o.fileName(collection)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating the output directory of collection %s: %v", collection, err)
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening the output file of collection %s: %v", collection, err)
+	}
+	o.files[collection] = file
+	o.writers[collection] = bufio.NewWriter(file)
+	return o.writers[collection], nil
+}
+
+// fileName is the file the documents of a collection are written to. The collections of a bson
+// output are keyed <database>/<collection>.
+func (o *fileOutput) fileName(collection string) string {
+	return filepath.Join(o.dir, collection+"."+o.format)
+}
+
+// write appends documents to the output of a collection. No document only creates the file.
+func (o *fileOutput) write(collection string, documents []interface{}) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	w, err := o.writer(collection)
+	if err != nil {
+		return err
+	}
+	for _, document := range documents {
+		encoded, err := o.encode(document)
+		if err != nil {
+			return fmt.Errorf("error encoding a document of collection %s: %v", collection, err)
+		}
+		if _, err := w.Write(encoded); err != nil {
+			return fmt.Errorf("error writing to the output of collection %s: %v", collection, err)
+		}
+	}
+	// stdout is flushed per batch so the lines of concurrent tables never mix
+	if o.stdout != nil {
+		return o.stdout.Flush()
+	}
+	return nil
+}
+
+// encode returns a document as a JSON line or as BSON, which already carries its own length
+func (o *fileOutput) encode(document interface{}) ([]byte, error) {
+	if o.format == outputBSON {
+		return bson.Marshal(document)
+	}
+	line, err := bson.MarshalExtJSON(document, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// truncate empties the file of a collection, the counterpart of dropping the collection
+func (o *fileOutput) truncate(collection string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stdout != nil {
+		return nil
+	}
+	if w, ok := o.writers[collection]; ok {
+		w.Reset(o.files[collection])
+		return o.files[collection].Truncate(0)
+	}
+	if err := os.Truncate(o.fileName(collection), 0); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error truncating the output file of collection %s: %v", collection, err)
+	}
+	return nil
+}
+
+// Close flushes and closes every output file
+func (o *fileOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stdout != nil {
+		return o.stdout.Flush()
+	}
+	var firstErr error
+	for collection, file := range o.files {
+		if err := o.writers[collection].Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	o.files, o.writers = map[string]*os.File{}, map[string]*bufio.Writer{}
+	return firstErr
+}
+
+// sink returns the DocSink of a collection. jsonl files are named by the collection alone, bson
+// files go into the directory of their database.
+func (o *fileOutput) sink(database, collection string) fileSink {
+	if o.format == outputBSON {
+		collection = filepath.Join(database, collection)
+	}
+	return fileSink{out: o, collection: collection}
+}
+
+// fileSink is the DocSink writing one collection to a fileOutput
+type fileSink struct {
+	out        *fileOutput
+	collection string
+}
+
+var _ DocSink = fileSink{}
+
+// InsertOne writes a document; the empty document transferTable inserts for empty tables only
+// creates the file, like the empty collection it creates in MongoDB
+func (s fileSink) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if d, ok := document.(bson.D); ok && len(d) == 0 {
+		return &mongo.InsertOneResult{}, s.out.write(s.collection, nil)
+	}
+	return &mongo.InsertOneResult{}, s.out.write(s.collection, []interface{}{document})
+}
+
+// InsertMany writes the documents in order
+func (s fileSink) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	return &mongo.InsertManyResult{}, s.out.write(s.collection, documents)
+}
+
+// BulkWrite writes the complete document of every upsert and replace model built by
+// buildWriteModels; a file cannot update earlier lines, so each write is a new line
+func (s fileSink) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	documents := make([]interface{}, len(models))
+	for i, model := range models {
+		switch m := model.(type) {
+		case *mongo.ReplaceOneModel:
+			documents[i] = m.Replacement
+		case *mongo.UpdateOneModel:
+			filter, _ := m.Filter.(bson.D)
+			update, _ := m.Update.(bson.D)
+			document := append(bson.D{}, filter...)
+			if len(update) == 1 {
+				if fields, ok := update[0].Value.(bson.D); ok && !(len(fields) == 1 && fields[0].Key == "_id") {
+					document = append(document, fields...)
+				}
+			}
+			documents[i] = document
+		default:
+			return nil, fmt.Errorf("unsupported write model %T for the file output", model)
+		}
+	}
+	return &mongo.BulkWriteResult{}, s.out.write(s.collection, documents)
+}
+
+// Drop empties the file of the collection, so drop_before_import rewrites it instead of appending
+func (s fileSink) Drop(ctx context.Context) error {
+	return s.out.truncate(s.collection)
+}
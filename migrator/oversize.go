@@ -0,0 +1,116 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxDocumentSize is the largest BSON document MongoDB stores (maxBsonObjectSize)
+const maxDocumentSize = 16 * 1024 * 1024
+
+// Handling of documents bigger than maxDocumentSize (mongodb.oversized_documents)
+const (
+	oversizedFail     = "fail"     // fail the table, or dead-letter the row with continue_on_error
+	oversizedSkip     = "skip"     // dead-letter the row and go on
+	oversizedTruncate = "truncate" // cut mongodb.truncate_fields until the document fits
+)
+
+// oversizedError is the conversion error of a row whose document MongoDB would refuse
+type oversizedError struct {
+	reason string
+}
+
+func (e *oversizedError) Error() string {
+	return e.reason
+}
+
+// skipsOversized reports whether err is an oversized document that mongodb.oversized_documents: skip dead-letters
+func skipsOversized(err error, config Config) bool {
+	var oversized *oversizedError
+	return config.MongoDB.OversizedDocuments == oversizedSkip && errors.As(err, &oversized)
+}
+
+// bsonSize is the size of a document, estimated by documentSize and encoded exactly once the
+// estimate comes within a factor of two of maxDocumentSize
+func bsonSize(document bson.D) int {
+	size := documentSize(document)
+	if size < maxDocumentSize/2 {
+		return size
+	}
+	if data, err := bson.Marshal(document); err == nil {
+		return len(data)
+	}
+	return size
+}
+
+// fitDocument applies mongodb.oversized_documents to the document of a row and returns its size.
+// A document that still does not fit fails with an oversizedError naming the row, its _id and size.
+func fitDocument(document bson.D, row int64, key interface{}, config Config) (int, error) {
+	size := bsonSize(document)
+	if size <= maxDocumentSize {
+		return size, nil
+	}
+	reason := fmt.Sprintf("document of row %d (_id %v) is %d bytes, more than the %d MongoDB accepts", row, key, size, maxDocumentSize)
+	if config.MongoDB.OversizedDocuments != oversizedTruncate {
+		return size, &oversizedError{reason: reason}
+	}
+
+	fitted, truncated := truncateDocument(document, config.MongoDB.TruncateFields, size)
+	if fitted > maxDocumentSize {
+		return fitted, &oversizedError{reason: fmt.Sprintf("%s, still %d bytes after truncating mongodb.truncate_fields", reason, fitted)}
+	}
+	logger.Warn("Truncated %s of row %d (_id %v): the document was %d bytes and is now %d", strings.Join(truncated, ", "), row, key, size, fitted)
+	return fitted, nil
+}
+
+// truncateDocument shortens the given fields of a document, in their order, until it fits
+// maxDocumentSize. Strings and binary values are cut to the bytes that fit, other values are
+// replaced with null. It returns the new size and the names of the fields it changed.
+func truncateDocument(document bson.D, fields []string, size int) (int, []string) {
+	var truncated []string
+	for _, field := range fields {
+		if size <= maxDocumentSize {
+			break
+		}
+		for i := range document {
+			if document[i].Key != field || document[i].Value == nil {
+				continue
+			}
+			excess := size - maxDocumentSize
+			switch v := document[i].Value.(type) {
+			case string:
+				document[i].Value = truncateString(v, len(v)-excess)
+			case []byte:
+				document[i].Value = v[:max(len(v)-excess, 0)]
+			case primitive.Binary:
+				v.Data = v.Data[:max(len(v.Data)-excess, 0)]
+				document[i].Value = v
+			default:
+				document[i].Value = nil
+			}
+			truncated = append(truncated, field)
+			size = bsonSize(document)
+			break
+		}
+	}
+	return size, truncated
+}
+
+// truncateString cuts s to at most n bytes without splitting a UTF-8 sequence
+func truncateString(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,138 @@
+package migrator
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// writeBatch is a batch of documents on its way to MongoDB, with what the state file records once it is written
+type writeBatch struct {
+	documents []bson.D
+	// Row numbers and source keys (see keyValue) of the documents, for dead-letter entries
+	rows []int64
+	keys []interface{}
+	// Raw incremental column and page key of the last row read before the batch was flushed
+	watermark, pageKey []byte
+
+	seq int
+}
+
+// writePipeline writes the batches of one table with several writers while the reader
+// goes on scanning rows. The channel holds at most queue batches, so a reader that is
+// faster than MongoDB waits for the writers.
+type writePipeline struct {
+	batches chan *writeBatch
+	writers sync.WaitGroup
+	store   func(*writeBatch) error
+	save    func(*writeBatch) error
+
+	mu sync.Mutex
+	// Sequence numbers of the next batch sent and the next one whose state is saved
+	sent, saved int
+	// Batches written out of order, waiting for the ones before them
+	written map[int]*writeBatch
+	// err is the error of the earliest failed batch
+	err    error
+	errSeq int
+	closed bool
+}
+
+// newWritePipeline starts writers goroutines that store the batches sent to the pipeline.
+// save runs in batch order once a batch and all batches before it are stored.
+func newWritePipeline(writers, queue int, store, save func(*writeBatch) error) *writePipeline {
+	p := &writePipeline{
+		batches: make(chan *writeBatch, queue),
+		store:   store,
+		save:    save,
+		written: make(map[int]*writeBatch),
+	}
+	for i := 0; i < writers; i++ {
+		p.writers.Add(1)
+		go p.run()
+	}
+	return p
+}
+
+func (p *writePipeline) run() {
+	defer p.writers.Done()
+	for b := range p.batches {
+		// After a failure the remaining batches are drained without writing them
+		if p.failed() {
+			continue
+		}
+		p.done(b, p.store(b))
+	}
+}
+
+func (p *writePipeline) failed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err != nil
+}
+
+// done records a stored batch and saves the state of every batch that is now written
+// together with all batches before it
+func (p *writePipeline) done(b *writeBatch, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.fail(b.seq, err)
+		return
+	}
+	p.written[b.seq] = b
+	for {
+		next, ok := p.written[p.saved]
+		if !ok {
+			return
+		}
+		delete(p.written, p.saved)
+		if err := p.save(next); err != nil {
+			p.fail(next.seq, err)
+			return
+		}
+		p.saved++
+	}
+}
+
+// fail keeps the error of the earliest batch, so the error reported is the one a serial transfer would hit first
+func (p *writePipeline) fail(seq int, err error) {
+	if p.err == nil || seq < p.errSeq {
+		p.err, p.errSeq = err, seq
+	}
+}
+
+// send queues a batch, waiting while the queue is full. It fails once a batch could not be written.
+func (p *writePipeline) send(ctx context.Context, b *writeBatch) error {
+	p.mu.Lock()
+	err := p.err
+	b.seq = p.sent
+	p.sent++
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case p.batches <- b:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close waits for the writers to finish the queued batches and returns the error of the earliest failed one
+func (p *writePipeline) close() error {
+	p.mu.Lock()
+	closed := p.closed
+	p.closed = true
+	p.mu.Unlock()
+	if !closed {
+		close(p.batches)
+	}
+	p.writers.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
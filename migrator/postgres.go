@@ -0,0 +1,605 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ConnectToPostgreSQL establishes a connection to PostgreSQL, retrying as configured by migration.max_retries
+func ConnectToPostgreSQL(ctx context.Context, pgConfig Config) (*pgxpool.Pool, error) {
+	var pool *pgxpool.Pool
+	err := retryConnect(ctx, "PostgreSQL", pgConfig, func() error {
+		var err error
+		pool, err = connectToPostgreSQLOnce(ctx, pgConfig)
+		return err
+	})
+	return pool, err
+}
+
+// connectToPostgreSQLOnce makes a single connection attempt
+func connectToPostgreSQLOnce(ctx context.Context, pgConfig Config) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(connectionString(pgConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	poolConfig.MaxConns = pgConfig.Postgres.PoolMaxConns
+	poolConfig.MinConns = pgConfig.Postgres.PoolMinConns
+	if pgConfig.Postgres.PoolMaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = pgConfig.Postgres.PoolMaxConnLifetime
+	}
+	if pgConfig.Postgres.PoolMaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = pgConfig.Postgres.PoolMaxConnIdleTime
+	}
+	// The server cancels statements running longer than this, whatever the context of the query
+	if timeout := pgConfig.Postgres.StatementTimeout; timeout > 0 {
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(timeout.Milliseconds(), 10)
+	}
+	// pgx prepares and caches every query on its connection by default, so the page query of a
+	// paginated table is parsed once per connection; without the cache each query is parsed
+	// anew, which also works behind pgbouncer
+	if !pgConfig.Postgres.PrepareStatements {
+		poolConfig.ConnConfig.BuildStatementCache = nil
+	}
+
+	// The password is set after parsing so that it may contain spaces and quotes. A dsn with a
+	// password of its own keeps it.
+	password := pgConfig.Postgres.Password
+	if password == "" && pgConfig.Postgres.PasswordEnv != "" {
+		password = os.Getenv(pgConfig.Postgres.PasswordEnv)
+	}
+	if password != "" && (pgConfig.Postgres.DSN == "" || poolConfig.ConnConfig.Password == "") {
+		poolConfig.ConnConfig.Password = password
+	}
+
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// connectionString returns postgres.dsn as it is, or assembles a connection string from the
+// host, port, database, user and SSL settings
+func connectionString(pgConfig Config) string {
+	if pgConfig.Postgres.DSN != "" {
+		return pgConfig.Postgres.DSN
+	}
+	connStr := fmt.Sprintf("host=%s port=%d dbname=%s user=%s",
+		pgConfig.Postgres.Host, pgConfig.Postgres.Port, pgConfig.Postgres.Database, pgConfig.Postgres.User)
+	for key, value := range map[string]string{
+		"sslmode":     pgConfig.Postgres.SSLMode,
+		"sslrootcert": pgConfig.Postgres.SSLRootCert,
+		"sslcert":     pgConfig.Postgres.SSLCert,
+		"sslkey":      pgConfig.Postgres.SSLKey,
+	} {
+		if value != "" {
+			connStr += " " + key + "=" + quoteConnValue(value)
+		}
+	}
+	return connStr
+}
+
+// quoteConnValue quotes a connection string value so that it may contain spaces and quotes
+func quoteConnValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", `\'`) + "'"
+}
+
+// GetAllPostgresTables retrieves all schema-qualified table names in postgres.schemas, optionally
+// including views and materialized views. System tables (those of the pg_ schemas and
+// information_schema, and the tables an extension created) are left out unless
+// postgres.include_system_tables is set, unlogged tables with postgres.include_unlogged_tables: false,
+// and temporary tables always, since only the session that created them can read them.
+// postgres.all_tables_query replaces all of this, see customTables.
+func GetAllPostgresTables(ctx context.Context, pgConn RowSource, config Config) ([]string, error) {
+	if config.Postgres.AllTablesQuery != "" {
+		return customTables(ctx, pgConn, config)
+	}
+
+	query := `
+		SELECT r.schema_name, r.table_name, c.relpersistence::text,
+			EXISTS (
+				SELECT 1 FROM pg_depend d
+				WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e'
+			)
+		FROM (
+			SELECT table_schema, table_name
+			FROM information_schema.tables
+			WHERE table_schema = ANY($1) AND (table_type = 'BASE TABLE' OR ($2 AND table_type = 'VIEW'))
+			UNION ALL
+			SELECT schemaname, matviewname
+			FROM pg_matviews
+			WHERE $3 AND schemaname = ANY($1)
+		) AS r(schema_name, table_name)
+		JOIN pg_namespace n ON n.nspname = r.schema_name
+		JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = r.table_name
+		ORDER BY 1, 2
+	`
+
+	rows, err := pgConn.Query(ctx, query, config.Postgres.Schemas, config.Postgres.IncludeViews, config.Postgres.IncludeMaterializedViews)
+	if err != nil {
+		return nil, fmt.Errorf("error querying PostgreSQL for table names: %v", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	// Number of left out tables by reason
+	left := map[string]int{}
+	var reasons []string
+	for rows.Next() {
+		var schemaName, tableName string
+		var persistence string
+		var extension bool
+		if err := rows.Scan(&schemaName, &tableName, &persistence, &extension); err != nil {
+			return nil, fmt.Errorf("error scanning table name: %v", err)
+		}
+		name := joinTableName(schemaName, tableName)
+
+		reason := ""
+		switch {
+		case persistence == "t":
+			reason = "temporary"
+		case !config.Postgres.IncludeSystemTables && (extension || isSystemSchema(schemaName)):
+			reason = "system"
+		case persistence == "u" && !config.Postgres.IncludeUnloggedTables:
+			reason = "unlogged"
+		}
+		if reason == "" {
+			tables = append(tables, name)
+			continue
+		}
+		logger.Debug("Leaving out %s table %s", reason, name)
+		if left[reason] == 0 {
+			reasons = append(reasons, reason)
+		}
+		left[reason]++
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating table names: %v", err)
+	}
+
+	if len(reasons) > 0 {
+		counts := make([]string, len(reasons))
+		total := 0
+		for i, reason := range reasons {
+			counts[i] = fmt.Sprintf("%d %s", left[reason], reason)
+			total += left[reason]
+		}
+		logger.Info("Left out %d table(s) of all_tables: %s", total, strings.Join(counts, ", "))
+	}
+	return tables, nil
+}
+
+// customTables runs postgres.all_tables_query, which must return a single text column named
+// table_name. Names without a schema are in the first of postgres.schemas, and a name returned
+// twice is used once. None of the filters of GetAllPostgresTables apply.
+func customTables(ctx context.Context, pgConn RowSource, config Config) ([]string, error) {
+	rows, err := pgConn.Query(ctx, config.Postgres.AllTablesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error running postgres.all_tables_query: %v", err)
+	}
+	defer rows.Close()
+
+	fields := rows.FieldDescriptions()
+	if len(fields) != 1 || string(fields[0].Name) != "table_name" {
+		names := make([]string, len(fields))
+		for i, field := range fields {
+			names[i] = string(field.Name)
+		}
+		return nil, fmt.Errorf("postgres.all_tables_query must return a single table_name column, got %d column(s) (%s)", len(fields), strings.Join(names, ", "))
+	}
+
+	var tables []string
+	seen := map[string]bool{}
+	for rows.Next() {
+		var name *string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("postgres.all_tables_query: table_name must be text: %v", err)
+		}
+		if name == nil || *name == "" {
+			return nil, fmt.Errorf("postgres.all_tables_query returned a NULL or empty table_name")
+		}
+		qualified := qualifyTableName(*name, config.Postgres.Schemas[0])
+		if !seen[qualified] {
+			seen[qualified] = true
+			tables = append(tables, qualified)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error running postgres.all_tables_query: %v", err)
+	}
+	logger.Info("postgres.all_tables_query returned %d table(s).", len(tables))
+	return tables, nil
+}
+
+// isSystemSchema reports whether a schema belongs to PostgreSQL itself: pg_catalog, pg_toast,
+// the temporary schemas and information_schema
+func isSystemSchema(schema string) bool {
+	return strings.HasPrefix(schema, "pg_") || schema == "information_schema"
+}
+
+// Handling of configured tables that do not exist (postgres.missing_tables)
+const (
+	missingTablesFail = "fail" // stop before migrating anything
+	missingTablesSkip = "skip" // warn and migrate the others
+)
+
+// missingTables returns the schema-qualified names that are neither a table, view, foreign table
+// nor materialized view visible to the user
+func missingTables(ctx context.Context, pgConn RowSource, names []string) ([]string, error) {
+	schemas := make([]string, len(names))
+	tables := make([]string, len(names))
+	for i, name := range names {
+		schemas[i], tables[i], _ = splitTableName(name)
+	}
+
+	query := `
+		SELECT wanted.n
+		FROM unnest($1::text[], $2::text[]) WITH ORDINALITY AS wanted(schema_name, table_name, n)
+		WHERE NOT EXISTS (
+			SELECT 1 FROM information_schema.tables
+			WHERE table_schema = wanted.schema_name AND table_name = wanted.table_name
+		) AND NOT EXISTS (
+			SELECT 1 FROM pg_matviews
+			WHERE schemaname = wanted.schema_name AND matviewname = wanted.table_name
+		)
+	`
+
+	rows, err := pgConn.Query(ctx, query, schemas, tables)
+	if err != nil {
+		return nil, fmt.Errorf("error checking that the tables exist: %v", err)
+	}
+	defer rows.Close()
+
+	var missing []string
+	for rows.Next() {
+		var n int64
+		if err := rows.Scan(&n); err != nil {
+			return nil, fmt.Errorf("error scanning table name: %v", err)
+		}
+		missing = append(missing, names[n-1])
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating table names: %v", err)
+	}
+	return missing, nil
+}
+
+// relationKind describes the kind of a schema-qualified relation for log messages
+func relationKind(ctx context.Context, pgConn RowSource, table string) (string, error) {
+	query := `
+		SELECT CASE relkind
+			WHEN 'v' THEN 'view'
+			WHEN 'm' THEN 'materialized view'
+			WHEN 'f' THEN 'foreign table'
+			ELSE 'table'
+		END
+		FROM pg_class
+		WHERE oid = $1::regclass
+	`
+
+	var kind string
+	if err := pgConn.QueryRow(ctx, query, quoteTableName(table)).Scan(&kind); err != nil {
+		return "", fmt.Errorf("error looking up relation %s: %v", table, err)
+	}
+	return kind, nil
+}
+
+// quoteIdentifier wraps a PostgreSQL identifier in double quotes and escapes embedded quotes
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteTableName quotes a table name, treating an optional "schema." prefix as its own identifier
+func quoteTableName(name string) string {
+	schema, table, qualified := splitTableName(name)
+	if qualified {
+		return quoteIdentifier(schema) + "." + quoteIdentifier(table)
+	}
+	return quoteIdentifier(table)
+}
+
+// splitTableName parses a table name of the config or the catalog into its schema and table. A part
+// holding a dot is written in double quotes with embedded quotes doubled, like "my.table" or
+// "my.schema"."Order"; unquoted parts are taken as they are, keeping their case.
+func splitTableName(name string) (schema, table string, qualified bool) {
+	first, rest := parseNamePart(name)
+	if !strings.HasPrefix(rest, ".") {
+		return "", first, false
+	}
+	rest = rest[1:]
+	if strings.HasPrefix(rest, `"`) {
+		rest, _ = parseNamePart(rest)
+	}
+	return first, rest, true
+}
+
+// parseNamePart reads the first part of a table name up to the dot after it, removing the quotes
+// of a quoted part. An unterminated quote runs to the end of the name.
+func parseNamePart(name string) (part, rest string) {
+	if !strings.HasPrefix(name, `"`) {
+		if i := strings.Index(name, "."); i >= 0 {
+			return name[:i], name[i:]
+		}
+		return name, ""
+	}
+	var b strings.Builder
+	for i := 1; i < len(name); i++ {
+		if name[i] != '"' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+1 < len(name) && name[i+1] == '"' {
+			b.WriteByte('"')
+			i++
+			continue
+		}
+		return b.String(), name[i+1:]
+	}
+	return b.String(), ""
+}
+
+// qualifyTableName prefixes a bare table name with the given schema
+func qualifyTableName(name, schema string) string {
+	tableSchema, table, qualified := splitTableName(name)
+	if !qualified {
+		tableSchema = schema
+	}
+	return joinTableName(tableSchema, table)
+}
+
+// joinTableName builds the schema-qualified name splitTableName parses, quoting only the parts that
+// need it so that plain names stay readable in logs and collection names
+func joinTableName(schema, table string) string {
+	part := func(s string) string {
+		if strings.Contains(s, ".") || strings.HasPrefix(s, `"`) {
+			return quoteIdentifier(s)
+		}
+		return s
+	}
+	return part(schema) + "." + part(table)
+}
+
+// getTableColumns retrieves the column names of a schema-qualified table, view or
+// materialized view in ordinal order
+func getTableColumns(ctx context.Context, pgConn RowSource, table string) ([]string, error) {
+	// pg_attribute rather than information_schema.columns, which leaves out materialized views
+	query := `
+		SELECT attname
+		FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped
+		ORDER BY attnum
+	`
+
+	rows, err := pgConn.Query(ctx, query, quoteTableName(table))
+	if err != nil {
+		return nil, fmt.Errorf("error querying PostgreSQL for column names: %v", err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var columnName string
+		if err := rows.Scan(&columnName); err != nil {
+			return nil, fmt.Errorf("error scanning column name: %v", err)
+		}
+		columns = append(columns, columnName)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating column names: %v", err)
+	}
+
+	return columns, nil
+}
+
+// resolveColumns applies a table's include/exclude lists to its actual columns.
+// It returns nil when neither list is set, meaning every column is selected.
+func resolveColumns(ctx context.Context, pgConn RowSource, table TableConfig) ([]string, error) {
+	if len(table.Include) == 0 && len(table.Exclude) == 0 {
+		return nil, nil
+	}
+
+	columns, err := getTableColumns(ctx, pgConn, table.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		existing[column] = true
+	}
+	for _, column := range append(table.Include, table.Exclude...) {
+		if !existing[column] {
+			return nil, fmt.Errorf("column %s does not exist in table %s", column, table.Name)
+		}
+	}
+
+	if len(table.Include) > 0 {
+		return table.Include, nil
+	}
+
+	excluded := make(map[string]bool, len(table.Exclude))
+	for _, column := range table.Exclude {
+		excluded[column] = true
+	}
+	var selected []string
+	for _, column := range columns {
+		if !excluded[column] {
+			selected = append(selected, column)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("every column of table %s is excluded", table.Name)
+	}
+	return selected, nil
+}
+
+// buildSelectQuery builds the query that reads a table, selecting the given columns
+// (all columns when empty) and applying its optional WHERE filter and watermark.
+// Rows are ordered by the watermark column when one is given, and limit caps the row count when positive;
+// otherwise the table's own limit applies, in random order with random_sample.
+func buildSelectQuery(table TableConfig, columns []string, wm *watermark, limit int) (string, []interface{}) {
+	if table.Query != "" && table.Limit > 0 {
+		return fmt.Sprintf("SELECT * FROM (%s) AS source%s LIMIT %d", table.Query, sampleOrder(table), table.Limit), nil
+	}
+	if table.Query != "" {
+		return table.Query, nil
+	}
+
+	projection := "*"
+	if table.projection != "" {
+		projection = table.projection
+	} else if len(columns) > 0 {
+		quoted := make([]string, len(columns))
+		for i, column := range columns {
+			quoted[i] = quoteIdentifier(column)
+		}
+		projection = strings.Join(quoted, ", ")
+	}
+
+	var conditions []string
+	var args []interface{}
+	if table.Where != "" {
+		conditions = append(conditions, "("+table.Where+")")
+	}
+	if wm != nil && wm.hasValue {
+		args = append(args, wm.value)
+		conditions = append(conditions, wm.condition(fmt.Sprintf("$%d", len(args))))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", projection, quoteTableName(table.Name))
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if wm != nil {
+		query += " ORDER BY " + quoteIdentifier(wm.column)
+	} else {
+		query += sampleOrder(table)
+	}
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	} else if table.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", table.Limit)
+	}
+	return query, args
+}
+
+// sampleOrder is the ORDER BY of a random sample, empty for other tables
+func sampleOrder(table TableConfig) string {
+	if table.Limit > 0 && table.RandomSample {
+		return " ORDER BY random()"
+	}
+	return ""
+}
+
+// getPrimaryKeyColumns retrieves the primary key columns of a schema-qualified table in key order
+func getPrimaryKeyColumns(ctx context.Context, pgConn RowSource, table string) ([]string, error) {
+	query := `
+		SELECT a.attname
+		FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = $1::regclass AND i.indisprimary
+		ORDER BY array_position(i.indkey::int2[], a.attnum)
+	`
+
+	rows, err := pgConn.Query(ctx, query, quoteTableName(table))
+	if err != nil {
+		return nil, fmt.Errorf("error querying PostgreSQL for primary key: %v", err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var columnName string
+		if err := rows.Scan(&columnName); err != nil {
+			return nil, fmt.Errorf("error scanning primary key column: %v", err)
+		}
+		columns = append(columns, columnName)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating primary key columns: %v", err)
+	}
+
+	return columns, nil
+}
+
+// tableIDColumns returns the id_column or id_columns of a table entry
+func tableIDColumns(table TableConfig) []string {
+	if table.IDColumn != "" {
+		return []string{table.IDColumn}
+	}
+	return table.IDColumns
+}
+
+// existingIDColumn returns the column of a table named _id, or else the one named id, and an empty
+// string when it has neither. The result columns of a custom query are not known in advance.
+func existingIDColumn(ctx context.Context, pgConn RowSource, table TableConfig) (string, error) {
+	if table.Query != "" {
+		return "", nil
+	}
+	columns, err := getTableColumns(ctx, pgConn, table.Name)
+	if err != nil {
+		return "", err
+	}
+	found := ""
+	for _, column := range columns {
+		if column == "_id" {
+			return column, nil
+		}
+		if column == "id" {
+			found = column
+		}
+	}
+	return found, nil
+}
+
+// resolveIDColumns returns the columns whose values make up the MongoDB _id of a table, following
+// mongodb.id_column_policy and then mongodb.id_strategy. The id_column or id_columns of the table
+// entry always win; nil means _id is left to MongoDB.
+func resolveIDColumns(ctx context.Context, pgConn RowSource, table TableConfig, config Config) ([]string, error) {
+	if columns := tableIDColumns(table); len(columns) > 0 {
+		return columns, nil
+	}
+	switch config.MongoDB.IDColumnPolicy {
+	case idPolicyAlwaysObjectID:
+		return nil, nil
+	case idPolicyUseIDColumn:
+		column, err := existingIDColumn(ctx, pgConn, table)
+		if err != nil || column != "" {
+			return []string{column}, err
+		}
+	}
+	strategy := config.idStrategy()
+	switch {
+	case (strategy == idStrategyFromColumns || strategy == idStrategyHash) && len(config.MongoDB.IDColumns) > 0:
+		return config.MongoDB.IDColumns, nil
+	case strategy == idStrategyHash && table.Query != "":
+		return nil, fmt.Errorf("table %s: mongodb.id_strategy hash needs id_columns for a custom query", table.Name)
+	case strategy == idStrategyFromColumns:
+		return nil, fmt.Errorf("table %s: mongodb.id_strategy from_columns needs id_columns", table.Name)
+	case strategy != idStrategyFromPK && strategy != idStrategyHash, table.Query != "":
+		return nil, nil
+	}
+
+	columns, err := getPrimaryKeyColumns(ctx, pgConn, table.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 && strategy == idStrategyHash {
+		return nil, fmt.Errorf("table %s has no primary key to hash, set id_columns", table.Name)
+	}
+	if len(columns) == 0 {
+		logger.Warn("Table %s has no primary key. MongoDB will generate _id values.", table.Name)
+	}
+	return columns, nil
+}
@@ -0,0 +1,94 @@
+package migrator
+
+import "testing"
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"orders", `"orders"`},
+		{"Order", `"Order"`},
+		{"user", `"user"`},
+		{"order items", `"order items"`},
+		{`say "hi"`, `"say ""hi"""`},
+		{"my.table", `"my.table"`},
+	}
+	for _, tt := range tests {
+		if got := quoteIdentifier(tt.name); got != tt.want {
+			t.Errorf("quoteIdentifier(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitTableName(t *testing.T) {
+	tests := []struct {
+		name      string
+		schema    string
+		table     string
+		qualified bool
+	}{
+		{"orders", "", "orders", false},
+		{"public.orders", "public", "orders", true},
+		{"Sales.Order", "Sales", "Order", true},
+		{`"my.table"`, "", "my.table", false},
+		{`public."my.table"`, "public", "my.table", true},
+		{`"my.schema".orders`, "my.schema", "orders", true},
+		{`"my.schema"."Order"`, "my.schema", "Order", true},
+		{`"a""b".c`, `a"b`, "c", true},
+		{`a"b`, "", `a"b`, false},
+		{"a.b.c", "a", "b.c", true},
+	}
+	for _, tt := range tests {
+		schema, table, qualified := splitTableName(tt.name)
+		if schema != tt.schema || table != tt.table || qualified != tt.qualified {
+			t.Errorf("splitTableName(%s) = %q, %q, %v, want %q, %q, %v", tt.name, schema, table, qualified, tt.schema, tt.table, tt.qualified)
+		}
+	}
+}
+
+func TestQuoteTableName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"orders", `"orders"`},
+		{"public.Order", `"public"."Order"`},
+		{"public.user", `"public"."user"`},
+		{`"my.table"`, `"my.table"`},
+		{`public."my.table"`, `"public"."my.table"`},
+		{`"my.schema"."Order"`, `"my.schema"."Order"`},
+		{`public."say ""hi"""`, `"public"."say ""hi"""`},
+	}
+	for _, tt := range tests {
+		if got := quoteTableName(tt.name); got != tt.want {
+			t.Errorf("quoteTableName(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQualifyTableName(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{"orders", "public", "public.orders"},
+		{"Order", "Sales", "Sales.Order"},
+		{"audit.log", "public", "audit.log"},
+		{`"my.table"`, "public", `public."my.table"`},
+		{"orders", "my.schema", `"my.schema".orders`},
+		{`"Order"`, "public", "public.Order"},
+	}
+	for _, tt := range tests {
+		got := qualifyTableName(tt.name, tt.schema)
+		if got != tt.want {
+			t.Errorf("qualifyTableName(%s, %s) = %s, want %s", tt.name, tt.schema, got, tt.want)
+		}
+		// The qualified name must split back into the same parts
+		schema, table, _ := splitTableName(got)
+		if joinTableName(schema, table) != got {
+			t.Errorf("joinTableName(splitTableName(%s)) = %s", got, joinTableName(schema, table))
+		}
+	}
+}
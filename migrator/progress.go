@@ -0,0 +1,111 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// redrawInterval throttles the redrawn progress line on a terminal
+const redrawInterval = time.Second
+
+// progress reports how far the transfer of a table got and when it is expected to finish
+type progress struct {
+	table     string
+	total     int64
+	estimated bool // total is the planner estimate rather than an exact count
+	start     time.Time
+	last      time.Time
+	interval  time.Duration
+	redraw    bool // redraw a single line on the terminal instead of logging lines
+}
+
+// newProgress counts the rows the transfer of a table is going to read. Tables without a filter use
+// the planner estimate from pg_class, which is instant; filtered reads are counted exactly.
+func newProgress(ctx context.Context, pgConn RowSource, table TableConfig, wm *watermark, config Config) (*progress, error) {
+	p := &progress{
+		table:    table.Name,
+		start:    time.Now(),
+		interval: config.Migration.ProgressInterval,
+		redraw:   stderrIsTerminal() && config.Migration.Concurrency == 1 && config.LogFormat != "json",
+	}
+	p.last = p.start
+
+	if table.Query == "" && table.Where == "" && (wm == nil || !wm.hasValue) {
+		err := pgConn.QueryRow(ctx, "SELECT reltuples::bigint FROM pg_class WHERE oid = $1::regclass", quoteTableName(table.Name)).Scan(&p.total)
+		if err != nil {
+			return nil, fmt.Errorf("error estimating the row count of table %s: %v", table.Name, err)
+		}
+		// A table that was never analyzed has no estimate (-1, or 0 before PostgreSQL 14)
+		if p.total > 0 {
+			p.estimated = true
+			if table.Limit > 0 && p.total > int64(table.Limit) {
+				p.total = int64(table.Limit)
+			}
+			return p, nil
+		}
+	}
+
+	// The order of a random sample does not change its count, so the sort is left out
+	table.RandomSample = false
+	query, args := buildSelectQuery(table, nil, wm, 0)
+	countQuery := fmt.Sprintf("SELECT count(*) FROM (%s) AS source", query)
+	if err := pgConn.QueryRow(ctx, countQuery, args...).Scan(&p.total); err != nil {
+		return nil, fmt.Errorf("error counting rows of table %s: %v", table.Name, err)
+	}
+	return p, nil
+}
+
+// update reports the number of rows read so far, at most once per interval
+func (p *progress) update(rows int64) {
+	interval := p.interval
+	if p.redraw {
+		interval = redrawInterval
+	}
+	now := time.Now()
+	if now.Sub(p.last) < interval {
+		return
+	}
+	p.last = now
+
+	if p.redraw {
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", p.line(rows, now))
+	} else {
+		logger.Info("Progress: %s", p.line(rows, now))
+	}
+}
+
+// done ends the redrawn line once the table is finished
+func (p *progress) done() {
+	if p.redraw && p.last != p.start {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// line formats the progress of the table after rows rows
+func (p *progress) line(rows int64, now time.Time) string {
+	about := ""
+	if p.estimated {
+		about = "~"
+	}
+	elapsed := now.Sub(p.start)
+	if p.total <= 0 || rows >= p.total {
+		// The estimate was too low, so neither percentage nor ETA is known
+		return fmt.Sprintf("table %s: %d of %s%d rows, %s elapsed", p.table, rows, about, p.total, elapsed.Round(time.Second))
+	}
+
+	percent := float64(rows) * 100 / float64(p.total)
+	eta := "unknown"
+	if rows > 0 {
+		remaining := time.Duration(float64(elapsed) * float64(p.total-rows) / float64(rows))
+		eta = remaining.Round(time.Second).String()
+	}
+	return fmt.Sprintf("table %s: %.1f%% (%d of %s%d rows), ETA %s", p.table, percent, rows, about, p.total, eta)
+}
+
+// stderrIsTerminal reports whether stderr is attached to a terminal
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,149 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// prunes reports whether the documents of deleted rows are removed from the collection of a
+// table after its transfer, honouring the prune option of the table entry
+func prunes(table TableConfig, config Config) bool {
+	if table.Prune != nil {
+		return *table.Prune
+	}
+	return config.MongoDB.Prune
+}
+
+// pruneCollection deletes the documents whose _id matches no row of the table (within its where
+// filter) anymore. The _id of every row is built exactly like for its document and kept in memory,
+// then the collection's _id values are scanned and the missing ones deleted in batches of
+// mongodb.batch_size. It returns the number of documents deleted, or found in a dry run.
+func pruneCollection(ctx context.Context, pgConn RowSource, collection *mongo.Collection, table TableConfig, config Config) (int64, error) {
+	keyColumns, err := resolveIDColumns(ctx, pgConn, table, config)
+	if err != nil {
+		return 0, err
+	}
+	if len(keyColumns) == 0 {
+		return 0, fmt.Errorf("table %s: prune needs an _id built from the rows, set an id_strategy or id_column", table.Name)
+	}
+
+	keys, err := sourceKeys(ctx, pgConn, table, keyColumns, config)
+	if err != nil {
+		return 0, err
+	}
+
+	cursor, err := collection.Find(ctx, bson.D{}, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, fmt.Errorf("error reading the _id values of collection %s: %v", collection.Name(), err)
+	}
+	defer cursor.Close(ctx)
+
+	var pruned int64
+	var stale bson.A
+	deleteStale := func() error {
+		if len(stale) == 0 {
+			return nil
+		}
+		if config.Migration.DryRun {
+			pruned += int64(len(stale))
+		} else {
+			deleted, err := collection.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: stale}}}})
+			if err != nil {
+				return fmt.Errorf("error deleting pruned documents of collection %s: %v", collection.Name(), err)
+			}
+			pruned += deleted.DeletedCount
+		}
+		stale = stale[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		id := cursor.Current.Lookup("_id")
+		if keys[rawKey(id)] {
+			continue
+		}
+		// The cursor reuses its buffer for the next document
+		id.Value = append([]byte(nil), id.Value...)
+		stale = append(stale, id)
+		if len(stale) >= config.MongoDB.BatchSize {
+			if err := deleteStale(); err != nil {
+				return pruned, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return pruned, fmt.Errorf("error reading the _id values of collection %s: %v", collection.Name(), err)
+	}
+	return pruned, deleteStale()
+}
+
+// sourceKeys reads the key columns of every row and returns the set of their _id values
+func sourceKeys(ctx context.Context, pgConn RowSource, table TableConfig, keyColumns []string, config Config) (map[string]bool, error) {
+	types, err := loadTypes(ctx, pgConn)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args := buildSelectQuery(table, keyColumns, nil, 0)
+	if table.Query != "" {
+		quoted := make([]string, len(keyColumns))
+		for i, column := range keyColumns {
+			quoted[i] = quoteIdentifier(column)
+		}
+		query = fmt.Sprintf("SELECT %s FROM (%s) AS source", strings.Join(quoted, ", "), query)
+	}
+	rows, err := queryRows(ctx, pgConn, table.Name, query, args, config)
+	if err != nil {
+		return nil, fmt.Errorf("error querying the keys of table %s: %v", table.Name, err)
+	}
+	defer rows.Close()
+
+	fields := rows.FieldDescriptions()
+	names := fieldNames(table.Name, keyColumns, config.MongoDB.FieldNaming)
+	keyIndexes := make([]int, len(keyColumns))
+	for i := range keyIndexes {
+		keyIndexes[i] = i
+	}
+	converters := buildConverters(table.Name, fields, types, config)
+	makeID := newIDFunc(fields, keyIndexes, config)
+
+	keys := map[string]bool{}
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, fmt.Errorf("error reading the keys of table %s: %v", table.Name, err)
+		}
+		raw := rows.RawValues()
+		row, err := convertRow(converters, values, raw)
+		if err == nil && makeID != nil {
+			row.id, err = makeID(raw)
+		}
+		if err != nil {
+			// The row has no document either, which the transfer reported already
+			continue
+		}
+		id := row.id
+		if id == nil {
+			id = buildID(names, row.values, keyIndexes)
+		}
+		encoded, err := bson.Marshal(bson.D{{Key: "_id", Value: id}})
+		if err != nil {
+			return nil, fmt.Errorf("error encoding the _id of table %s: %v", table.Name, err)
+		}
+		keys[rawKey(bson.Raw(encoded).Lookup("_id"))] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading the keys of table %s: %v", table.Name, err)
+	}
+	return keys, nil
+}
+
+// rawKey identifies a BSON value by its type and encoding, so that equal _id values of the source
+// and the collection match
+func rawKey(value bson.RawValue) string {
+	return string(rune(value.Type)) + string(value.Value)
+}
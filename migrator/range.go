@@ -0,0 +1,127 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Storage formats of range columns (types.range_format)
+const (
+	rangeFormatDocument = "document" // {lower, upper, lowerInclusive, upperInclusive, lowerInfinite, upperInfinite}
+	rangeFormatString   = "string"   // text form of PostgreSQL, e.g. [1,10)
+)
+
+// loadRangeTypes records the subtype of every range type, the built-in int4range, tsrange, ... and
+// those created with CREATE TYPE ... AS RANGE
+func loadRangeTypes(ctx context.Context, pgConn RowSource, types pgTypes) error {
+	rows, err := pgConn.Query(ctx, `SELECT rngtypid, rngsubtype FROM pg_range`)
+	if err != nil {
+		return fmt.Errorf("error querying PostgreSQL for range types: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid, subtype uint32
+		if err := rows.Scan(&oid, &subtype); err != nil {
+			return fmt.Errorf("error scanning range type: %v", err)
+		}
+		types.ranges[oid] = subtype
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating range types: %v", err)
+	}
+	return nil
+}
+
+// rangeConverter stores a range as a sub-document of its bounds, converted like columns of the
+// subtype (dates as BSON dates, integers as integers), with whether each is inclusive. A missing
+// bound is null with lowerInfinite or upperInfinite true, and an empty range is {empty: true}.
+// With range_format: string the text form is stored instead.
+func rangeConverter(table string, field pgproto3.FieldDescription, subtype uint32, types pgTypes, config Config) convertFunc {
+	column := string(field.Name)
+	connInfo := pgtype.NewConnInfo()
+	bound := pgproto3.FieldDescription{Name: field.Name, DataTypeOID: subtype, Format: field.Format}
+	convert := converterFor(table, bound, types, config).convert
+
+	// convertBound converts the text or binary form of one bound
+	convertBound := func(raw []byte) (interface{}, error) {
+		var value interface{}
+		var err error
+		if field.Format == pgtype.TextFormatCode {
+			value, err = decodeText(connInfo, subtype, raw)
+		} else {
+			value, err = decodeBinary(connInfo, subtype, raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("column %s: error decoding range bound: %v", column, err)
+		}
+		return convert(value, raw)
+	}
+
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		if config.Types.RangeFormat == rangeFormatString {
+			return encodeColumnText(field, raw)
+		}
+
+		var lower, upper []byte
+		var lowerType, upperType pgtype.BoundType
+		if field.Format == pgtype.TextFormatCode {
+			parsed, err := pgtype.ParseUntypedTextRange(string(raw))
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", column, err)
+			}
+			lower, upper, lowerType, upperType = []byte(parsed.Lower), []byte(parsed.Upper), parsed.LowerType, parsed.UpperType
+		} else {
+			parsed, err := pgtype.ParseUntypedBinaryRange(raw)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", column, err)
+			}
+			lower, upper, lowerType, upperType = parsed.Lower, parsed.Upper, parsed.LowerType, parsed.UpperType
+		}
+		if lowerType == pgtype.Empty {
+			return bson.D{{Key: "empty", Value: true}}, nil
+		}
+
+		document := bson.D{
+			{Key: "lower"}, {Key: "upper"},
+			{Key: "lowerInclusive", Value: lowerType == pgtype.Inclusive},
+			{Key: "upperInclusive", Value: upperType == pgtype.Inclusive},
+			{Key: "lowerInfinite", Value: lowerType == pgtype.Unbounded},
+			{Key: "upperInfinite", Value: upperType == pgtype.Unbounded},
+		}
+		var err error
+		if lowerType != pgtype.Unbounded {
+			if document[0].Value, err = convertBound(lower); err != nil {
+				return nil, err
+			}
+		}
+		if upperType != pgtype.Unbounded {
+			if document[1].Value, err = convertBound(upper); err != nil {
+				return nil, err
+			}
+		}
+		return document, nil
+	}
+}
+
+// decodeBinary decodes the binary form of a value like pgx does for a result column
+func decodeBinary(connInfo *pgtype.ConnInfo, oid uint32, raw []byte) (interface{}, error) {
+	dataType, ok := connInfo.DataTypeForOID(oid)
+	if !ok {
+		return nil, fmt.Errorf("unsupported type OID %d", oid)
+	}
+	value := pgtype.NewValue(dataType.Value)
+	decoder, ok := value.(pgtype.BinaryDecoder)
+	if !ok {
+		return nil, fmt.Errorf("unsupported type OID %d", oid)
+	}
+	if err := decoder.DecodeBinary(connInfo, raw); err != nil {
+		return nil, err
+	}
+	return value.Get(), nil
+}
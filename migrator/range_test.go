@@ -0,0 +1,114 @@
+package migrator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// floatRangeOID stands for a range type created with CREATE TYPE floatrange AS RANGE (subtype = float8)
+const floatRangeOID = 90100
+
+var rangeTypes = pgTypes{ranges: map[uint32]uint32{
+	pgtype.Int4rangeOID: pgtype.Int4OID,
+	pgtype.Int8rangeOID: pgtype.Int8OID,
+	pgtype.NumrangeOID:  pgtype.NumericOID,
+	pgtype.TsrangeOID:   pgtype.TimestampOID,
+	pgtype.TstzrangeOID: pgtype.TimestamptzOID,
+	pgtype.DaterangeOID: pgtype.DateOID,
+	floatRangeOID:       pgtype.Float8OID,
+}}
+
+// bounds is the document of a range with the given bounds and their kinds, "[" or "(" for the
+// lower and "]" or ")" for the upper bound; a nil bound is infinite
+func bounds(lower interface{}, lowerKind, upperKind string, upper interface{}) bson.D {
+	return bson.D{
+		{Key: "lower", Value: lower}, {Key: "upper", Value: upper},
+		{Key: "lowerInclusive", Value: lowerKind == "["},
+		{Key: "upperInclusive", Value: upperKind == "]"},
+		{Key: "lowerInfinite", Value: lower == nil},
+		{Key: "upperInfinite", Value: upper == nil},
+	}
+}
+
+func TestRangeFormats(t *testing.T) {
+	date := func(year int, month time.Month, day, hour int) primitive.DateTime {
+		return primitive.NewDateTimeFromTime(time.Date(year, month, day, hour, 0, 0, 0, time.UTC))
+	}
+	empty := bson.D{{Key: "empty", Value: true}}
+	tests := []struct {
+		name     string
+		oid      uint32
+		raw      string
+		document bson.D
+	}{
+		{"int4range", pgtype.Int4rangeOID, "[1,10)", bounds(int32(1), "[", ")", int32(10))},
+		{"int4range without lower bound", pgtype.Int4rangeOID, "(,10)", bounds(nil, "(", ")", int32(10))},
+		{"int4range without upper bound", pgtype.Int4rangeOID, "[3,)", bounds(int32(3), "[", ")", nil)},
+		{"unbounded int4range", pgtype.Int4rangeOID, "(,)", bounds(nil, "(", ")", nil)},
+		{"empty int4range", pgtype.Int4rangeOID, "empty", empty},
+		{"int8range", pgtype.Int8rangeOID, "[10000000000,10000000005)", bounds(int64(10000000000), "[", ")", int64(10000000005))},
+		{"numrange with exclusive lower bound", pgtype.NumrangeOID, "(1.5,2.25]", bounds(decimal(t, "1.5"), "(", "]", decimal(t, "2.25"))},
+		{"empty numrange", pgtype.NumrangeOID, "empty", empty},
+		{"tsrange", pgtype.TsrangeOID, `["2024-01-01 10:00:00","2024-01-02 00:00:00")`, bounds(date(2024, 1, 1, 10), "[", ")", date(2024, 1, 2, 0))},
+		{"tstzrange", pgtype.TstzrangeOID, `["2024-01-01 10:00:00+02",)`, bounds(date(2024, 1, 1, 8), "[", ")", nil)},
+		{"daterange", pgtype.DaterangeOID, "[2024-01-01,2024-02-01)", bounds(date(2024, 1, 1, 0), "[", ")", date(2024, 2, 1, 0))},
+		// An infinity bound is a value of the subtype, not a missing bound
+		{"daterange up to infinity", pgtype.DaterangeOID, "[2024-01-01,infinity)", bounds(date(2024, 1, 1, 0), "[", ")", "infinity")},
+		{"custom range", floatRangeOID, "[0.5,1]", bounds(0.5, "[", "]", 1.0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			field := column("period", test.oid)
+			config := testConfig(t)
+			if got, _ := convertColumn(t, field, []byte(test.raw), rangeTypes, config); !reflect.DeepEqual(got, test.document) {
+				t.Errorf("document %q: got %#v, want %#v", test.raw, got, test.document)
+			}
+			config.Types.RangeFormat = rangeFormatString
+			if got, _ := convertColumn(t, field, []byte(test.raw), rangeTypes, config); got != test.raw {
+				t.Errorf("string %q: got %#v", test.raw, got)
+			}
+		})
+	}
+}
+
+func TestRangeBinary(t *testing.T) {
+	// Flags of the binary form: empty 0x01, lower inclusive 0x02, upper inclusive 0x04, no lower bound
+	// 0x08, no upper bound 0x10, each bound given with its length
+	tests := []struct {
+		raw      []byte
+		text     string
+		document bson.D
+	}{
+		{[]byte{0x02, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0, 0, 4, 0, 0, 0, 10}, "[1,10)", bounds(int32(1), "[", ")", int32(10))},
+		{[]byte{0x08, 0, 0, 0, 4, 0, 0, 0, 10}, "(,10)", bounds(nil, "(", ")", int32(10))},
+		{[]byte{0x12, 0, 0, 0, 4, 0, 0, 0, 3}, "[3,)", bounds(int32(3), "[", ")", nil)},
+		{[]byte{0x01}, "empty", bson.D{{Key: "empty", Value: true}}},
+	}
+	field := column("period", pgtype.Int4rangeOID)
+	field.Format = pgtype.BinaryFormatCode
+	for _, test := range tests {
+		config := testConfig(t)
+		if got, _ := convertColumn(t, field, test.raw, rangeTypes, config); !reflect.DeepEqual(got, test.document) {
+			t.Errorf("document %s: got %#v, want %#v", test.text, got, test.document)
+		}
+		config.Types.RangeFormat = rangeFormatString
+		if got, _ := convertColumn(t, field, test.raw, rangeTypes, config); got != test.text {
+			t.Errorf("string %s: got %#v", test.text, got)
+		}
+	}
+}
+
+func TestRangeNull(t *testing.T) {
+	for _, format := range []string{rangeFormatDocument, rangeFormatString} {
+		config := testConfig(t)
+		config.Types.RangeFormat = format
+		if got, _ := convertColumn(t, column("period", pgtype.Int4rangeOID), nil, rangeTypes, config); got != nil {
+			t.Errorf("%s NULL: got %#v, want nil", format, got)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package migrator
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// newWriteLimiter returns a token bucket allowing mongodb.max_docs_per_second documents per second,
+// or nil when the rate is unlimited. The bucket holds at least one batch so a full batch can
+// always be sent once enough tokens have accumulated.
+func newWriteLimiter(config Config) *rate.Limiter {
+	perSecond := config.MongoDB.MaxDocsPerSecond
+	if perSecond <= 0 {
+		return nil
+	}
+	burst := config.MongoDB.BatchSize
+	if burst < perSecond {
+		burst = perSecond
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// waitToWrite blocks until n more documents may be written, or ctx is cancelled
+func waitToWrite(ctx context.Context, limiter *rate.Limiter, n int) error {
+	if limiter == nil {
+		return nil
+	}
+	return limiter.WaitN(ctx, n)
+}
@@ -0,0 +1,138 @@
+package migrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// RunReport is the machine-readable summary of a run, written as JSON with --report
+type RunReport struct {
+	Status          string        `json:"status"`
+	Error           string        `json:"error,omitempty"`
+	DryRun          bool          `json:"dry_run"`
+	StartedAt       time.Time     `json:"started_at"`
+	FinishedAt      time.Time     `json:"finished_at"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Tables          []TableReport `json:"tables"`
+	Totals          ReportTotals  `json:"totals"`
+}
+
+// TableReport is the entry of one table in a RunReport
+type TableReport struct {
+	Source          string  `json:"source,omitempty"`
+	Table           string  `json:"table"`
+	Collection      string  `json:"collection"`
+	Status          string  `json:"status"`
+	Error           string  `json:"error,omitempty"`
+	Required        bool    `json:"required"`
+	RowsRead        int64   `json:"rows_read"`
+	DocsInserted    int64   `json:"docs_inserted"`
+	DocsFailed      int64   `json:"docs_failed"`
+	RowsSkipped     int64   `json:"rows_skipped"`
+	DocsPruned      int64   `json:"docs_pruned"`
+	DocsDuplicate   int64   `json:"docs_duplicate"`
+	IDCollisions    int64   `json:"id_collisions"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// ReportTotals adds up the tables of a RunReport
+type ReportTotals struct {
+	Tables            int   `json:"tables"`
+	Failed            int   `json:"failed"`
+	FailedNotRequired int   `json:"failed_not_required"` // failed tables with required: false, which did not stop the run
+	Cancelled         int   `json:"cancelled"`
+	RowsRead          int64 `json:"rows_read"`
+	DocsInserted      int64 `json:"docs_inserted"`
+	DocsFailed        int64 `json:"docs_failed"`
+	RowsSkipped       int64 `json:"rows_skipped"`
+	DocsPruned        int64 `json:"docs_pruned"`
+	DocsDuplicate     int64 `json:"docs_duplicate"`
+	IDCollisions      int64 `json:"id_collisions"`
+}
+
+// NewRunReport starts the report of a run
+func NewRunReport(config Config) *RunReport {
+	return &RunReport{StartedAt: time.Now().UTC(), DryRun: config.Migration.DryRun, Tables: []TableReport{}}
+}
+
+// Add records the results of the tables of a source, "" without a sources list
+func (r *RunReport) Add(source string, results []TransferResult) {
+	for _, result := range results {
+		table := TableReport{
+			Source:          source,
+			Table:           result.Table,
+			Collection:      result.Collection,
+			Status:          result.Status,
+			Required:        !result.NotRequired,
+			RowsRead:        result.RowsRead,
+			DocsInserted:    result.DocsInserted,
+			DocsFailed:      result.DocsFailed,
+			RowsSkipped:     result.RowsSkipped,
+			DocsPruned:      result.DocsPruned,
+			DocsDuplicate:   result.DocsDuplicate,
+			IDCollisions:    result.IDCollisions,
+			DurationSeconds: result.Duration.Seconds(),
+		}
+		if result.Err != nil {
+			table.Error = result.Err.Error()
+		}
+		r.Tables = append(r.Tables, table)
+
+		r.Totals.Tables++
+		switch result.Status {
+		case StatusFailed:
+			r.Totals.Failed++
+			if result.NotRequired {
+				r.Totals.FailedNotRequired++
+			}
+		case StatusCancelled:
+			r.Totals.Cancelled++
+		}
+		r.Totals.RowsRead += result.RowsRead
+		r.Totals.DocsInserted += result.DocsInserted
+		r.Totals.DocsFailed += result.DocsFailed
+		r.Totals.RowsSkipped += result.RowsSkipped
+		r.Totals.DocsPruned += result.DocsPruned
+		r.Totals.DocsDuplicate += result.DocsDuplicate
+		r.Totals.IDCollisions += result.IDCollisions
+	}
+}
+
+// DroppedRows is the number of rows that did not make it into MongoDB, for fail_on_dropped_rows.
+// A table with required: false that failed is left out: its failure does not fail the run, and
+// neither should the rows it dropped before failing.
+func (r *RunReport) DroppedRows() int64 {
+	var dropped int64
+	for _, table := range r.Tables {
+		if table.Status == StatusFailed && !table.Required {
+			continue
+		}
+		dropped += table.DocsFailed + table.RowsSkipped
+	}
+	return dropped
+}
+
+// Finish sets the end time and overall status of the run, failed when err stopped it
+func (r *RunReport) Finish(err error) {
+	r.FinishedAt = time.Now().UTC()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.Status = StatusOK
+	if err != nil {
+		r.Status = StatusFailed
+		r.Error = err.Error()
+	}
+}
+
+// WriteFile writes the report to path as indented JSON
+func (r *RunReport) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding the run report: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing the run report: %v", err)
+	}
+	return nil
+}
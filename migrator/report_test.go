@@ -0,0 +1,47 @@
+package migrator
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDroppedRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []TransferResult
+		dropped int64
+	}{
+		{"nothing dropped", []TransferResult{
+			{Table: "public.orders", Status: StatusOK, RowsRead: 10, DocsInserted: 10},
+		}, 0},
+		{"dead-lettered and skipped rows", []TransferResult{
+			{Table: "public.orders", Status: StatusOK, RowsRead: 10, DocsInserted: 7, DocsFailed: 2, RowsSkipped: 1},
+			{Table: "public.customers", Status: StatusOK, RowsRead: 5, DocsInserted: 4, DocsFailed: 1},
+		}, 4},
+		{"failed table that is not required", []TransferResult{
+			{Table: "public.orders", Status: StatusOK, RowsRead: 10, DocsInserted: 10},
+			{Table: "public.audit_log", Status: StatusFailed, NotRequired: true, Err: errors.New("lost connection"), DocsFailed: 3, RowsSkipped: 2},
+		}, 0},
+		{"failed required table", []TransferResult{
+			{Table: "public.orders", Status: StatusFailed, Err: errors.New("rejected batch"), DocsFailed: 3},
+		}, 3},
+		{"table that is not required and succeeded", []TransferResult{
+			{Table: "public.audit_log", Status: StatusOK, NotRequired: true, DocsFailed: 1, RowsSkipped: 1},
+			{Table: "public.sessions", Status: StatusFailed, NotRequired: true, Err: errors.New("missing relation"), RowsSkipped: 8},
+		}, 2},
+	}
+	for _, test := range tests {
+		report := NewRunReport(Config{})
+		report.Add("", test.results)
+		if got := report.DroppedRows(); got != test.dropped {
+			t.Errorf("%s: got %d dropped rows, want %d", test.name, got, test.dropped)
+		}
+	}
+
+	// The totals still count every table
+	report := NewRunReport(Config{})
+	report.Add("", tests[2].results)
+	if report.Totals.DocsFailed != 3 || report.Totals.RowsSkipped != 2 || report.Totals.FailedNotRequired != 1 {
+		t.Errorf("got totals %+v", report.Totals)
+	}
+}
@@ -0,0 +1,127 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TransferResult reports what happened while transferring one table
+type TransferResult struct {
+	Table         string
+	Collection    string
+	RowsRead      int64
+	DocsInserted  int64
+	DocsFailed    int64 // documents MongoDB rejected
+	RowsSkipped   int64 // rows written to the dead-letter file in continue-on-error mode
+	DocsPruned    int64 // documents of deleted rows removed with prune
+	DocsDuplicate int64 // documents left out with on_duplicate: skip because their _id was taken
+	IDCollisions  int64 // rows that got the _id of an earlier row of the table, with migration.check_ids
+	Duration      time.Duration
+
+	// Status is StatusOK, StatusFailed or StatusCancelled once MigrateTables is done with the
+	// table, and Err the error that stopped it
+	Status string
+	Err    error
+
+	// NotRequired is set for a table with required: false, whose failure did not stop the run
+	NotRequired bool
+}
+
+// Outcomes of a table transfer and of a whole run
+const (
+	StatusOK        = "ok"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// recordWrite adds the outcome of writing a batch of n documents to the result. For a
+// bulk write error only the documents MongoDB rejected, or never attempted after the
+// first error of an ordered write, count as failed.
+func (r *TransferResult) recordWrite(n int, ordered bool, err error) {
+	if err == nil {
+		r.DocsInserted += int64(n)
+		return
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+		r.DocsFailed += int64(n)
+		return
+	}
+
+	written := n - len(bulkErr.WriteErrors)
+	if ordered {
+		written = bulkErr.WriteErrors[0].Index
+	}
+	r.DocsInserted += int64(written)
+	r.DocsFailed += int64(n - written)
+}
+
+// maxReportedWriteErrors caps how many rejected documents the error of a failed batch lists
+const maxReportedWriteErrors = 10
+
+// describeWriteErrors spells out which documents of a batch MongoDB rejected, by row number, source
+// key and error, and for an ordered write how many after the first rejected one were not written.
+// Errors other than a bulk write error are returned as they are.
+func describeWriteErrors(err error, rows []int64, keys []interface{}, ordered bool) error {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d documents rejected", len(bulkErr.WriteErrors), len(rows))
+	for i, writeErr := range bulkErr.WriteErrors {
+		if i == maxReportedWriteErrors {
+			fmt.Fprintf(&b, "; and %d more", len(bulkErr.WriteErrors)-i)
+			break
+		}
+		fmt.Fprintf(&b, "; row %d (key %v): code %d: %s", rows[writeErr.Index], keys[writeErr.Index], writeErr.Code, writeErr.Message)
+	}
+	if ordered {
+		if skipped := len(rows) - bulkErr.WriteErrors[0].Index - 1; skipped > 0 {
+			fmt.Fprintf(&b, "; the %d documents after it were not written (mongodb.ordered)", skipped)
+		}
+	}
+	if bulkErr.WriteConcernError != nil {
+		fmt.Fprintf(&b, "; write concern error: %v", bulkErr.WriteConcernError)
+	}
+	return errors.New(b.String())
+}
+
+// PrintSummary writes a table of per-table results and their totals to stdout
+func PrintSummary(results []TransferResult) {
+	FprintSummary(os.Stdout, results)
+}
+
+// FprintSummary writes the table of PrintSummary to out, followed by the failed tables that are not required
+func FprintSummary(out io.Writer, results []TransferResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "TABLE\tCOLLECTION\tROWS READ\tINSERTED\tFAILED\tSKIPPED\tDUPLICATES\tDURATION\t")
+
+	var total TransferResult
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t\n", r.Table, r.Collection, r.RowsRead, r.DocsInserted, r.DocsFailed, r.RowsSkipped, r.DocsDuplicate, r.Duration.Round(time.Millisecond))
+		total.RowsRead += r.RowsRead
+		total.DocsInserted += r.DocsInserted
+		total.DocsFailed += r.DocsFailed
+		total.RowsSkipped += r.RowsSkipped
+		total.DocsDuplicate += r.DocsDuplicate
+		total.Duration += r.Duration
+	}
+	fmt.Fprintf(w, "TOTAL\t\t%d\t%d\t%d\t%d\t%d\t%s\t\n", total.RowsRead, total.DocsInserted, total.DocsFailed, total.RowsSkipped, total.DocsDuplicate, total.Duration.Round(time.Millisecond))
+	w.Flush()
+
+	for _, r := range results {
+		if r.Status == StatusFailed && r.NotRequired {
+			fmt.Fprintf(out, "FAILED (not required) %s: %v\n", r.Table, r.Err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxRetryDelay caps the exponential backoff between connection attempts
+const maxRetryDelay = 30 * time.Second
+
+// retryConnect calls connect until it succeeds, retrying up to migration.max_retries times
+// with exponential backoff. It gives up early when ctx is cancelled.
+func retryConnect(ctx context.Context, name string, config Config, connect func() error) error {
+	delay := config.Migration.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := connect()
+		if err == nil || attempt >= config.Migration.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		logger.Warn("Connecting to %s failed (attempt %d of %d): %v. Retrying in %s...",
+			name, attempt+1, config.Migration.MaxRetries+1, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// retryableWriteCodes are the server error codes of a primary stepping down or a node going away,
+// after which the same write can succeed against the new primary
+var retryableWriteCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	262,   // ExceededTimeLimit
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// duplicateKeyCode is the write error code of an _id or unique index that is already taken
+const duplicateKeyCode = 11000
+
+// isRetryableWriteError reports whether a failed write may succeed when sent again: network errors,
+// timeouts and the server errors of an election. Rejected documents and cancellation are final.
+func isRetryableWriteError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	if serverErr.HasErrorLabel("RetryableWriteError") {
+		return true
+	}
+	for _, code := range retryableWriteCodes {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryWrite calls write until it succeeds or fails with an error that is not retryable, retrying
+// up to migration.max_retries times with the backoff of retryConnect. write is told whether it is
+// a retry. It gives up early when ctx is cancelled.
+func retryWrite(ctx context.Context, collection string, config Config, write func(retry bool) error) error {
+	delay := config.Migration.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := write(attempt > 0)
+		if attempt >= config.Migration.MaxRetries || ctx.Err() != nil || !isRetryableWriteError(err) {
+			return err
+		}
+
+		logger.Warn("Writing to MongoDB collection %s failed (attempt %d of %d): %v. Retrying in %s...",
+			collection, attempt+1, config.Migration.MaxRetries+1, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// queryCanceledCode is the SQLSTATE of a statement PostgreSQL cancelled, among others for statement_timeout
+const queryCanceledCode = "57014"
+
+// isStatementTimeout reports whether err is PostgreSQL cancelling a statement after postgres.statement_timeout
+func isStatementTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == queryCanceledCode && strings.Contains(pgErr.Message, "statement timeout")
+}
+
+// statementTimeoutError names postgres.statement_timeout in the error of a read that ran into it
+func statementTimeoutError(err error, config Config) error {
+	if !isStatementTimeout(err) {
+		return err
+	}
+	return fmt.Errorf("%v (the statement ran longer than postgres.statement_timeout of %s)", err, config.Postgres.StatementTimeout)
+}
+
+// retryRead calls read until it succeeds or fails with anything but a statement timeout, retrying
+// up to migration.max_retries times with the backoff of retryConnect. It gives up early when ctx
+// is cancelled.
+func retryRead(ctx context.Context, table string, config Config, read func() error) error {
+	delay := config.Migration.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := read()
+		if attempt >= config.Migration.MaxRetries || ctx.Err() != nil || !isStatementTimeout(err) {
+			return err
+		}
+
+		logger.Warn("Reading table %s timed out (attempt %d of %d): %v. Retrying in %s...",
+			table, attempt+1, config.Migration.MaxRetries+1, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// ignoreDuplicateKeys drops the duplicate key errors from the error of a retried insert: the
+// documents they reject were written by the attempt that failed. The other errors are kept.
+func ignoreDuplicateKeys(err error) error {
+	_, err = dropDuplicateKeys(err)
+	return err
+}
+
+// dropDuplicateKeys removes the duplicate key errors from the error of an unordered insert and
+// returns how many there were, with what is left of the error
+func dropDuplicateKeys(err error) (int, error) {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return 0, err
+	}
+	var kept []mongo.BulkWriteError
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != duplicateKeyCode {
+			kept = append(kept, writeErr)
+		}
+	}
+	duplicates := len(bulkErr.WriteErrors) - len(kept)
+	if len(kept) == 0 {
+		return duplicates, nil
+	}
+	bulkErr.WriteErrors = kept
+	return duplicates, bulkErr
+}
+
+// markMaybeWritten marks in written the documents a failed insert could have written before it
+// failed: all of them but those its write errors rejected and, for an ordered insert, those after
+// the first rejected one. An error without write errors, such as a network error, does not tell,
+// so then all of them could have been written.
+func markMaybeWritten(written []bool, err error, ordered bool) {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+		for i := range written {
+			written[i] = true
+		}
+		return
+	}
+	rejected := make(map[int]bool, len(bulkErr.WriteErrors))
+	for _, writeErr := range bulkErr.WriteErrors {
+		rejected[writeErr.Index] = true
+	}
+	end := len(written)
+	if ordered {
+		end = bulkErr.WriteErrors[0].Index
+	}
+	for i := 0; i < end; i++ {
+		if !rejected[i] {
+			written[i] = true
+		}
+	}
+}
+
+// dropRetriedDuplicates removes from the error of a retried unordered insert the duplicate key
+// errors of the documents an earlier attempt could have written, and with skip the other
+// duplicate key errors too. It returns how many of those others it removed, with what is left of
+// the error.
+func dropRetriedDuplicates(err error, written []bool, skip bool) (int, error) {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return 0, err
+	}
+	duplicates := 0
+	var kept []mongo.BulkWriteError
+	for _, writeErr := range bulkErr.WriteErrors {
+		switch {
+		case writeErr.Code != duplicateKeyCode:
+			kept = append(kept, writeErr)
+		case written[writeErr.Index]:
+			// Written by a failed attempt, not a duplicate
+		case skip:
+			duplicates++
+		default:
+			kept = append(kept, writeErr)
+		}
+	}
+	if len(kept) == 0 {
+		return duplicates, nil
+	}
+	bulkErr.WriteErrors = kept
+	return duplicates, bulkErr
+}
+
+// withID puts a new ObjectID first in a document that has no _id, so that a retried insert sends
+// the same _id again instead of the driver generating a new one
+func withID(document bson.D) bson.D {
+	if len(document) > 0 && document[0].Key == "_id" {
+		return document
+	}
+	return append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, document...)
+}
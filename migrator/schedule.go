@@ -0,0 +1,68 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule gives the start of the next run of a scheduled migration after the given time
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+// ParseSchedule parses migration.schedule: either a duration such as 15m, waited after each run, or
+// a cron expression with five fields or a descriptor such as @hourly or @every 1h
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval < time.Second {
+			return nil, fmt.Errorf("invalid schedule %q: the interval must be at least 1s", spec)
+		}
+		return cron.Every(interval), nil
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: must be a duration such as 15m or a cron expression: %v", spec, err)
+	}
+	return schedule, nil
+}
+
+// WaitUntil sleeps until next, returning early with the error of ctx when it is done first
+func WaitUntil(ctx context.Context, next time.Time) error {
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// RepeatedInserts returns the tables a scheduled migration would insert in full again on every
+// run: those without an incremental column that are neither upserted, replaced nor dropped first
+func RepeatedInserts(config Config) []string {
+	if config.MongoDB.Mode != modeInsert {
+		return nil
+	}
+	var tables []string
+	for _, table := range config.Postgres.Tables {
+		drop := config.MongoDB.DropBeforeImport
+		if table.DropBeforeImport != nil {
+			drop = *table.DropBeforeImport
+		}
+		if table.Incremental != "" || drop {
+			continue
+		}
+		name := table.Name
+		if name == "" {
+			name = table.Collection
+		}
+		tables = append(tables, name)
+	}
+	return tables
+}
@@ -0,0 +1,31 @@
+package migrator
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RowSource is the PostgreSQL access the migration reads through. *pgxpool.Pool implements it,
+// and a fake can stand in for it to exercise the transfer logic without a database.
+type RowSource interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+}
+
+// DocSink is the MongoDB collection a table is written to. *mongo.Collection implements it.
+type DocSink interface {
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+	Drop(ctx context.Context) error
+}
+
+var (
+	_ RowSource = (*pgxpool.Pool)(nil)
+	_ DocSink   = (*mongo.Collection)(nil)
+)
@@ -0,0 +1,104 @@
+package migrator
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// sourceName is what a source name may look like; it becomes part of file names
+var sourceName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// sourceMongoConnectionKeys are the mongodb settings a source cannot change, since all
+// sources are written through one MongoDB client
+var sourceMongoConnectionKeys = []string{"uri", "username", "password", "auth_mechanism", "auth_source", "tls", "write_concern", "read_preference"}
+
+// PostgresSources returns one configuration per PostgreSQL source: the entries of the sources
+// list, or the configuration itself when it has none
+func (c Config) PostgresSources() []Config {
+	if len(c.Sources) == 0 {
+		return []Config{c}
+	}
+	return c.Sources
+}
+
+// loadSources builds the configuration of every entry of the sources list. Each starts from the
+// top-level configuration and decodes the postgres and mongodb settings of the entry over it.
+func loadSources(base Config, entries []interface{}, decodeHook mapstructure.DecodeHookFunc) ([]Config, error) {
+	var sources []Config
+	seen := map[string]bool{}
+	for i, entry := range entries {
+		settings, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("sources: entry %d must be a map with a name", i+1)
+		}
+		name, _ := settings["name"].(string)
+		if !sourceName.MatchString(name) {
+			return nil, fmt.Errorf("sources: entry %d needs a name of letters, digits, _ and -, got %q", i+1, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("sources: the name %s is used twice", name)
+		}
+		seen[name] = true
+
+		source := base
+		source.SourceName = name
+		for key, value := range settings {
+			var err error
+			switch strings.ToLower(key) {
+			case "name":
+			case "postgres":
+				err = decodeOver(value, &source.Postgres, decodeHook)
+			case "mongodb":
+				mongoSettings, _ := value.(map[string]interface{})
+				for _, connectionKey := range sourceMongoConnectionKeys {
+					if _, ok := mongoSettings[connectionKey]; ok {
+						return nil, fmt.Errorf("source %s: mongodb.%s can only be set at the top level", name, connectionKey)
+					}
+				}
+				err = decodeOver(value, &source.MongoDB, decodeHook)
+			default:
+				err = fmt.Errorf("unknown setting %s, a source has name, postgres and mongodb", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("source %s: %v", name, err)
+			}
+		}
+
+		// Table names repeat between sources, so each keeps its own state and dead letters
+		source.Migration.StateFile = sourceFile(base.Migration.StateFile, name)
+		source.Migration.DeadLetterFile = sourceFile(base.Migration.DeadLetterFile, name)
+
+		if err := finishConfig(&source); err != nil {
+			return nil, fmt.Errorf("source %s: %v", name, err)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// decodeOver decodes settings into result, keeping the fields the settings do not mention
+func decodeOver(settings interface{}, result interface{}, decodeHook mapstructure.DecodeHookFunc) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       decodeHook,
+		WeaklyTypedInput: true,
+		ZeroFields:       true,
+		Result:           result,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(settings)
+}
+
+// sourceFile inserts the source name before the extension of path, e.g. sync_state.orders.json
+func sourceFile(path, name string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
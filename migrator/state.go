@@ -0,0 +1,127 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// tableState is the progress persisted for one table between runs
+type tableState struct {
+	// Watermark is the text form of the highest incremental column value transferred so far
+	Watermark string `json:"watermark,omitempty"`
+
+	// Checkpoint is the text form of the primary key of the last row written by an
+	// unfinished keyset-paginated transfer
+	Checkpoint string `json:"checkpoint,omitempty"`
+}
+
+// StateStore keeps per-table progress in a JSON file shared by all workers of a run. Updates are
+// serialized by mu and each replaces the whole file atomically, see save.
+type StateStore struct {
+	mu     sync.Mutex
+	path   string
+	tables map[string]tableState
+
+	// ReadOnly keeps updates in memory without writing the state file
+	ReadOnly bool
+}
+
+// LoadStateStore reads the state file at path. A missing file is treated as a first run.
+func LoadStateStore(path string) (*StateStore, error) {
+	store := &StateStore{path: path, tables: map[string]tableState{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &store.tables); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// get returns the persisted state of a table
+func (s *StateStore) get(table string) (tableState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.tables[table]
+	return state, ok
+}
+
+// update applies fn to the state of a table and writes the state file
+func (s *StateStore) update(table string, fn func(state *tableState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.tables[table]
+	fn(&state)
+	s.tables[table] = state
+
+	return s.save()
+}
+
+// ClearCheckpoints forgets the checkpoints of every table, keeping their watermarks
+func (s *StateStore) ClearCheckpoints() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for table, state := range s.tables {
+		state.Checkpoint = ""
+		s.tables[table] = state
+	}
+	return s.save()
+}
+
+// save writes the state file; the caller must hold s.mu. The state goes to a temporary file next
+// to it that then replaces it, so a crash or a full disk during the write leaves the previous state
+// intact instead of a truncated file, and the workers of a run never see half of another's update.
+func (s *StateStore) save() error {
+	if s.ReadOnly {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.tables, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of path, flushes it to disk and
+// renames it over path, which replaces the file in one step
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// Once renamed the temporary file is gone and removing it fails harmlessly
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,208 @@
+package migrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgtype"
+)
+
+func TestStateStoreConcurrentUpdates(t *testing.T) {
+	const workers, updates = 8, 100
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	store, err := LoadStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader checks that the file never holds half of an update while the workers write it
+	done := make(chan struct{})
+	readErrors := make(chan error, 1)
+	go func() {
+		defer close(readErrors)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			var tables map[string]tableState
+			if err == nil {
+				err = json.Unmarshal(data, &tables)
+			}
+			if err != nil {
+				readErrors <- err
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			table := fmt.Sprintf("public.table_%d", w)
+			for i := 1; i <= updates; i++ {
+				err := store.update(table, func(s *tableState) {
+					s.Watermark = strconv.Itoa(i)
+					s.Checkpoint = strconv.Itoa(i * 10)
+				})
+				if err == nil {
+					// Every worker also counts in a table they share, which loses no update
+					err = store.update("public.shared", func(s *tableState) {
+						n, _ := strconv.Atoi(s.Watermark)
+						s.Watermark = strconv.Itoa(n + 1)
+					})
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	if err := <-readErrors; err != nil {
+		t.Fatalf("reading the state file during the updates: %v", err)
+	}
+
+	// The next run finds every table where it was left
+	reloaded, err := LoadStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for w := 0; w < workers; w++ {
+		table := fmt.Sprintf("public.table_%d", w)
+		want := tableState{Watermark: strconv.Itoa(updates), Checkpoint: strconv.Itoa(updates * 10)}
+		if got, _ := reloaded.get(table); got != want {
+			t.Errorf("%s: got %+v, want %+v", table, got, want)
+		}
+	}
+	if got, _ := reloaded.get("public.shared"); got.Watermark != strconv.Itoa(workers*updates) {
+		t.Errorf("public.shared: got count %s, want %d", got.Watermark, workers*updates)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got files %v, want only the state file", entries)
+	}
+}
+
+// versionedRows is a table public.orders whose rows carry a version column that grows on every
+// update, read incrementally by version. Rows change while a run reads them.
+type versionedRows struct {
+	mu       sync.Mutex
+	versions map[int]int // id -> version
+}
+
+func (v *versionedRows) set(id, version int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.versions[id] = version
+}
+
+// read returns the rows past the version in args, if any, ordered by version
+func (v *versionedRows) read(args []interface{}) [][][]byte {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	after := -1
+	if len(args) > 0 {
+		after, _ = strconv.Atoi(fmt.Sprint(args[0]))
+	}
+	var ids []int
+	for id, version := range v.versions {
+		if version > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return v.versions[ids[i]] < v.versions[ids[j]] })
+	rows := make([][][]byte, len(ids))
+	for i, id := range ids {
+		rows[i] = textRow(strconv.Itoa(id), strconv.Itoa(v.versions[id]))
+	}
+	return rows
+}
+
+func TestIncrementalRowsChangingDuringRun(t *testing.T) {
+	config := testConfig(t)
+	config.MongoDB.IDStrategy = idStrategyFromPK
+	config.MongoDB.Mode = modeReplace
+	table := TableConfig{Name: "public.orders", Incremental: "version"}
+	state, err := LoadStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &versionedRows{versions: map[int]int{1: 1, 2: 2, 3: 3}}
+
+	// beforeRead runs when the watermark column is looked up, afterRead once the rows of the
+	// table query are taken; each run sets them anew
+	var beforeRead, afterRead func()
+	source := &fakeSource{results: []fakeResult{
+		{match: "indisprimary", fields: columns("attname", pgtype.TextOID), rows: [][][]byte{textRow("id")}},
+		{match: "format_type", fields: columns("format_type", pgtype.TextOID), answer: func(args []interface{}) [][][]byte {
+			if beforeRead != nil {
+				beforeRead()
+			}
+			return [][][]byte{textRow("bigint")}
+		}},
+		{match: `FROM "public"."orders"`, fields: columns("id", pgtype.Int4OID, "version", pgtype.Int8OID), answer: func(args []interface{}) [][][]byte {
+			rows := data.read(args)
+			if afterRead != nil {
+				afterRead()
+			}
+			return rows
+		}},
+	}}
+	sink := &fakeSink{}
+	run := func(wantRows int64, wantWatermark string) {
+		t.Helper()
+		result, err := transferInto(t, source, sink, table, state, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.RowsRead != wantRows {
+			t.Errorf("got %d rows read, want %d", result.RowsRead, wantRows)
+		}
+		if got, _ := state.get(table.Name); got.Watermark != wantWatermark {
+			t.Errorf("got watermark %q, want %q", got.Watermark, wantWatermark)
+		}
+	}
+
+	// Between the watermark lookup and the query row 2 is updated and row 4 inserted, which the
+	// query sees. Row 1 is updated once the rows are read, which this run misses.
+	beforeRead = func() { data.set(2, 5); data.set(4, 4) }
+	afterRead = func() { data.set(1, 6) }
+	run(4, "5")
+
+	// The next run starts after the last version written and picks up the update of row 1
+	beforeRead, afterRead = nil, nil
+	run(1, "6")
+	run(0, "6")
+
+	want := map[int32]int64{1: 6, 2: 5, 3: 3, 4: 4}
+	if len(sink.documents) != len(want) {
+		t.Fatalf("got %d documents, want %d", len(sink.documents), len(want))
+	}
+	for _, document := range sink.documents {
+		id := document[0].Value.(int32)
+		if version := document[2].Value.(int64); version != want[id] {
+			t.Errorf("document %d: got version %d, want %d", id, version, want[id])
+		}
+	}
+}
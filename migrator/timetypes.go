@@ -0,0 +1,235 @@
+package migrator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// Time zone names resolve also where the system has no zoneinfo files
+	_ "time/tzdata"
+
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// timetzOID is the type OID of time with time zone, which pgtype does not register
+const timetzOID = 1266
+
+// Storage formats of interval columns (types.interval_format)
+const (
+	intervalFormatISO          = "iso8601"      // ISO 8601 duration string as PostgreSQL prints it, e.g. P1Y2M3DT4H5M6.5S
+	intervalFormatMicroseconds = "microseconds" // total length as int64, counting a month as 30 days
+)
+
+// Storage formats of time and timetz columns (types.time_format)
+const (
+	timeFormatString       = "string"       // HH:MM:SS[.ffffff], timetz keeps its offset
+	timeFormatMilliseconds = "milliseconds" // int64 milliseconds since midnight, timetz in UTC
+)
+
+// Lengths used to turn intervals and times into plain numbers
+const (
+	microsPerSecond = int64(1000000)
+	microsPerMinute = 60 * microsPerSecond
+	microsPerHour   = 60 * microsPerMinute
+	microsPerDay    = 24 * microsPerHour
+)
+
+// sourceLocation is the time zone of types.source_timezone, UTC when it is unset
+func sourceLocation(config Config) *time.Location {
+	location, err := time.LoadLocation(config.Types.SourceTimezone)
+	if err != nil {
+		// validateConfig rejects unknown names
+		return time.UTC
+	}
+	return location
+}
+
+// localTimestampConverter stores timestamp without time zone values as BSON dates, reading their
+// wall clock in location
+func localTimestampConverter(location *time.Location) convertFunc {
+	if location == time.UTC {
+		return timestampConverter
+	}
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		wall, ok := value.(time.Time)
+		if !ok {
+			return timestampConverter(value, raw)
+		}
+		return primitive.NewDateTimeFromTime(inLocation(wall, location)), nil
+	}
+}
+
+// inLocation returns the instant at which the clocks of location show the wall clock of a UTC
+// time. Around DST changes it resolves like PostgreSQL's AT TIME ZONE: a time skipped by a
+// spring-forward gap takes the offset from before the change (02:30 becomes 03:30 daylight
+// time), and a time repeated when clocks fall back takes the offset after it (standard time).
+func inLocation(wall time.Time, location *time.Location) time.Time {
+	wall = wall.UTC()
+	// A change of offset happens at most once within a day around the wall clock
+	_, before := wall.Add(-24 * time.Hour).In(location).Zone()
+	_, after := wall.Add(24 * time.Hour).In(location).Zone()
+	later := wall.Add(-time.Duration(after) * time.Second)
+	if _, offset := later.In(location).Zone(); offset == after {
+		return later
+	}
+	return wall.Add(-time.Duration(before) * time.Second)
+}
+
+// intervalConverter stores interval values in the configured format
+func intervalConverter(format string) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		interval, ok := value.(pgtype.Interval)
+		if !ok {
+			return nil, fmt.Errorf("unexpected interval value of type %T", value)
+		}
+		if format == intervalFormatMicroseconds {
+			return (int64(interval.Months)*30+int64(interval.Days))*microsPerDay + interval.Microseconds, nil
+		}
+		return formatISOInterval(interval), nil
+	}
+}
+
+// formatISOInterval returns an interval in the iso_8601 IntervalStyle of PostgreSQL, where every
+// component carries its own sign, e.g. P1Y-2M3DT-4H
+func formatISOInterval(interval pgtype.Interval) string {
+	var b strings.Builder
+	b.WriteString("P")
+	years, months := interval.Months/12, interval.Months%12
+	for _, part := range []struct {
+		value int64
+		unit  string
+	}{{int64(years), "Y"}, {int64(months), "M"}, {int64(interval.Days), "D"}} {
+		if part.value != 0 {
+			b.WriteString(strconv.FormatInt(part.value, 10) + part.unit)
+		}
+	}
+
+	micros := interval.Microseconds
+	hours := micros / microsPerHour
+	micros -= hours * microsPerHour
+	minutes := micros / microsPerMinute
+	micros -= minutes * microsPerMinute
+	if hours != 0 || minutes != 0 || micros != 0 {
+		b.WriteString("T")
+		if hours != 0 {
+			b.WriteString(strconv.FormatInt(hours, 10) + "H")
+		}
+		if minutes != 0 {
+			b.WriteString(strconv.FormatInt(minutes, 10) + "M")
+		}
+		if micros != 0 {
+			b.WriteString(formatSeconds(micros) + "S")
+		}
+	}
+	if b.Len() == 1 {
+		return "PT0S"
+	}
+	return b.String()
+}
+
+// formatSeconds formats microseconds as seconds without trailing zeros, e.g. -6.5
+func formatSeconds(micros int64) string {
+	sign := ""
+	if micros < 0 {
+		sign, micros = "-", -micros
+	}
+	seconds := strconv.FormatInt(micros/microsPerSecond, 10)
+	if fraction := micros % microsPerSecond; fraction != 0 {
+		seconds += strings.TrimRight(fmt.Sprintf(".%06d", fraction), "0")
+	}
+	return sign + seconds
+}
+
+// timeConverter stores time values, decoded by pgx as microseconds since midnight, in the
+// configured format
+func timeConverter(format string) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		micros, ok := value.(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected time value of type %T", value)
+		}
+		if format == timeFormatMilliseconds {
+			return micros / 1000, nil
+		}
+		return formatTimeOfDay(micros), nil
+	}
+}
+
+// formatTimeOfDay returns microseconds since midnight as HH:MM:SS with the fraction PostgreSQL
+// would print, e.g. 08:30:00 or 23:59:59.5
+func formatTimeOfDay(micros int64) string {
+	hours := micros / microsPerHour
+	minutes := micros % microsPerHour / microsPerMinute
+	seconds := micros % microsPerMinute
+	text := fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds/microsPerSecond)
+	if fraction := seconds % microsPerSecond; fraction != 0 {
+		text += strings.TrimRight(fmt.Sprintf(".%06d", fraction), "0")
+	}
+	return text
+}
+
+// timetzConverter stores timetz values, which pgx returns as the text PostgreSQL prints such as
+// 10:30:00+02, in the configured format
+func timetzConverter(format string) convertFunc {
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected timetz value of type %T", value)
+		}
+		if format != timeFormatMilliseconds {
+			return text, nil
+		}
+		micros, offset, err := parseTimetz(text)
+		if err != nil {
+			return nil, err
+		}
+		utc := ((micros-offset)%microsPerDay + microsPerDay) % microsPerDay
+		return utc / 1000, nil
+	}
+}
+
+// parseTimetz splits a timetz text into microseconds since midnight and its UTC offset in
+// microseconds
+func parseTimetz(text string) (micros, offset int64, err error) {
+	i := strings.LastIndexAny(text, "+-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid timetz value %q: no UTC offset", text)
+	}
+	if micros, err = parseClock(text[:i], true); err != nil {
+		return 0, 0, fmt.Errorf("invalid timetz value %q: %v", text, err)
+	}
+	if offset, err = parseClock(text[i+1:], false); err != nil {
+		return 0, 0, fmt.Errorf("invalid timetz value %q: %v", text, err)
+	}
+	if text[i] == '-' {
+		offset = -offset
+	}
+	return micros, offset, nil
+}
+
+// parseClock parses HH[:MM[:SS[.ffffff]]] into microseconds, requiring minutes and seconds when full
+func parseClock(text string, full bool) (int64, error) {
+	parts := strings.Split(text, ":")
+	if len(parts) > 3 || (full && len(parts) != 3) {
+		return 0, fmt.Errorf("malformed time %q", text)
+	}
+	units := []int64{microsPerHour, microsPerMinute, microsPerSecond}
+	var micros int64
+	for i, part := range parts {
+		if i == 2 {
+			seconds, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return 0, fmt.Errorf("malformed time %q", text)
+			}
+			micros += int64(seconds*float64(microsPerSecond) + 0.5)
+			continue
+		}
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed time %q", text)
+		}
+		micros += n * units[i]
+	}
+	return micros, nil
+}
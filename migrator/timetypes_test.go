@@ -0,0 +1,227 @@
+package migrator
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIntervalFormats(t *testing.T) {
+	const day = 24 * 60 * 60 * int64(1000000)
+	tests := []struct {
+		raw    string
+		iso    string
+		micros int64
+	}{
+		{"1 year 2 mons 3 days 04:05:06.5", "P1Y2M3DT4H5M6.5S", (14*30+3)*day + ((4*60+5)*60+6)*1000000 + 500000},
+		{"3 days", "P3D", 3 * day},
+		{"00:00:00.000001", "PT0.000001S", 1},
+		{"-1 days -02:00:00", "P-1DT-2H", -day - 2*60*60*1000000},
+		{"1 mon -1 days", "P1M-1D", 29 * day},
+		{"00:00:00", "PT0S", 0},
+	}
+	field := column("wait", pgtype.IntervalOID)
+	for _, test := range tests {
+		config := testConfig(t)
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); got != test.iso {
+			t.Errorf("iso8601 %q: got %#v, want %q", test.raw, got, test.iso)
+		}
+		config.Types.IntervalFormat = intervalFormatMicroseconds
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); got != test.micros {
+			t.Errorf("microseconds %q: got %#v, want %d", test.raw, got, test.micros)
+		}
+	}
+}
+
+func TestTimeFormats(t *testing.T) {
+	tests := []struct {
+		oid          uint32
+		raw          string
+		text         string
+		milliseconds int64
+	}{
+		{pgtype.TimeOID, "08:30:00", "08:30:00", 30600000},
+		{pgtype.TimeOID, "23:59:59.5", "23:59:59.5", 86399500},
+		{pgtype.TimeOID, "00:00:00", "00:00:00", 0},
+		{timetzOID, "10:30:00+02", "10:30:00+02", 30600000},
+		{timetzOID, "10:30:00-05:30", "10:30:00-05:30", 57600000},
+		// Converted to UTC the time wraps around midnight
+		{timetzOID, "01:00:00+02", "01:00:00+02", 82800000},
+		{timetzOID, "23:15:00.25-01", "23:15:00.25-01", 900250},
+	}
+	for _, test := range tests {
+		field := column("at", test.oid)
+		config := testConfig(t)
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); got != test.text {
+			t.Errorf("string %q: got %#v, want %q", test.raw, got, test.text)
+		}
+		config.Types.TimeFormat = timeFormatMilliseconds
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); got != test.milliseconds {
+			t.Errorf("milliseconds %q: got %#v, want %d", test.raw, got, test.milliseconds)
+		}
+	}
+}
+
+func TestTimeTypesNull(t *testing.T) {
+	config := testConfig(t)
+	config.Types.IntervalFormat = intervalFormatMicroseconds
+	config.Types.TimeFormat = timeFormatMilliseconds
+	for _, oid := range []uint32{pgtype.IntervalOID, pgtype.TimeOID, timetzOID} {
+		if got, _ := convertColumn(t, column("at", oid), nil, pgTypes{}, config); got != nil {
+			t.Errorf("NULL of type %d: got %#v, want nil", oid, got)
+		}
+	}
+}
+
+func TestParseTimetzInvalid(t *testing.T) {
+	for _, text := range []string{"10:30:00", "10:30+02", "ab:30:00+02", "10:30:00+xx"} {
+		if _, _, err := parseTimetz(text); err == nil {
+			t.Errorf("%q: got no error", text)
+		}
+	}
+}
+
+func TestSourceTimezone(t *testing.T) {
+	tests := []struct {
+		zone string
+		raw  string
+		want string // instant in UTC
+	}{
+		{"", "2024-03-10 02:30:00", "2024-03-10T02:30:00Z"},
+		{"America/New_York", "2024-03-10 01:30:00", "2024-03-10T06:30:00Z"},
+		// Skipped by the spring-forward gap: read with the offset from before, so 03:30 daylight time
+		{"America/New_York", "2024-03-10 02:30:00", "2024-03-10T07:30:00Z"},
+		{"America/New_York", "2024-03-10 03:30:00", "2024-03-10T07:30:00Z"},
+		{"America/New_York", "2024-11-03 00:30:00", "2024-11-03T04:30:00Z"},
+		// Repeated when the clocks fall back: read as standard time
+		{"America/New_York", "2024-11-03 01:30:00", "2024-11-03T06:30:00Z"},
+		{"America/New_York", "2024-11-03 02:30:00", "2024-11-03T07:30:00Z"},
+		{"Europe/Berlin", "2024-07-01 12:00:00", "2024-07-01T10:00:00Z"},
+		{"Europe/Berlin", "2024-01-01 00:00:00.5", "2023-12-31T23:00:00.5Z"},
+		{"Asia/Kolkata", "2024-03-10 02:30:00", "2024-03-09T21:00:00Z"},
+	}
+	for _, test := range tests {
+		config := testConfig(t)
+		config.Types.SourceTimezone = test.zone
+		got, _ := convertColumn(t, column("created_at", pgtype.TimestampOID), []byte(test.raw), pgTypes{}, config)
+		want, err := time.Parse(time.RFC3339Nano, test.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != primitive.NewDateTimeFromTime(want) {
+			t.Errorf("%s %q: got %v, want %s", test.zone, test.raw, got, test.want)
+		}
+	}
+}
+
+func TestSourceTimezoneLeavesTimestamptz(t *testing.T) {
+	config := testConfig(t)
+	config.Types.SourceTimezone = "America/New_York"
+	want := primitive.NewDateTimeFromTime(time.Date(2024, 3, 10, 2, 30, 0, 0, time.UTC))
+	if got, _ := convertColumn(t, column("created_at", pgtype.TimestamptzOID), []byte("2024-03-10 02:30:00+00"), pgTypes{}, config); got != want {
+		t.Errorf("timestamptz: got %v, want %v", got, want)
+	}
+	if got, _ := convertColumn(t, column("created_at", pgtype.TimestampOID), nil, pgTypes{}, config); got != nil {
+		t.Errorf("NULL timestamp: got %#v, want nil", got)
+	}
+	if got, _ := convertColumn(t, column("created_at", pgtype.TimestampOID), []byte("infinity"), pgTypes{}, config); got != "infinity" {
+		t.Errorf("infinite timestamp: got %#v, want infinity", got)
+	}
+}
+
+func TestSourceTimezoneInvalid(t *testing.T) {
+	_, err := loadTestConfig(t, "config.yml", `
+postgres:
+  host: localhost
+  port: 5432
+  database: shop
+  user: app
+  tables: [orders]
+mongodb:
+  uri: mongodb://localhost:27017
+  database: shop
+types:
+  source_timezone: Mars/Olympus_Mons
+`)
+	if err == nil || !strings.Contains(err.Error(), "types.source_timezone") {
+		t.Errorf("got error %v, want one about types.source_timezone", err)
+	}
+}
+
+func TestTimestampOffset(t *testing.T) {
+	instant := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	binary, err := (&pgtype.Timestamptz{Time: instant, Status: pgtype.Present}).EncodeBinary(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryField := column("created_at", pgtype.TimestamptzOID)
+	binaryField.Format = pgtype.BinaryFormatCode
+
+	tests := []struct {
+		zone  string
+		field pgproto3.FieldDescription
+		raw   []byte
+		want  string
+	}{
+		// The server prints timestamptz values in the session zone, whatever offset they were written with
+		{"Asia/Kolkata", column("created_at", pgtype.TimestamptzOID), []byte("2024-03-01 16:00:00+05:30"), "+05:30"},
+		{"Asia/Kolkata", binaryField, binary, "+05:30"},
+		{"America/New_York", binaryField, binary, "-05:00"},
+		{"UTC", binaryField, binary, "+00:00"},
+		{"", column("created_at", pgtype.TimestamptzOID), []byte("2024-03-01 12:30:00+02"), "+00:00"},
+	}
+	config := testConfig(t)
+	config.Types.TimestampOffsetField = true
+	for _, test := range tests {
+		types := pgTypes{}
+		if test.zone != "" {
+			location, err := time.LoadLocation(test.zone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			types.timeZone = location
+		}
+		_, companions := convertColumn(t, test.field, test.raw, types, config)
+		if len(companions) != 1 || companions[0].Key != "created_at_offset" || companions[0].Value != test.want {
+			t.Errorf("%s %q: got companions %v, want created_at_offset %s", test.zone, test.raw, companions, test.want)
+		}
+	}
+
+	// Daylight saving time changes the offset within one zone
+	newYork, _ := time.LoadLocation("America/New_York")
+	_, companions := convertColumn(t, column("created_at", pgtype.TimestamptzOID), []byte("2024-07-01 12:00:00+00"), pgTypes{timeZone: newYork}, config)
+	if len(companions) != 1 || companions[0].Value != "-04:00" {
+		t.Errorf("summer in New York: got companions %v, want -04:00", companions)
+	}
+	_, companions = convertColumn(t, column("created_at", pgtype.TimestamptzOID), nil, pgTypes{timeZone: newYork}, config)
+	if len(companions) != 1 || companions[0].Value != nil {
+		t.Errorf("NULL timestamptz: got companions %v, want a null created_at_offset", companions)
+	}
+}
+
+func TestLoadTimeZone(t *testing.T) {
+	tests := []struct {
+		setting []byte
+		want    string
+	}{
+		{[]byte("Europe/Berlin"), "Europe/Berlin"},
+		{[]byte("<+03>-03"), "UTC"},
+	}
+	for _, test := range tests {
+		source := &fakeSource{results: []fakeResult{
+			{match: "current_setting('TimeZone')", fields: columns("current_setting", pgtype.TextOID), rows: [][][]byte{{test.setting}}},
+		}}
+		types, err := loadTypes(context.Background(), source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := types.timeZone.String(); got != test.want {
+			t.Errorf("TimeZone %s: got %s, want %s", test.setting, got, test.want)
+		}
+	}
+}
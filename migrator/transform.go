@@ -0,0 +1,106 @@
+package migrator
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TransformConfig sets a document field to the output of a Go text/template over the columns
+// of the row, e.g. {{ .first_name }} {{ .last_name }}
+type TransformConfig struct {
+	Field    string `mapstructure:"field"`
+	Template string `mapstructure:"template"`
+}
+
+// transformFuncs are the functions a transform can call besides the text/template builtins
+var transformFuncs = template.FuncMap{
+	"upper": func(value interface{}) string { return strings.ToUpper(templateText(value)) },
+	"lower": func(value interface{}) string { return strings.ToLower(templateText(value)) },
+	"trim":  func(value interface{}) string { return strings.TrimSpace(templateText(value)) },
+	"replace": func(old, new string, value interface{}) string {
+		return strings.ReplaceAll(templateText(value), old, new)
+	},
+	"default": func(fallback, value interface{}) interface{} {
+		if templateText(value) == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// templateText is the text a value prints as in a template
+func templateText(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// transform is a parsed TransformConfig
+type transform struct {
+	field    string
+	template *template.Template
+}
+
+// compileTransforms parses the transforms of a table. A column the template names that is not
+// part of the row fails the row instead of printing <no value>.
+func compileTransforms(table TableConfig) ([]transform, error) {
+	transforms := make([]transform, len(table.Transforms))
+	for i, t := range table.Transforms {
+		if t.Field == "" || t.Field == "_id" {
+			return nil, fmt.Errorf("table %s: transform %d needs a field other than _id", table.Name, i+1)
+		}
+		parsed, err := template.New(t.Field).Funcs(transformFuncs).Option("missingkey=error").Parse(t.Template)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: transform of field %s: %v", table.Name, t.Field, err)
+		}
+		transforms[i] = transform{field: t.Field, template: parsed}
+	}
+	return transforms, nil
+}
+
+// applyTransforms sets the field of every transform in a built document, in place when the field
+// exists and before the metadata fields otherwise. The templates see the converted values of the
+// row by column name, with NULL as an empty string and timestamps as time.Time in UTC.
+func applyTransforms(document bson.D, transforms []transform, columnNames []string, values []interface{}, metadataFields int) (bson.D, error) {
+	data := make(map[string]interface{}, len(columnNames))
+	for i, column := range columnNames {
+		switch v := values[i].(type) {
+		case nil:
+			data[column] = ""
+		case primitive.DateTime:
+			data[column] = v.Time().UTC()
+		default:
+			data[column] = v
+		}
+	}
+
+	var b strings.Builder
+	for _, t := range transforms {
+		b.Reset()
+		if err := t.template.Execute(&b, data); err != nil {
+			return document, fmt.Errorf("transform of field %s: %v", t.field, err)
+		}
+		document = setField(document, t.field, b.String(), metadataFields)
+	}
+	return document, nil
+}
+
+// setField replaces the value of a field, or inserts the field before the last before fields
+func setField(document bson.D, field string, value interface{}, before int) bson.D {
+	for i := range document {
+		if document[i].Key == field {
+			document[i].Value = value
+			return document
+		}
+	}
+	at := len(document) - before
+	document = append(document, bson.E{})
+	copy(document[at+1:], document[at:])
+	document[at] = bson.E{Key: field, Value: value}
+	return document
+}
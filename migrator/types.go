@@ -0,0 +1,133 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// pgTypes describes the user-defined PostgreSQL types pgx has no decoder for. Their OIDs differ
+// between databases, so they are looked up in the catalog before a table is read.
+type pgTypes struct {
+	enums        map[uint32]map[string]int       // enum type OID -> label -> 1-based position
+	enumArrays   map[uint32]uint32               // array type OID -> enum type OID
+	geometries   map[uint32]bool                 // PostGIS geometry and geography type OIDs
+	hstores      map[uint32]bool                 // hstore type OID, when the extension is installed
+	citexts      map[uint32]bool                 // citext type OID, when the extension is installed
+	citextArrays map[uint32]bool                 // citext[] type OID
+	composites   map[uint32][]compositeAttribute // composite type OID -> attributes
+	ranges       map[uint32]uint32               // range type OID -> subtype OID
+	timeZone     *time.Location                  // session TimeZone, in which the server prints timestamptz values
+}
+
+// loadTypes reads the enum types of the database with their labels in sort order, and the
+// PostGIS, hstore and citext types if the extensions are installed, the attributes of composite types and
+// the subtypes of range types, and the session TimeZone
+func loadTypes(ctx context.Context, pgConn RowSource) (pgTypes, error) {
+	types := pgTypes{enums: map[uint32]map[string]int{}, enumArrays: map[uint32]uint32{}, geometries: map[uint32]bool{}, hstores: map[uint32]bool{}, citexts: map[uint32]bool{}, citextArrays: map[uint32]bool{}, composites: map[uint32][]compositeAttribute{}, ranges: map[uint32]uint32{}}
+
+	query := `
+		SELECT t.oid, t.typarray, e.enumlabel
+		FROM pg_type t
+		JOIN pg_enum e ON e.enumtypid = t.oid
+		ORDER BY t.oid, e.enumsortorder
+	`
+
+	rows, err := pgConn.Query(ctx, query)
+	if err != nil {
+		return types, fmt.Errorf("error querying PostgreSQL for enum types: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid, arrayOID uint32
+		var label string
+		if err := rows.Scan(&oid, &arrayOID, &label); err != nil {
+			return types, fmt.Errorf("error scanning enum type: %v", err)
+		}
+		labels, ok := types.enums[oid]
+		if !ok {
+			labels = map[string]int{}
+			types.enums[oid] = labels
+			if arrayOID != 0 {
+				types.enumArrays[arrayOID] = oid
+			}
+		}
+		labels[label] = len(labels) + 1
+	}
+
+	if err := rows.Err(); err != nil {
+		return types, fmt.Errorf("error iterating enum types: %v", err)
+	}
+
+	if err := loadTypeOIDs(ctx, pgConn, "geometry", []string{"geometry", "geography"}, types.geometries); err != nil {
+		return types, err
+	}
+	if err := loadTypeOIDs(ctx, pgConn, "hstore", []string{"hstore"}, types.hstores); err != nil {
+		return types, err
+	}
+	if err := loadTypeOIDs(ctx, pgConn, "citext", []string{"citext"}, types.citexts); err != nil {
+		return types, err
+	}
+	if err := loadTypeOIDs(ctx, pgConn, "citext[]", []string{"_citext"}, types.citextArrays); err != nil {
+		return types, err
+	}
+	if err := loadCompositeTypes(ctx, pgConn, types); err != nil {
+		return types, err
+	}
+	if err := loadRangeTypes(ctx, pgConn, types); err != nil {
+		return types, err
+	}
+	types.timeZone, err = loadTimeZone(ctx, pgConn)
+	return types, err
+}
+
+// loadTimeZone reads the TimeZone setting of the session. pgx decodes binary timestamptz values
+// in the local zone of the process, so offsets are taken in this zone instead, as psql would
+// print them. A setting Go does not know, such as a POSIX zone, falls back to UTC with a warning.
+func loadTimeZone(ctx context.Context, pgConn RowSource) (*time.Location, error) {
+	rows, err := pgConn.Query(ctx, `SELECT current_setting('TimeZone')`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying PostgreSQL for the session time zone: %v", err)
+	}
+	defer rows.Close()
+
+	name := "UTC"
+	for rows.Next() {
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("error scanning the session time zone: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating the session time zone: %v", err)
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		logger.Warn("Session TimeZone %q is not a known time zone (%v), timestamptz offsets are taken in UTC", name, err)
+		return time.UTC, nil
+	}
+	return location, nil
+}
+
+// loadTypeOIDs records the OIDs of the extension types with the given names in oids
+func loadTypeOIDs(ctx context.Context, pgConn RowSource, kind string, names []string, oids map[uint32]bool) error {
+	rows, err := pgConn.Query(ctx, `SELECT oid FROM pg_type WHERE typname = ANY($1)`, names)
+	if err != nil {
+		return fmt.Errorf("error querying PostgreSQL for %s types: %v", kind, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid uint32
+		if err := rows.Scan(&oid); err != nil {
+			return fmt.Errorf("error scanning %s type: %v", kind, err)
+		}
+		oids[oid] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating %s types: %v", kind, err)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Levels of the validator created with mongodb.create_validator, passed on as MongoDB's validationLevel
+const (
+	validationStrict   = "strict"   // every insert and update is checked
+	validationModerate = "moderate" // updates of documents that did not match already are not checked
+)
+
+// bsonTypes returns the BSON types a column is stored as after conversion, or nil when the
+// column can hold values of any type, such as json. Timestamps and numerics allow a string
+// for infinity and for numbers too large for Decimal128.
+func bsonTypes(field pgproto3.FieldDescription, types pgTypes, config Config) []string {
+	pick := func(condition bool, yes, no string) []string {
+		if condition {
+			return []string{yes}
+		}
+		return []string{no}
+	}
+	// Values over mongodb.gridfs_threshold become references to their GridFS file
+	if config.MongoDB.GridFSThreshold > 0 {
+		switch field.DataTypeOID {
+		case pgtype.ByteaOID, pgtype.TextOID, pgtype.VarcharOID:
+			inline := config
+			inline.MongoDB.GridFSThreshold = 0
+			return append(bsonTypes(field, types, inline), "object")
+		}
+	}
+	switch field.DataTypeOID {
+	case pgtype.BoolOID:
+		return []string{"bool"}
+	case pgtype.Int2OID, pgtype.Int4OID:
+		return []string{"int"}
+	case pgtype.Int8OID:
+		return []string{"long"}
+	case pgtype.Float4OID, pgtype.Float8OID:
+		return []string{"double"}
+	case pgtype.NumericOID:
+		return []string{"decimal", "string"}
+	case moneyOID:
+		return []string{"decimal"}
+	case pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID, pgtype.NameOID, pgtype.MacaddrOID:
+		return []string{"string"}
+	case pgtype.TimestampOID, pgtype.TimestamptzOID, pgtype.DateOID:
+		return []string{"date", "string"}
+	case pgtype.UUIDOID:
+		return pick(config.Types.UUIDFormat == uuidFormatBinary, "binData", "string")
+	case pgtype.ByteaOID:
+		return pick(config.Types.ByteaFormat == byteaFormatBase64, "string", "binData")
+	case pgtype.BitOID, pgtype.VarbitOID:
+		return pick(config.Types.BitFormat == bitFormatBinary, "binData", "string")
+	case pgtype.InetOID, pgtype.CIDROID:
+		return pick(config.Types.InetFormat == inetFormatDocument, "object", "string")
+	case pgtype.IntervalOID:
+		return pick(config.Types.IntervalFormat == intervalFormatMicroseconds, "long", "string")
+	case pgtype.TimeOID, timetzOID:
+		return pick(config.Types.TimeFormat == timeFormatMilliseconds, "long", "string")
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		if config.Types.JSONAsString {
+			return []string{"string"}
+		}
+		return nil
+	case xmlOID:
+		if config.Types.XMLFormat == xmlFormatDocument {
+			return []string{"object", "string"}
+		}
+		return []string{"string"}
+	}
+
+	if _, ok := arrayElementOIDs[field.DataTypeOID]; ok {
+		return []string{"array"}
+	}
+	if _, ok := types.enums[field.DataTypeOID]; ok {
+		return []string{"string"}
+	}
+	if _, ok := types.enumArrays[field.DataTypeOID]; ok {
+		return []string{"array"}
+	}
+	if types.geometries[field.DataTypeOID] {
+		return []string{"object", "string"}
+	}
+	if types.hstores[field.DataTypeOID] {
+		return []string{"object"}
+	}
+	if types.citexts[field.DataTypeOID] {
+		return []string{"string"}
+	}
+	if types.citextArrays[field.DataTypeOID] {
+		return []string{"array"}
+	}
+	if _, ok := types.composites[field.DataTypeOID]; ok {
+		return []string{"object"}
+	}
+	if _, ok := types.ranges[field.DataTypeOID]; ok {
+		return pick(config.Types.RangeFormat == rangeFormatString, "string", "object")
+	}
+	return nil
+}
+
+// attribute identifies a table column by the OID of its table and its column number
+type attribute struct {
+	table  uint32
+	number uint16
+}
+
+// loadNotNullColumns reads the columns declared NOT NULL of a table, or for a custom query those of
+// every table outside the system schemas, since its result columns may come from any of them. It
+// runs before the table query, whose rows keep the connection busy until they are read.
+func loadNotNullColumns(ctx context.Context, pgConn RowSource, table TableConfig) (map[attribute]bool, error) {
+	query := `
+		SELECT a.attrelid, a.attnum
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE a.attnum > 0 AND a.attnotnull AND NOT a.attisdropped
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+	`
+	var args []interface{}
+	if table.Query == "" {
+		query += " AND a.attrelid = $1::regclass"
+		args = append(args, quoteTableName(table.Name))
+	}
+
+	rows, err := pgConn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up NOT NULL columns of table %s: %v", table.Name, err)
+	}
+	defer rows.Close()
+
+	notNull := map[attribute]bool{}
+	for rows.Next() {
+		var relation uint32
+		var number int16
+		if err := rows.Scan(&relation, &number); err != nil {
+			return nil, fmt.Errorf("error scanning NOT NULL column of table %s: %v", table.Name, err)
+		}
+		notNull[attribute{table: relation, number: uint16(number)}] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error looking up NOT NULL columns of table %s: %v", table.Name, err)
+	}
+	return notNull, nil
+}
+
+// notNullColumns reports for every result column whether it is a table column declared NOT NULL,
+// given the columns of loadNotNullColumns. Computed columns of a custom query count as nullable.
+func notNullColumns(fields []pgproto3.FieldDescription, declared map[attribute]bool) []bool {
+	notNull := make([]bool, len(fields))
+	for i, field := range fields {
+		notNull[i] = declared[attribute{table: field.TableOID, number: field.TableAttributeNumber}]
+	}
+	return notNull
+}
+
+// documentValidator builds the $jsonSchema validator of the documents of a table: every column
+// field gets the bsonType of its converted values, plus null unless the column is NOT NULL, and the
+// fields every document has are required. Fields other than the columns, such as metadata, companions and
+// embedded arrays, are allowed without checks, and so are the fields of skip.
+func documentValidator(fields []pgproto3.FieldDescription, names []string, notNull []bool, skip map[string]bool, types pgTypes, config Config) bson.D {
+	properties := bson.D{}
+	required := bson.A{}
+	for i, field := range fields {
+		name := names[i]
+		bsonType := bsonTypes(field, types, config)
+		if name == "_id" || skip[name] || bsonType == nil {
+			continue
+		}
+		// Empty strings may become null, NULL arrays [] and nulls are left out with omit_nulls
+		nullable := !notNull[i] || (config.MongoDB.EmptyStringAsNull && contains(bsonType, "string"))
+		emptyArray := config.MongoDB.NullArrayAsEmpty && bsonType[0] == "array"
+		switch {
+		case !nullable || emptyArray:
+			required = append(required, name)
+		case !config.MongoDB.OmitNulls:
+			bsonType = append(bsonType, "null")
+		}
+
+		var value interface{} = bsonType[0]
+		if len(bsonType) > 1 {
+			allowed := make(bson.A, len(bsonType))
+			for j, t := range bsonType {
+				allowed[j] = t
+			}
+			value = allowed
+		}
+		properties = append(properties, bson.E{Key: name, Value: bson.D{{Key: "bsonType", Value: value}}})
+	}
+
+	schema := bson.D{{Key: "bsonType", Value: "object"}}
+	if len(required) > 0 {
+		schema = append(schema, bson.E{Key: "required", Value: required})
+	}
+	schema = append(schema, bson.E{Key: "properties", Value: properties})
+	return bson.D{{Key: "$jsonSchema", Value: schema}}
+}
+
+// contains reports whether values holds value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyValidator creates the collection with validator, or sets it on an existing collection with
+// collMod, replacing a validator it had. Existing documents are not checked either way.
+func applyValidator(ctx context.Context, collection *mongo.Collection, validator bson.D, config Config) error {
+	level := config.MongoDB.ValidationLevel
+	if config.Migration.DryRun {
+		text, err := bson.MarshalExtJSON(validator, false, false)
+		if err != nil {
+			return fmt.Errorf("error encoding the validator of MongoDB collection %s: %v", collection.Name(), err)
+		}
+		logger.Info("Dry run: would set the %s validator %s on MongoDB collection %s.", level, text, collection.Name())
+		return nil
+	}
+
+	db := collection.Database()
+	specs, err := db.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collection.Name()}})
+	if err != nil {
+		return fmt.Errorf("error looking up MongoDB collection %s: %v", collection.Name(), err)
+	}
+	if len(specs) == 0 {
+		createOptions := options.CreateCollection().SetValidator(validator).SetValidationLevel(level)
+		if err := db.CreateCollection(ctx, collection.Name(), createOptions); err != nil {
+			return fmt.Errorf("error creating MongoDB collection %s with a validator: %v", collection.Name(), err)
+		}
+		logger.Info("Created MongoDB collection %s with a %s validator.", collection.Name(), level)
+		return nil
+	}
+	command := bson.D{{Key: "collMod", Value: collection.Name()}, {Key: "validator", Value: validator}, {Key: "validationLevel", Value: level}}
+	if err := db.RunCommand(ctx, command).Err(); err != nil {
+		return fmt.Errorf("error setting the validator of MongoDB collection %s: %v", collection.Name(), err)
+	}
+	logger.Info("Set a %s validator on MongoDB collection %s.", level, collection.Name())
+	return nil
+}
@@ -0,0 +1,50 @@
+package migrator
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+func TestNotNullColumns(t *testing.T) {
+	const ordersOID, customersOID = 16384, 16390
+	source := &fakeSource{results: []fakeResult{{
+		match:  "attnotnull",
+		fields: columns("attrelid", pgtype.OIDOID, "attnum", pgtype.Int2OID),
+		rows:   [][][]byte{textRow("16384", "1"), textRow("16384", "3"), textRow("16390", "1")},
+	}}}
+
+	declared, err := loadNotNullColumns(context.Background(), source, TableConfig{Name: "public.orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[attribute]bool{{ordersOID, 1}: true, {ordersOID, 3}: true, {customersOID, 1}: true}
+	if !reflect.DeepEqual(declared, want) {
+		t.Errorf("got %v, want %v", declared, want)
+	}
+	if queries := source.queried("attnotnull"); len(queries) != 1 || !strings.Contains(queries[0], "regclass") {
+		t.Errorf("got queries %q, want one restricted to the table", queries)
+	}
+	// The columns of a custom query may come from any table
+	if _, err := loadNotNullColumns(context.Background(), source, TableConfig{Name: "report", Query: "SELECT 1"}); err != nil {
+		t.Fatal(err)
+	}
+	if queries := source.queried("attnotnull"); len(queries) != 2 || strings.Contains(queries[1], "regclass") {
+		t.Errorf("got queries %q, want the second one over every table", queries)
+	}
+
+	fields := []pgproto3.FieldDescription{
+		{Name: []byte("id"), TableOID: ordersOID, TableAttributeNumber: 1},
+		{Name: []byte("note"), TableOID: ordersOID, TableAttributeNumber: 2},
+		{Name: []byte("total"), TableOID: ordersOID, TableAttributeNumber: 3},
+		{Name: []byte("customer_id"), TableOID: customersOID, TableAttributeNumber: 1},
+		{Name: []byte("computed")},
+	}
+	if got := notNullColumns(fields, declared); !reflect.DeepEqual(got, []bool{true, false, true, true, false}) {
+		t.Errorf("got %v, want [true false true true false]", got)
+	}
+}
@@ -0,0 +1,97 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// VerifyResult compares the row count of a table with the document count of its collection
+type VerifyResult struct {
+	Table      string
+	Collection string
+	Expected   int64 // rows matching the table's filter
+	Actual     int64 // documents in the collection
+}
+
+// Mismatch reports whether the counts differ
+func (r VerifyResult) Mismatch() bool {
+	return r.Expected != r.Actual
+}
+
+// VerifyTables counts the rows of every configured table, honouring its where filter or custom query,
+// and the documents of its collection. Rows read by earlier incremental runs are counted too,
+// since their documents are still in the collection. The documents of a merged table are told
+// apart by its source field, merged tables without one are compared together with their collection.
+func VerifyTables(ctx context.Context, pgConn RowSource, mongoClient *mongo.Client, config Config) ([]VerifyResult, error) {
+	var results []VerifyResult
+	// Position in results of the merged collections without a source field
+	combined := map[string]int{}
+	for _, table := range config.Postgres.Tables {
+		collection := mongoClient.Database(databaseName(table, config)).Collection(collectionName(table, config))
+		result := VerifyResult{Table: table.Name, Collection: collection.Name()}
+		filter := bson.D{}
+		if table.SourceField != "" {
+			filter = bson.D{{Key: table.SourceField, Value: sourceTable(table, config)}}
+		}
+
+		// A sampled table is expected to have at most its limit of documents, in any order
+		counted := sampled(table, config)
+		counted.RandomSample = false
+		query, args := buildSelectQuery(counted, nil, nil, 0)
+		countQuery := fmt.Sprintf("SELECT count(*) FROM (%s) AS source", query)
+		if err := pgConn.QueryRow(ctx, countQuery, args...).Scan(&result.Expected); err != nil {
+			return results, fmt.Errorf("error counting rows of table %s: %v", table.Name, err)
+		}
+
+		target := databaseName(table, config) + "." + collection.Name()
+		if i, ok := combined[target]; ok {
+			results[i].Table += ", " + table.Name
+			results[i].Expected += result.Expected
+			continue
+		}
+
+		count, err := collection.CountDocuments(ctx, filter)
+		if err != nil {
+			return results, fmt.Errorf("error counting documents of MongoDB collection %s: %v", collection.Name(), err)
+		}
+		result.Actual = count
+
+		// An empty table is migrated as a collection holding one empty document
+		if result.Expected == 0 && result.Actual == 1 && table.merge == nil {
+			var document bson.D
+			if err := collection.FindOne(ctx, bson.D{}).Decode(&document); err == nil && len(document) == 1 && document[0].Key == "_id" {
+				result.Actual = 0
+			}
+		}
+
+		if table.merge != nil && table.SourceField == "" {
+			combined[target] = len(results)
+		}
+		results = append(results, result)
+	}
+	for _, result := range results {
+		if result.Mismatch() {
+			logger.Error("Table %s has %d rows but MongoDB collection %s has %d documents", result.Table, result.Expected, result.Collection, result.Actual)
+		}
+	}
+	return results, nil
+}
+
+// PrintVerification writes a table of expected and actual counts to stdout
+func PrintVerification(results []VerifyResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "TABLE\tCOLLECTION\tEXPECTED\tACTUAL\tSTATUS\t")
+	for _, r := range results {
+		status := "ok"
+		if r.Mismatch() {
+			status = "MISMATCH"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t\n", r.Table, r.Collection, r.Expected, r.Actual, status)
+	}
+	w.Flush()
+}
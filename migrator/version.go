@@ -0,0 +1,17 @@
+package migrator
+
+import "fmt"
+
+// Build information, injected at build time, e.g.
+//
+//	go build -ldflags "-X cmd_pg_mongo/migrator.Version=1.2.0 -X cmd_pg_mongo/migrator.Commit=$(git rev-parse --short HEAD)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// VersionString describes the running build on one line
+func VersionString() string {
+	return fmt.Sprintf("cmd_pg_mongo %s (commit %s, built %s)", Version, Commit, BuildDate)
+}
@@ -0,0 +1,125 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// xmlOID is the type OID of xml, which pgtype does not register, so pgx returns its text
+const xmlOID = 142
+
+// Storage formats of xml columns (types.xml_format)
+const (
+	xmlFormatString   = "string"   // the XML text as it is
+	xmlFormatDocument = "document" // elements as sub-documents, see parseXML
+)
+
+// Field names of a parsed XML element besides its children
+const (
+	xmlAttributePrefix = "@"     // prefix of the attributes of an element
+	xmlTextField       = "#text" // text of an element that also has attributes or children
+)
+
+// xmlConverter stores xml columns as strings, or parsed with xml_format: document. A value that
+// does not parse is stored as a string with a warning, once per column.
+func xmlConverter(table, column, format string) convertFunc {
+	warned := false
+	return func(value interface{}, raw []byte) (interface{}, error) {
+		if format != xmlFormatDocument {
+			return string(raw), nil
+		}
+		parsed, err := parseXML(raw)
+		if err != nil {
+			if !warned {
+				logger.Warn("Table %s column %s has malformed XML (%v), storing it as a string", table, column, err)
+				warned = true
+			}
+			return string(raw), nil
+		}
+		return parsed, nil
+	}
+}
+
+// parseXML turns an XML document or content fragment into a document with a field per top-level
+// element. An element becomes a sub-document of its attributes (named @name) and child elements,
+// in document order, with a child name that repeats collecting its elements in an array. Text
+// next to attributes or children goes into #text, trimmed; an element holding only text becomes
+// that string. Namespace declarations, comments and processing instructions are left out, and
+// names are used without their namespace prefix. A fragment without elements stays a string.
+func parseXML(text []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(text))
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		current := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				node.fields = append(node.fields, bson.E{Key: xmlAttributePrefix + attr.Name.Local, Value: attr.Value})
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1].add(current.name, current.value())
+		case xml.CharData:
+			current.text.Write(t)
+		}
+	}
+	if len(stack) > 1 {
+		return nil, errors.New("unexpected end of XML")
+	}
+	if len(root.fields) == 0 {
+		return string(text), nil
+	}
+	return root.value(), nil
+}
+
+// xmlNode collects an element while it is parsed
+type xmlNode struct {
+	name   string
+	fields bson.D
+	text   strings.Builder
+}
+
+// add appends a child element, turning the field into an array when the name repeats
+func (n *xmlNode) add(name string, value interface{}) {
+	for i := range n.fields {
+		if n.fields[i].Key != name {
+			continue
+		}
+		if values, ok := n.fields[i].Value.(bson.A); ok {
+			n.fields[i].Value = append(values, value)
+		} else {
+			n.fields[i].Value = bson.A{n.fields[i].Value, value}
+		}
+		return
+	}
+	n.fields = append(n.fields, bson.E{Key: name, Value: value})
+}
+
+// value is the BSON value of a parsed element
+func (n *xmlNode) value() interface{} {
+	if len(n.fields) == 0 {
+		return n.text.String()
+	}
+	if text := strings.TrimSpace(n.text.String()); text != "" {
+		return append(n.fields, bson.E{Key: xmlTextField, Value: text})
+	}
+	return n.fields
+}
@@ -0,0 +1,62 @@
+package migrator
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestXMLFormats(t *testing.T) {
+	tests := []struct {
+		raw      string
+		document interface{}
+	}{
+		{`<book id="1"><author>A</author><author>B</author></book>`, bson.D{{Key: "book", Value: bson.D{
+			{Key: "@id", Value: "1"},
+			{Key: "author", Value: bson.A{"A", "B"}},
+		}}}},
+		{`<order no="7" status="open"><customer><name>Ann</name><address city="Oslo"/></customer><line sku="a">2</line></order>`,
+			bson.D{{Key: "order", Value: bson.D{
+				{Key: "@no", Value: "7"},
+				{Key: "@status", Value: "open"},
+				{Key: "customer", Value: bson.D{
+					{Key: "name", Value: "Ann"},
+					{Key: "address", Value: bson.D{{Key: "@city", Value: "Oslo"}}},
+				}},
+				{Key: "line", Value: bson.D{{Key: "@sku", Value: "a"}, {Key: "#text", Value: "2"}}},
+			}}}},
+		{`<note>  see <b>this</b> </note>`, bson.D{{Key: "note", Value: bson.D{{Key: "b", Value: "this"}, {Key: "#text", Value: "see"}}}}},
+		{`<?xml version="1.0"?><!-- shipped --><x:item xmlns:x="urn:shop" x:ref="9">&lt;ok&gt;</x:item>`,
+			bson.D{{Key: "item", Value: bson.D{{Key: "@ref", Value: "9"}, {Key: "#text", Value: "<ok>"}}}}},
+		// A content fragment with several top-level elements, and one without elements
+		{`<a>1</a><b>2</b><a>3</a>`, bson.D{{Key: "a", Value: bson.A{"1", "3"}}, {Key: "b", Value: "2"}}},
+		{`plain text`, "plain text"},
+		{`<empty/>`, bson.D{{Key: "empty", Value: ""}}},
+	}
+	field := column("body", xmlOID)
+	for _, test := range tests {
+		config := testConfig(t)
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); got != test.raw {
+			t.Errorf("string %q: got %#v", test.raw, got)
+		}
+		config.Types.XMLFormat = xmlFormatDocument
+		if got, _ := convertColumn(t, field, []byte(test.raw), pgTypes{}, config); !reflect.DeepEqual(got, test.document) {
+			t.Errorf("document %q: got %#v, want %#v", test.raw, got, test.document)
+		}
+	}
+}
+
+func TestXMLMalformed(t *testing.T) {
+	config := testConfig(t)
+	config.Types.XMLFormat = xmlFormatDocument
+	field := column("body", xmlOID)
+	for _, raw := range []string{`<book><author>A</book>`, `<book>`, `<book id=1/>`, `<a></b>`} {
+		if got, _ := convertColumn(t, field, []byte(raw), pgTypes{}, config); got != raw {
+			t.Errorf("%q: got %#v, want the text", raw, got)
+		}
+	}
+	if got, _ := convertColumn(t, field, nil, pgTypes{}, config); got != nil {
+		t.Errorf("NULL: got %#v, want nil", got)
+	}
+}